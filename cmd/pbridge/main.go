@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"pbridge/pkg/apiserver"
 	"pbridge/pkg/config"
 	"pbridge/pkg/ebpf"
 	"pbridge/pkg/logging"
+	"pbridge/pkg/sessionstore"
 	"pbridge/pkg/wgclient"
 	"pbridge/pkg/wgserver"
 	"pbridge/testclient"
@@ -27,6 +30,12 @@ var (
 	flagConnectUsername = commandConnect.Flag("username", "Username").Required().String()
 	flagConnectPassword = commandConnect.Flag("password", "Password").Required().String()
 	flagConnectServers  = commandConnect.Flag("server", "Server").Required().Strings()
+	flagConnectOnion    = commandConnect.Flag("onion", "Encrypt next hops with onion layers").Bool()
+
+	commandMigrate    = app.Command("migrate", "Move sessions from the configured session store to another one")
+	flagMigrateConfig = commandMigrate.Flag("config", "Path to the configuration file").Required().ExistingFile()
+	flagMigrateType   = commandMigrate.Flag("to-type", "Target store type").Required().Enum("dir", "bolt", "journal")
+	flagMigratePath   = commandMigrate.Flag("to-path", "Target directory or database file").Required().String()
 )
 
 func main() {
@@ -34,7 +43,9 @@ func main() {
 	case commandStart.FullCommand():
 		actionStart(*flagConfig)
 	case commandConnect.FullCommand():
-		testclient.Connect(*flagConnectUsername, *flagConnectPassword, *flagConnectServers)
+		testclient.Connect(*flagConnectUsername, *flagConnectPassword, *flagConnectServers, *flagConnectOnion)
+	case commandMigrate.FullCommand():
+		actionMigrate(*flagMigrateConfig, *flagMigrateType, *flagMigratePath)
 	}
 }
 
@@ -68,7 +79,7 @@ func actionStart(configPath string) {
 	}
 
 	// Initialize the Wireguard server
-	wgServer := wgserver.New(&cfg.Wireguard.Server)
+	wgServer := wgserver.New(&cfg.Wireguard.Server, cfg.Wireguard.Adopt)
 	err = wgServer.Init()
 	if err != nil {
 		slog.Error("error initializing wireguard server", slog.Any("err", err))
@@ -77,8 +88,18 @@ func actionStart(configPath string) {
 	}
 	defer wgServer.Close()
 
+	if cfg.API.Exit.Enabled {
+		slog.Info("exit mode enabled, setup NAT")
+		err = wgServer.EnableExitNAT()
+		if err != nil {
+			slog.Error("error enabling exit NAT", slog.Any("err", err))
+			os.Exit(1)
+			return
+		}
+	}
+
 	// Initialize the Wireguard client
-	wgClient := wgclient.New(&cfg.Wireguard.Client)
+	wgClient := wgclient.New(&cfg.Wireguard.Client, cfg.Wireguard.Adopt)
 	err = wgClient.Init()
 	if err != nil {
 		slog.Error("error initializing wireguard client", slog.Any("err", err))
@@ -100,6 +121,16 @@ func actionStart(configPath string) {
 		return
 	}
 
+	// drop kernel state of the previous run which no restored session has claimed
+	err = wgServer.Reconcile()
+	if err != nil {
+		slog.Error("error reconciling wireguard server", slog.Any("err", err))
+	}
+	err = wgClient.Reconcile()
+	if err != nil {
+		slog.Error("error reconciling wireguard client", slog.Any("err", err))
+	}
+
 	go MustRun("API server", apiServer.ListenAndServe)
 
 	slog.Info("started")
@@ -107,6 +138,49 @@ func actionStart(configPath string) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
+
+	slog.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	apiServer.Shutdown(ctx)
+	cancel()
+}
+
+// actionMigrate copies sessions to another store, the bridge has to be stopped, then its configuration is switched
+// to the target store.
+func actionMigrate(configPath string, toType string, toPath string) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		slog.Error("error loading configuration", slog.Any("err", err))
+		os.Exit(1)
+		return
+	}
+
+	from, err := sessionstore.Open(cfg.API.SessionStore, cfg.API.SessionStorage)
+	if err != nil {
+		slog.Error("error opening session store", slog.Any("err", err))
+		os.Exit(1)
+		return
+	}
+	defer from.Close()
+
+	// sessions are encrypted with the current key of the configured store
+	to, err := sessionstore.Open(config.SessionStoreConfig{Type: toType, Encryption: cfg.API.SessionStore.Encryption},
+		toPath)
+	if err != nil {
+		slog.Error("error opening target session store", slog.Any("err", err))
+		os.Exit(1)
+		return
+	}
+	defer to.Close()
+
+	migrated, err := sessionstore.Migrate(from, to)
+	if err != nil {
+		slog.Error("error migrating sessions", slog.Any("err", err))
+		os.Exit(1)
+		return
+	}
+	slog.Info("sessions migrated", slog.Int("sessions", migrated), slog.String("type", toType),
+		slog.String("path", toPath))
 }
 
 func MustRun(name string, fn func() error) {
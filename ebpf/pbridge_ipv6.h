@@ -27,6 +27,13 @@ static __always_inline int handle_ipv6(struct xdp_md *ctx) {
   src_ip.family = AF_INET6;
   __builtin_memcpy(&src_ip.addr.v6, &iph->saddr, sizeof(struct in6_addr));
   struct rule *src_rule = bpf_map_lookup_elem(&src_rules, &src_ip);
+  if (src_rule && src_rule->ifindex == 0) {
+    // exit rule: traffic is terminated on this node, pass it to the kernel network stack
+    src_rule->counter_packets++;
+    src_rule->counter_bytes += (ctx->data_end - ctx->data);
+    src_rule->last_seen = bpf_ktime_get_ns();
+    return XDP_PASS;
+  }
   if (src_rule) {
 //    bpf_printk("src match\n");
     __builtin_memcpy(prev_ip, &iph->saddr, sizeof(struct in6_addr));
@@ -38,6 +45,7 @@ static __always_inline int handle_ipv6(struct xdp_md *ctx) {
 
     src_rule->counter_packets++;
     src_rule->counter_bytes += (ctx->data_end - ctx->data);
+    src_rule->last_seen = bpf_ktime_get_ns();
   }
 
   // check and use dst rule
@@ -16,6 +16,8 @@ struct rule {
 
   __u64 counter_packets;
   __u64 counter_bytes;
+  // monotonic time of the last packet from the source in ns, src rules only
+  __u64 last_seen;
 };
 
 #endif
\ No newline at end of file
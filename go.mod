@@ -9,8 +9,9 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/henvic/httpretty v0.1.4
 	github.com/lmittmann/tint v1.0.7
-	github.com/stretchr/testify v1.9.0
+	github.com/stretchr/testify v1.10.0
 	github.com/vishvananda/netlink v1.3.0
+	go.etcd.io/bbolt v1.4.0
 	golang.org/x/crypto v0.32.0
 	golang.org/x/sys v0.29.0
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20241231184526-a9ab2273dd10
@@ -1,43 +1,134 @@
 package apiserver
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"pbridge/pkg/config"
+	"pbridge/pkg/hoppolicy"
 	"pbridge/pkg/listeners"
-	"pbridge/pkg/wgclient"
-	"pbridge/pkg/wgserver"
+	"pbridge/pkg/prober"
+	"pbridge/pkg/sessionstore"
+	"pbridge/pkg/token"
 	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type Service struct {
 	http.Handler
 
-	cfg      config.APIConfig
-	c        *http.Client
-	wgServer *wgserver.Service
-	wgClient *wgclient.Service
+	cfg       config.APIConfig
+	c         *http.Client
+	wgServer  WireguardServer
+	wgClient  WireguardClient
+	onionKey  wgtypes.Key
+	hopPolicy *hoppolicy.Policy
+	prober    LatencyProber
+	auth      Authenticator
+	// client access token verifier, nil if not configured
+	tokenVerifier *token.Verifier
 
-	saveCh chan struct{}
+	store sessionstore.Store
+	// encoded sessions as they are in the store, guarded by saveLock
+	saved        map[string][]byte
+	saveCh       chan struct{}
+	saveLock     sync.Mutex
+	teardownCh   chan *teardownTask
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+	// expire, save and teardown workers, stopped on shutdown
+	workers sync.WaitGroup
 
 	lock     sync.Mutex
 	sessions map[string]*Session
+	// ids of sessions changed since the previous save
+	dirty      map[string]struct{}
+	tombstones map[string]tombstone
+	// connects with idempotency key by client
+	connects map[string]*idempotentConnect
+	// connects in progress by owner, counted against max sessions
+	pendingSessions map[string]int
+	// events stream tickets by hash
+	eventsTickets map[string]eventsTicket
+	// outcome of restoring stored sessions on startup
+	restoreReport *RestoreReport
 }
 
-func New(cfg config.APIConfig, wgServer *wgserver.Service, wgClient *wgclient.Service) (*Service, error) {
+func New(cfg config.APIConfig, wgServer WireguardServer, wgClient WireguardClient) (*Service, error) {
 	s := &Service{
-		cfg:      cfg,
-		c:        &http.Client{},
-		wgServer: wgServer,
-		wgClient: wgClient,
-		saveCh:   make(chan struct{}, 1),
-		sessions: map[string]*Session{},
+		cfg:        cfg,
+		c:          &http.Client{},
+		wgServer:   wgServer,
+		wgClient:   wgClient,
+		saveCh:     make(chan struct{}, 1),
+		teardownCh: make(chan *teardownTask, cfg.Teardown.GetQueueSize()),
+		shutdownCh: make(chan struct{}),
+		saved:      map[string][]byte{},
+		sessions:   map[string]*Session{},
+		dirty:      map[string]struct{}{},
+		tombstones: map[string]tombstone{},
+		connects:   map[string]*idempotentConnect{},
+
+		pendingSessions: map[string]int{},
+		eventsTickets:   map[string]eventsTicket{},
+	}
+
+	var err error
+	s.onionKey, err = loadOnionKey(cfg.OnionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading onion key: %v", err)
+	}
+
+	s.store, err = sessionstore.Open(cfg.SessionStore, cfg.SessionStorage)
+	if err != nil {
+		return nil, fmt.Errorf("error opening session store: %v", err)
+	}
+
+	s.auth, err = newAuthenticator(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating client authenticator: %v", err)
+	}
+
+	s.tokenVerifier, err = token.NewVerifier(cfg.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("error creating access token verifier: %v", err)
+	}
+
+	switch cfg.GetOnStaleUpstream() {
+	case StaleUpstreamNone, StaleUpstreamReestablish, StaleUpstreamTeardown:
+	default:
+		return nil, fmt.Errorf("invalid on_stale_upstream: %s", cfg.OnStaleUpstream)
+	}
+	wgClient.SetStaleHandler(s.handleStaleUpstream)
+
+	s.hopPolicy, err = hoppolicy.New(cfg.HopPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("error loading hop policy: %v", err)
 	}
+	// probes are subject to the same address rules as API requests
+	s.prober = prober.New(cfg.Probe, s.hopPolicy.DialContext(prober.Dialer()))
+
+	// next hop addresses are validated on every connection to prevent access to denied networks
+	transport := &http.Transport{
+		DialContext: s.hopPolicy.DialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	s.c.Transport = transport
 
 	// load trust CA if provided
 	if cfg.TrustCAFile != "" {
@@ -48,12 +139,9 @@ func New(cfg config.APIConfig, wgServer *wgserver.Service, wgClient *wgclient.Se
 
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(trustCaPem)
-		tlsConfig := &tls.Config{
+		transport.TLSClientConfig = &tls.Config{
 			RootCAs: caCertPool,
 		}
-		s.c.Transport = &http.Transport{
-			TLSClientConfig: tlsConfig,
-		}
 	}
 
 	r := http.NewServeMux()
@@ -61,17 +149,27 @@ func New(cfg config.APIConfig, wgServer *wgserver.Service, wgClient *wgclient.Se
 	r.HandleFunc("POST /wireguard/update", s.handleUpdate)
 	r.HandleFunc("POST /wireguard/watch", s.handleWatch)
 	r.HandleFunc("POST /wireguard/disconnect", s.handleDisconnect)
+	r.HandleFunc("POST /wireguard/notify", s.handleNotify)
+	r.HandleFunc("GET /wireguard/events", s.handleEvents)
+	r.HandleFunc("POST /wireguard/events/ticket", s.handleEventsTicket)
+	r.HandleFunc("GET /wireguard/key", s.handleKey)
+	r.HandleFunc("GET /wireguard/latency", s.handleLatency)
 
 	r.HandleFunc("/admin/login", s.handleAdminLogin)
 	r.HandleFunc("GET /admin/dashboard", authMiddleware(s.handleAdminDashboard))
 	r.HandleFunc("GET /admin/sessions", authMiddleware(s.handleAdminSessions))
 
 	r.HandleFunc("/admin/api/status", authMiddleware(s.handleAdminAPIStatus))
+	r.HandleFunc("POST /admin/api/sessions/{id}/disconnect", authMiddleware(s.handleAdminDisconnect))
 
 	s.Handler = r
 
+	s.workers.Add(2 + teardownWorkers)
 	go s.expireWorker()
 	go s.saveWorker()
+	for range teardownWorkers {
+		go s.teardownWorker()
+	}
 
 	return s, nil
 }
@@ -101,25 +199,85 @@ func (s *Service) ListenAndServe() error {
 	return nil
 }
 
-func (s *Service) authClient(r *http.Request) error {
-	if len(s.cfg.Clients) > 0 {
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			return ErrUnauthorized.WithErrorMsg("Basic auth required")
+// authClient resolves identity of the client from Basic auth. If client authentication is not configured,
+// anonymous identity with empty username is returned.
+func (s *Service) authClient(r *http.Request) (*Identity, error) {
+	if s.auth == nil {
+		return &Identity{}, nil
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrUnauthorized.WithErrorMsg("Basic auth required")
+	}
+
+	return s.authenticate(r.Context(), username, password)
+}
+
+// authConnect authenticates connect request with Basic auth or, if it is missing, with credentials for this bridge
+// from the request body.
+func (s *Service) authConnect(r *http.Request, request *ConnectRequest, credentials HopCredentials) (*Identity, error) {
+	if s.auth == nil {
+		return &Identity{}, nil
+	}
+
+	if _, _, ok := r.BasicAuth(); ok || len(request.HopCredentials) == 0 {
+		return s.authClient(r)
+	}
+
+	return s.authenticate(r.Context(), credentials.Username, credentials.Password)
+}
+
+func (s *Service) authenticate(ctx context.Context, username, password string) (*Identity, error) {
+	identity, err := s.auth.Authenticate(ctx, username, password)
+	if err != nil {
+		if errors.Is(err, errInvalidCredentials) {
+			return nil, ErrUnauthorized.WithErrorMsg("Invalid username or password")
 		}
+		slog.Error("failed to authenticate client", slog.String("username", username), slog.Any("err", err))
+		return nil, ErrInternalServerError.WithErrorMsg("Authentication failed")
+	}
+	return identity, nil
+}
 
-		found := false
-		for _, client := range s.cfg.Clients {
-			if client.Username == username && client.Password == password {
-				found = true
-				break
-			}
+// authSession finds the session of update, watch or disconnect request. Sessions issued with a session token
+// require it, sessions restored from older versions fall back to client authentication.
+func (s *Service) authSession(r *http.Request, sessionId, sessionToken, accessToken string) (*Session, error) {
+	s.lock.Lock()
+	sess, ok := s.sessions[sessionId]
+	s.lock.Unlock()
+
+	if !ok {
+		if err := s.terminatedError(sessionId); err != nil {
+			return nil, err
 		}
+		return nil, ErrSessionNotFound
+	}
 
-		if !found {
-			return ErrUnauthorized.WithErrorMsg("Invalid username or password")
+	if sess.SessionTokenHash != "" {
+		if !sess.checkSessionToken(sessionToken) {
+			return nil, ErrUnauthorized.WithErrorMsg("Invalid session token")
 		}
+		return sess, nil
 	}
 
-	return nil
+	identity, err := s.authClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.authAccessToken(r.Context(), identity, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if !identity.ownsSession(sess) {
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+// ownsSession reports whether authenticated client is allowed to manage the session.
+func (identity *Identity) ownsSession(sess *Session) bool {
+	return identity.Username == "" || identity.Username == sess.Owner
 }
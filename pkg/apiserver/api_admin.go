@@ -6,6 +6,8 @@ import (
 	"log/slog"
 	"net/http"
 	"pbridge/pkg/token"
+	"pbridge/pkg/wgclient"
+	"pbridge/pkg/wgserver"
 	"pbridge/templates"
 	"sort"
 	"time"
@@ -18,6 +20,8 @@ type SessionWithStats struct {
 	TxBytes   uint64 `json:"tx_bytes"`
 	RxPackets uint64 `json:"rx_packets"`
 	RxBytes   uint64 `json:"rx_bytes"`
+	// upstream peer state, stale if there was no recent handshake with the next hop
+	Upstream *wgclient.PeerState `json:"upstream,omitempty"`
 }
 
 type AdminSessionsTemplateParams struct {
@@ -88,18 +92,113 @@ func (s *Service) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// AdminSession is the session exposed by admin API. Credentials of the client, tokens and credentials of the
+// previous and next hops and the upstream private key are bearer secrets, so they are left out.
+type AdminSession struct {
+	Id         string    `json:"id"`
+	StartTime  time.Time `json:"start_time"`
+	UpdateTime time.Time `json:"update_time"`
+	ExpireTime time.Time `json:"expire_time"`
+	Username   string    `json:"username,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+
+	CallbackURL         string   `json:"callback_url,omitempty"`
+	ClientPublicKey     string   `json:"client_public_key,omitempty"`
+	NextHops            []string `json:"next_hops,omitempty"`
+	NextHopAlternatives []string `json:"next_hop_alternatives,omitempty"`
+	NextHopSessionID    string   `json:"next_hop_session_id,omitempty"`
+
+	NextHopServerPublicKey string `json:"next_hop_server_public_key,omitempty"`
+	NextHopConnectIP4      string `json:"next_hop_connect_ip4,omitempty"`
+	NextHopConnectIP6      string `json:"next_hop_connect_ip6,omitempty"`
+	NextHopConnectPort     int    `json:"next_hop_connect_port,omitempty"`
+	NextHopInternalIP4     string `json:"next_hop_internal_ip4,omitempty"`
+	NextHopInternalIP6     string `json:"next_hop_internal_ip6,omitempty"`
+
+	DNS4                        string `json:"dns4,omitempty"`
+	DNS6                        string `json:"dns6,omitempty"`
+	MTU                         int    `json:"mtu,omitempty"`
+	PersistentKeepaliveInterval int    `json:"persistent_keepalive_interval,omitempty"`
+	RXTimeout                   int    `json:"rx_timeout,omitempty"`
+
+	ClientProfile *AdminClientProfile     `json:"client_profile,omitempty"`
+	ServerProfile *wgserver.ServerProfile `json:"server_profile,omitempty"`
+
+	TxPackets uint64              `json:"tx_packets"`
+	TxBytes   uint64              `json:"tx_bytes"`
+	RxPackets uint64              `json:"rx_packets"`
+	RxBytes   uint64              `json:"rx_bytes"`
+	Upstream  *wgclient.PeerState `json:"upstream,omitempty"`
+}
+
+// AdminClientProfile is the upstream profile without private key.
+type AdminClientProfile struct {
+	ServerIP        string `json:"server_ip"`
+	ServerPort      int    `json:"server_port"`
+	ServerPublicKey string `json:"server_public_key"`
+	ClientPublicKey string `json:"client_public_key"`
+	InternalIP4     string `json:"internal_ip4"`
+	InternalIP6     string `json:"internal_ip6"`
+}
+
+func (s *SessionWithStats) adminSession() *AdminSession {
+	session := &AdminSession{
+		Id:                          s.Id,
+		StartTime:                   s.StartTime,
+		UpdateTime:                  s.UpdateTime,
+		ExpireTime:                  s.ExpireTime,
+		Username:                    s.Username,
+		Owner:                       s.Owner,
+		CallbackURL:                 s.CallbackURL,
+		ClientPublicKey:             s.ClientPublicKey,
+		NextHops:                    s.NextHops,
+		NextHopAlternatives:         s.NextHopAlternatives,
+		NextHopSessionID:            s.NextHopSessionID,
+		NextHopServerPublicKey:      s.NextHopServerPublicKey,
+		NextHopConnectIP4:           s.NextHopConnectIP4,
+		NextHopConnectIP6:           s.NextHopConnectIP6,
+		NextHopConnectPort:          s.NextHopConnectPort,
+		NextHopInternalIP4:          s.NextHopInternalIP4,
+		NextHopInternalIP6:          s.NextHopInternalIP6,
+		DNS4:                        s.DNS4,
+		DNS6:                        s.DNS6,
+		MTU:                         s.MTU,
+		PersistentKeepaliveInterval: s.PersistentKeepaliveInterval,
+		RXTimeout:                   s.RXTimeout,
+		ServerProfile:               s.ServerProfile,
+		TxPackets:                   s.TxPackets,
+		TxBytes:                     s.TxBytes,
+		RxPackets:                   s.RxPackets,
+		RxBytes:                     s.RxBytes,
+		Upstream:                    s.Upstream,
+	}
+	if s.ClientProfile != nil {
+		session.ClientProfile = &AdminClientProfile{
+			ServerIP:        s.ClientProfile.ServerIP,
+			ServerPort:      s.ClientProfile.ServerPort,
+			ServerPublicKey: s.ClientProfile.ServerPublicKey,
+			ClientPublicKey: s.ClientProfile.ClientPublicKey,
+			InternalIP4:     s.ClientProfile.InternalIP4,
+			InternalIP6:     s.ClientProfile.InternalIP6,
+		}
+	}
+	return session
+}
+
 type AdminAPIStatusResponse struct {
-	Sessions   []*SessionWithStats `json:"sessions"`
-	ServerName string              `json:"server_name"`
+	Sessions   []*AdminSession `json:"sessions"`
+	ServerName string          `json:"server_name"`
+	Restore    *RestoreReport  `json:"restore,omitempty"`
 }
 
 func (s *Service) handleAdminAPIStatus(w http.ResponseWriter, r *http.Request) {
 	var response AdminAPIStatusResponse
 	s.lock.Lock()
-	response.Sessions = make([]*SessionWithStats, 0, len(s.sessions))
+	response.Sessions = make([]*AdminSession, 0, len(s.sessions))
 	for _, sess := range s.sessions {
-		response.Sessions = append(response.Sessions, sess.ToOutputSession())
+		response.Sessions = append(response.Sessions, sess.ToOutputSession().adminSession())
 	}
+	response.Restore = s.restoreReport
 	s.lock.Unlock()
 
 	response.ServerName = s.cfg.ServerName
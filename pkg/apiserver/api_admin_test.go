@@ -0,0 +1,43 @@
+package apiserver
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"pbridge/pkg/wgserver"
+	"testing"
+)
+
+func TestAdminStatusRedacted(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	s.lock.Lock()
+	sess := s.sessions["upstream-1"]
+	sess.Password = "client-password"
+	sess.AccessToken = "client-access-token"
+	sess.CallbackToken = "previous-hop-callback-token"
+	sess.NextHopCredentials = &HopCredentials{Username: "next", Password: "next-hop-password"}
+	sess.NextHopRoute = &NextHopRoute{Onion: "onion-for-next-hop"}
+	// fake handle has no counters
+	sess.ServerProfileHandle = &wgserver.ProfileHandle{}
+	s.lock.Unlock()
+
+	rec = httptest.NewRecorder()
+	s.handleAdminAPIStatus(rec, httptest.NewRequest(http.MethodGet, "/admin/api/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	require.Contains(t, body, `"id":"upstream-1"`)
+	for _, secret := range []string{"client-password", "client-access-token", "previous-hop-callback-token",
+		"upstream-token", "next-hop-password", "onion-for-next-hop", `"client_private_key"`,
+		`"callback_token"`, `"next_hop_session_token"`, `"next_hop_credentials"`, `"next_hop_connect"`} {
+		require.NotContains(t, body, secret)
+	}
+}
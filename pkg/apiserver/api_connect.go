@@ -2,14 +2,19 @@ package apiserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"pbridge/pkg/hoppolicy"
+	"pbridge/pkg/onion"
 	"pbridge/pkg/wgclient"
 	"pbridge/pkg/wgserver"
+	"slices"
+	"strconv"
 	"time"
 )
 
@@ -19,6 +24,24 @@ type ConnectRequest struct {
 	AccessToken     string   `json:"access_token"`
 	ClientPublicKey string   `json:"client_public_key"`
 	NextHops        []string `json:"next_hops"`
+	// alternatives for next_hops[0] in order of preference, tried when it is unavailable on connect and used for
+	// failover of the established session
+	NextHopAlternatives []string `json:"next_hop_alternatives,omitempty"`
+	// exits to choose from after the last of next_hops, the bridge before the exit picks the one with the lowest
+	// latency and keeps the others as alternatives
+	ExitCandidates []string `json:"exit_candidates,omitempty"`
+	// onion encrypted to this bridge key, alternative to plain next_hops
+	Onion string `json:"onion,omitempty"`
+	// credentials for this bridge followed by credentials for every next hop in chain order,
+	// each bridge consumes its own entry and forwards only the remaining ones
+	HopCredentials []HopCredentials `json:"hop_credentials,omitempty"`
+	// endpoint of the previous hop to be notified when the session is terminated and token to authorize
+	// the notification
+	CallbackURL   string `json:"callback_url,omitempty"`
+	CallbackToken string `json:"callback_token,omitempty"`
+	// client generated key identifying the connect, a retry with the same key and client public key gets response
+	// of the session created by the first attempt
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 type ConnectResponse struct {
@@ -38,34 +61,155 @@ type ConnectResponse struct {
 	PersistentKeepaliveInterval int    `json:"persistent_keepalive_interval"`
 	RXTimeout                   int    `json:"rx_timeout"`
 	TTL                         int    `json:"ttl"`
+	// secret authorizing update, watch and disconnect requests of the session
+	SessionToken string `json:"session_token,omitempty"`
 }
 
 func (s *Service) handleConnect(w http.ResponseWriter, r *http.Request) {
-	if err := s.authClient(r); err != nil {
+	deadline, err := s.connectDeadline(r)
+	if err != nil {
+		slog.Warn("invalid connect timeout", slog.String("timeout", r.Header.Get(ConnectTimeoutHeader)))
 		writeError(w, err)
 		return
 	}
 
 	var request ConnectRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err = json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		slog.Warn("failed to decode connect request", slog.Any("err", err))
 		ErrBadRequest.WithErrorMsg("Invalid json").Handle(w)
 		return
 	}
 
-	if len(request.NextHops) == 0 {
+	credentials, nextHopCredentials := request.splitCredentials()
+	identity, err := s.authConnect(r, &request, credentials)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.authAccessToken(r.Context(), identity, credentials.AccessToken)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	owner := identity.Username
+	if owner == "" {
+		owner = credentials.Username
+	}
+
+	if request.IdempotencyKey != "" {
+		if len(request.IdempotencyKey) > maxIdempotencyKeyLen {
+			slog.Warn("too long idempotency key in connect request", slog.String("owner", owner))
+			ErrBadRequest.WithErrorMsg("Too long idempotency_key").Handle(w)
+			return
+		}
+
+		key := idempotencyCacheKey(owner, request.ClientPublicKey, request.IdempotencyKey)
+		response, err := s.beginIdempotentConnect(r.Context(), key)
+		if err != nil {
+			slog.Warn("connect retry canceled", slog.String("owner", owner), slog.Any("err", err))
+			return
+		}
+		if response != nil {
+			slog.Info("connect retry, return existing session", slog.String("owner", owner),
+				slog.String("session_id", response.SessionID))
+			writeResponse(w, http.StatusOK, response)
+			return
+		}
+		defer s.finishIdempotentConnect(key)
+	}
+
+	if identity.Limits.MaxSessions > 0 {
+		release, ok := s.reserveSession(owner, identity.Limits.MaxSessions)
+		if !ok {
+			slog.Warn("too many sessions", slog.String("owner", owner))
+			ErrForbidden.WithErrorMsg("Too many sessions").Handle(w)
+			return
+		}
+		defer release()
+	}
+
+	if request.CallbackURL != "" {
+		err = s.hopPolicy.CheckCallback(hoppolicy.WithClient(r.Context(), owner), owner, request.CallbackURL)
+		if err != nil {
+			slog.Warn("callback is not allowed", slog.String("url", request.CallbackURL), slog.String("client", owner),
+				slog.Any("err", err))
+			ErrHopNotAllowed.WithError(err).Handle(w)
+			return
+		}
+	}
+
+	nextHops := request.NextHops
+	var nextOnion string
+	if request.Onion != "" {
+		if len(request.NextHops) > 0 {
+			slog.Warn("both next_hops and onion in connect request")
+			ErrBadRequest.WithErrorMsg("next_hops and onion are mutually exclusive").Handle(w)
+			return
+		}
+
+		if len(request.NextHopAlternatives) > 0 || len(request.ExitCandidates) > 0 {
+			slog.Warn("both next hop choice and onion in connect request")
+			ErrBadRequest.WithErrorMsg("next_hop_alternatives and exit_candidates can't be used with onion").Handle(w)
+			return
+		}
+
+		layer, err := onion.Peel(s.onionKey, request.Onion)
+		if err != nil {
+			slog.Warn("failed to peel onion", slog.Any("err", err))
+			ErrBadRequest.WithErrorMsg("Invalid onion").Handle(w)
+			return
+		}
+
+		// only the successor is revealed to this bridge
+		nextHops = nil
+		if layer.NextHop != "" {
+			nextHops = []string{layer.NextHop}
+		}
+		nextOnion = layer.Onion
+	}
+
+	if len(nextHops) == 0 && len(request.ExitCandidates) == 0 {
+		if s.cfg.Exit.Enabled {
+			s.handleExitConnect(w, r, &request, credentials, owner)
+			return
+		}
 		slog.Warn("no next_hops in connect request")
 		ErrNotAnExitNode.WithErrorMsg("It is not an exit node").Handle(w)
 		return
 	}
-	if len(request.NextHops) > s.cfg.GetMaxHops() {
+
+	maxHops := s.cfg.GetMaxHops()
+	if identity.Limits.MaxHops > 0 && identity.Limits.MaxHops < maxHops {
+		maxHops = identity.Limits.MaxHops
+	}
+	hops := len(nextHops)
+	if len(request.ExitCandidates) > 0 {
+		hops++
+	}
+	if hops > maxHops {
 		slog.Warn("too many hops in connect request")
 		ErrTooManyHops.WithErrorMsg("Too many hops").Handle(w)
 		return
 	}
 
-	for _, nextHop := range request.NextHops {
+	if len(request.NextHopAlternatives) > s.cfg.Failover.GetMaxAlternatives() {
+		slog.Warn("too many next hop alternatives in connect request")
+		ErrBadRequest.WithErrorMsg("Too many next_hop_alternatives").Handle(w)
+		return
+	}
+
+	if len(request.ExitCandidates) > s.cfg.Probe.GetMaxCandidates() {
+		slog.Warn("too many exit candidates in connect request")
+		ErrBadRequest.WithErrorMsg("Too many exit_candidates").Handle(w)
+		return
+	}
+
+	// all of them are validated and checked against hop policy
+	checkedHops := slices.Concat(nextHops, request.NextHopAlternatives, request.ExitCandidates)
+	for _, nextHop := range checkedHops {
 		_, err = url.Parse(nextHop)
 		if err != nil {
 			slog.Warn("invalid URL in next_hops", slog.String("url", nextHop), slog.Any("err", err))
@@ -74,9 +218,33 @@ func (s *Service) handleConnect(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	nextHop := request.NextHops[0]
+	ctx := hoppolicy.WithClient(r.Context(), owner)
+	for _, nextHop := range checkedHops {
+		err = s.hopPolicy.Check(ctx, owner, nextHop)
+		if err != nil {
+			slog.Warn("next hop is not allowed", slog.String("url", nextHop), slog.String("client", owner),
+				slog.Any("err", err))
+			ErrHopNotAllowed.WithError(err).Handle(w)
+			return
+		}
+
+		if len(identity.AllowedHops) > 0 && !hoppolicy.MatchPatterns(identity.AllowedHops, nextHop) {
+			slog.Warn("next hop is not allowed by access token", slog.String("url", nextHop),
+				slog.String("client", owner))
+			ErrHopNotAllowed.WithErrorMsg("Next hop is not allowed by access token").Handle(w)
+			return
+		}
+	}
+
+	// this bridge is the last before the exit
+	nextHopAlternatives := request.NextHopAlternatives
+	exitCandidates := request.ExitCandidates
+	if len(nextHops) == 0 {
+		nextHops, nextHopAlternatives = s.selectNextHop(ctx, slices.Concat(exitCandidates, nextHopAlternatives))
+		exitCandidates = nil
+	}
 
-	slog.Info("incoming connect", slog.String("username", request.Username), slog.String("next_hop", nextHop),
+	slog.Info("incoming connect", slog.String("username", credentials.Username), slog.String("next_hop", nextHops[0]),
 		slog.String("client_public_key", request.ClientPublicKey))
 
 	// generate new wireguard key pair
@@ -87,113 +255,119 @@ func (s *Service) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slog.Info("generated new wireguard key pair", slog.String("username", request.Username),
+	slog.Info("generated new wireguard key pair", slog.String("username", credentials.Username),
 		slog.String("public_key", nextHopPrivateKey.PublicKey().String()))
 
-	// compose request URL for the next hop
-	nextHopUrl, err := url.JoinPath(nextHop, "/wireguard/connect")
-	if err != nil { // this error should never happen, we have already checked the URLs in next_hops
-		slog.Error("failed to join next hop URL", slog.String("url", nextHop), slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
-	}
-
 	// prepare request to next hop
 	nextHopRequest := ConnectRequest{
-		Username:        request.Username,
-		Password:        request.Password,
-		AccessToken:     request.AccessToken,
 		ClientPublicKey: nextHopPrivateKey.PublicKey().String(),
-		NextHops:        request.NextHops[1:],
-	}
-	nextHopRequestBytes, err := json.Marshal(nextHopRequest)
-	if err != nil {
-		slog.Error("failed to marshal next hop connect request", slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
+		NextHops:        nextHops[1:],
+		Onion:           nextOnion,
+		ExitCandidates:  exitCandidates,
+		IdempotencyKey:  request.IdempotencyKey,
 	}
-
-	nextHopReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, nextHopUrl, bytes.NewReader(nextHopRequestBytes))
-	if err != nil {
-		slog.Error("failed to create next hop request", slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
-	}
-	nextHopReq.Header.Set("Content-Type", "application/json")
-	nextHopReq.Header.Set("Accept", "application/json")
-	// Skip original IP address forwarding
-	// nextHopReq.Header.Set("X-Forwarded-For", getNextHeader(r))
-
-	// send request to next hop
-	nextHopResp, err := s.c.Do(nextHopReq)
-	if err != nil {
-		slog.Warn("failed to send connect request to next hop", slog.String("host", nextHop), slog.Any("err", err))
-		ErrNextHopUnavailable.WithError(err).Handle(w)
-		return
+	var nextHopAuth *HopCredentials
+	if len(request.HopCredentials) == 0 {
+		// legacy mode, the same credentials are forwarded down the chain
+		nextHopRequest.Username = request.Username
+		nextHopRequest.Password = request.Password
+		nextHopRequest.AccessToken = request.AccessToken
+	} else if len(nextHopCredentials) > 0 {
+		// top-level credentials are kept for next hops which don't support hop_credentials
+		nextHopAuth = &nextHopCredentials[0]
+		nextHopRequest.Username = nextHopAuth.Username
+		nextHopRequest.Password = nextHopAuth.Password
+		nextHopRequest.AccessToken = nextHopAuth.AccessToken
+		nextHopRequest.HopCredentials = nextHopCredentials
+	} else {
+		// the rest of the chain takes no credentials, client credentials of this bridge are not forwarded
+		nextHopAuth = &HopCredentials{}
 	}
-	defer nextHopResp.Body.Close()
-
-	// forward response from next hop
-	if nextHopResp.StatusCode != http.StatusOK {
-		var nextHopError ApiError
-		err = json.NewDecoder(nextHopResp.Body).Decode(&nextHopError)
+	var callbackTokenHash string
+	if s.cfg.PublicURL != "" {
+		nextHopRequest.CallbackURL, err = url.JoinPath(s.cfg.PublicURL, "/wireguard/notify")
 		if err != nil {
-			slog.Warn("failed to decode error from next hop", slog.String("host", nextHop), slog.Any("err", err))
+			slog.Error("failed to join callback URL", slog.Any("err", err))
 			ErrInternalServerError.WithError(err).Handle(w)
 			return
 		}
 
-		slog.Warn("error from next hop connect",
-			slog.String("host", request.NextHops[0]),
-			slog.String("result", nextHopError.Result),
-			slog.String("error_msg", nextHopError.ErrorMsg))
-
-		nextHopError.HttpCode = nextHopResp.StatusCode
-		nextHopError.ErrorMsg = fmt.Errorf("error from %s: %s", nextHopReq.URL.Host, nextHopError.ErrorMsg).Error()
-		nextHopError.Handle(w)
-		return
+		nextHopRequest.CallbackToken, callbackTokenHash, err = newToken()
+		if err != nil {
+			slog.Error("failed to generate callback token", slog.Any("err", err))
+			ErrInternalServerError.WithError(err).Handle(w)
+			return
+		}
 	}
-
-	// decode response from next hop
-	var rresponse ConnectResponse
-	err = json.NewDecoder(nextHopResp.Body).Decode(&rresponse)
+	nextHopRequestBytes, err := json.Marshal(nextHopRequest)
 	if err != nil {
-		slog.Warn("failed to decode response from next hop", slog.String("host", nextHop), slog.Any("err", err))
+		slog.Error("failed to marshal next hop connect request", slog.Any("err", err))
 		ErrInternalServerError.WithError(err).Handle(w)
 		return
 	}
 
-	slog.Info("response from next hop", slog.String("username", request.Username), slog.String("host", nextHop),
+	// next hops are tried in order until one of them is available
+	candidates := append([]string{nextHops[0]}, nextHopAlternatives...)
+	var rresponse *ConnectResponse
+	for i, candidate := range candidates {
+		rresponse, err = s.connectNextHop(ctx, candidate, nextHopRequestBytes, nextHopAuth, deadline,
+			len(candidates) > 1)
+		if err == nil {
+			nextHops = append([]string{candidate}, nextHops[1:]...)
+			candidates = slices.Delete(candidates, i, i+1)
+			break
+		}
+		// the next hop may have created the session after this bridge has given up on it, without idempotency key
+		// it can't be found and lives there until its TTL
+		if request.IdempotencyKey != "" && isConnectTimeout(err, candidate) {
+			s.enqueueTeardown(&teardownTask{
+				sess: &Session{
+					Owner:              owner,
+					NextHops:           []string{candidate},
+					NextHopCredentials: nextHopAuth,
+					Username:           nextHopRequest.Username,
+					Password:           nextHopRequest.Password,
+					AccessToken:        nextHopRequest.AccessToken,
+				},
+				reason:  SessionEventTerminated,
+				connect: nextHopRequestBytes,
+			})
+		}
+		// alternatives are not tried when the budget is spent
+		if !isNextHopFailure(err) || i == len(candidates)-1 || s.connectBudget(deadline) <= 0 {
+			writeError(w, err)
+			return
+		}
+		slog.Warn("next hop failed, try alternative", slog.String("host", candidate),
+			slog.String("alternative", candidates[i+1]), slog.Any("err", err))
+	}
+	nextHop := nextHops[0]
+
+	slog.Info("response from next hop", slog.String("username", credentials.Username), slog.String("host", nextHop),
 		slog.String("result", rresponse.Result),
 		slog.String("connect_ip", rresponse.ConnectIP),
 		slog.String("internal_ip", rresponse.InternalIP),
 		slog.String("session_id", rresponse.SessionID))
 
-	internalIP4, internalIP6, err := s.wgServer.AllocateInternalIPs()
-	if err != nil {
-		slog.Error("failed to allocate internal IPs", slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
-	}
-	var internalIP4Str, internalIP6Str string
-	if internalIP4 != nil {
-		internalIP4Str = internalIP4.String()
-	}
-	if internalIP6 != nil {
-		internalIP6Str = internalIP6.String()
-	}
-
 	currentTime := time.Now()
 	session := &Session{
 		Id:              rresponse.SessionID,
 		StartTime:       currentTime,
 		UpdateTime:      currentTime,
 		ExpireTime:      time.Now().Add(time.Duration(rresponse.TTL) * time.Second),
-		Username:        request.Username,
-		Password:        request.Password,
-		AccessToken:     request.AccessToken,
+		Username:        credentials.Username,
+		Owner:           owner,
 		ClientPublicKey: request.ClientPublicKey,
-		NextHops:        request.NextHops,
+		NextHops:        nextHops,
+		// remaining candidates are kept for failover
+		NextHopAlternatives: candidates,
+
+		NextHopSessionToken: rresponse.SessionToken,
+		idempotencyKey:      request.IdempotencyKey,
+
+		CallbackURL:       request.CallbackURL,
+		CallbackToken:     request.CallbackToken,
+		CallbackTokenHash: callbackTokenHash,
 
 		NextHopServerPublicKey: rresponse.ServerPublicKey,
 		NextHopConnectIP4:      rresponse.ConnectIP,
@@ -223,18 +397,214 @@ func (s *Service) handleConnect(w http.ResponseWriter, r *http.Request) {
 			ClientPublicKey: request.ClientPublicKey,
 			ServerPublicKey: s.wgServer.GetPublicKey(),
 			KeepAlive:       rresponse.PersistentKeepaliveInterval,
-			InternalIP4:     internalIP4Str,
-			InternalIP6:     internalIP6Str,
 		},
 	}
+	if s.cfg.Reestablish.Enabled || len(session.NextHopAlternatives) > 0 {
+		if len(nextHopCredentials) > 1 {
+			// credentials of the hops behind the next one are not stored, the chain can't be connected again
+			slog.Info("session won't be reestablished, hops behind the next one take credentials",
+				slog.String("session_id", session.Id))
+		} else {
+			session.NextHopRoute = &NextHopRoute{
+				NextHops:       nextHopRequest.NextHops,
+				Onion:          nextHopRequest.Onion,
+				ExitCandidates: nextHopRequest.ExitCandidates,
+			}
+		}
+	}
+	if rresponse.SessionToken == "" || session.NextHopRoute != nil {
+		// next hop doesn't issue session tokens or the session is connected again, keep credentials of the next hop
+		if len(request.HopCredentials) == 0 {
+			session.Password = request.Password
+			session.AccessToken = request.AccessToken
+		} else {
+			session.NextHopCredentials = nextHopAuth
+		}
+	}
+
+	// the previous hop has already given up on this connect
+	if time.Now().After(deadline) {
+		slog.Warn("connect deadline exceeded", slog.String("session_id", session.Id))
+		s.abortConnect(session)
+		writeError(w, errConnectTimeout(s.cfg.ServerName))
+		return
+	}
+
+	// the session is established on the next hop, from now on every failure has to close it there
+	sessionToken, sessionTokenHash, err := newToken()
+	if err != nil {
+		slog.Error("failed to generate session token", slog.Any("err", err))
+		s.abortConnect(session)
+		ErrInternalServerError.WithError(err).Handle(w)
+		return
+	}
+	session.SessionTokenHash = sessionTokenHash
+
+	internalIP4, internalIP6, err := s.wgServer.AllocateInternalIPs()
+	if err != nil {
+		slog.Error("failed to allocate internal IPs", slog.Any("err", err))
+		s.abortConnect(session)
+		ErrInternalServerError.WithError(err).Handle(w)
+		return
+	}
+	if internalIP4 != nil {
+		session.ServerProfile.InternalIP4 = internalIP4.String()
+	}
+	if internalIP6 != nil {
+		session.ServerProfile.InternalIP6 = internalIP6.String()
+	}
 
 	err = s.setupSession(session)
 	if err != nil {
 		slog.Error("failed to setup session", slog.Any("err", err))
+		s.abortConnect(session)
 		ErrInternalServerError.WithError(err).Handle(w)
 		return
 	}
 
+	if !s.sendConnectResponse(w, r, session, rresponse.TTL, sessionToken) {
+		s.abortConnect(session)
+		return
+	}
+
+	slog.Info("connected", slog.String("username", credentials.Username), slog.String("session_id", rresponse.SessionID),
+		slog.String("internal_ip", rresponse.InternalIP), slog.String("internal_ip6", rresponse.InternalIP6))
+}
+
+// connectNextHop sends connect request to the next hop. The request is not canceled with the client request, so the
+// session is not created on the next hop without this bridge knowing its id, but it is limited by connect deadline
+// minus time reserved for local setup. With limited attempt time the request is canceled earlier to try alternatives.
+func (s *Service) connectNextHop(ctx context.Context, nextHop string, requestBytes []byte,
+	nextHopAuth *HopCredentials, deadline time.Time, limitAttemptTime bool) (*ConnectResponse, error) {
+	nextHopUrl, err := url.JoinPath(nextHop, "/wireguard/connect")
+	if err != nil { // this error should never happen, we have already checked the URLs in next_hops
+		slog.Error("failed to join next hop URL", slog.String("url", nextHop), slog.Any("err", err))
+		return nil, ErrInternalServerError.WithError(err)
+	}
+
+	budget := s.connectBudget(deadline)
+	if limitAttemptTime {
+		budget = min(budget, s.cfg.Failover.GetAttemptTimeout())
+	}
+	if budget <= 0 {
+		slog.Warn("no time left to connect next hop", slog.String("host", nextHop))
+		return nil, errConnectTimeout(s.cfg.ServerName)
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), budget)
+	defer cancel()
+
+	nextHopReq, err := http.NewRequestWithContext(ctx, http.MethodPost, nextHopUrl, bytes.NewReader(requestBytes))
+	if err != nil {
+		slog.Error("failed to create next hop request", slog.Any("err", err))
+		return nil, ErrInternalServerError.WithError(err)
+	}
+	nextHopReq.Header.Set("Content-Type", "application/json")
+	nextHopReq.Header.Set("Accept", "application/json")
+	nextHopReq.Header.Set(ConnectTimeoutHeader, strconv.FormatInt(budget.Milliseconds(), 10))
+	nextHopAuth.setBasicAuth(nextHopReq)
+	// Skip original IP address forwarding
+	// nextHopReq.Header.Set("X-Forwarded-For", getNextHeader(r))
+
+	// send request to next hop
+	startTime := time.Now()
+	nextHopResp, err := s.c.Do(nextHopReq)
+	if err != nil {
+		slog.Warn("failed to send connect request to next hop", slog.String("host", nextHop), slog.Any("err", err))
+		return nil, s.traceHop(nextHopRequestError(nextHopReq, err), nextHopReq, startTime)
+	}
+	defer nextHopResp.Body.Close()
+
+	// forward response from next hop
+	if nextHopResp.StatusCode != http.StatusOK {
+		nextHopError := decodeNextHopError(nextHopResp)
+		slog.Warn("error from next hop connect",
+			slog.String("host", nextHop),
+			slog.String("result", nextHopError.Result),
+			slog.String("error_msg", nextHopError.ErrorMsg))
+		return nil, s.traceHop(nextHopError, nextHopReq, startTime)
+	}
+
+	// decode response from next hop
+	var response ConnectResponse
+	err = json.NewDecoder(nextHopResp.Body).Decode(&response)
+	if err != nil {
+		slog.Warn("failed to decode response from next hop", slog.String("host", nextHop), slog.Any("err", err))
+		return nil, s.traceHop(ErrNextHopInvalidResponse.WithError(err), nextHopReq, startTime)
+	}
+	return &response, nil
+}
+
+// connectBudget returns time the next hop has to complete connect, the rest is reserved for local setup.
+func (s *Service) connectBudget(deadline time.Time) time.Duration {
+	return time.Until(deadline) - s.cfg.GetConnectSetupReserve()
+}
+
+// isNextHopFailure reports whether the error is caused by unavailable or failing next hop, so an alternative may
+// succeed. Rejections, e.g. invalid credentials, are returned as is.
+func isNextHopFailure(err error) bool {
+	var apiError *ApiError
+	if !errors.As(err, &apiError) {
+		return true
+	}
+	return apiError.HttpCode >= http.StatusInternalServerError
+}
+
+// isConnectTimeout reports whether this bridge has given up waiting for connect response of the next hop.
+func isConnectTimeout(err error, nextHop string) bool {
+	var apiError *ApiError
+	if !errors.As(err, &apiError) || apiError.Result != ErrNextHopTimeout.Result {
+		return false
+	}
+	nextHopUrl, err := url.Parse(nextHop)
+	return err == nil && apiError.Hop == nextHopUrl.Host
+}
+
+// sendConnectResponse delivers connect response to the client. If the client is gone, it will never learn the session
+// id and nobody would disconnect the session, so it is removed right away.
+func (s *Service) sendConnectResponse(w http.ResponseWriter, r *http.Request, session *Session, ttl int,
+	sessionToken string) bool {
+	// client request is canceled when its connection is closed
+	response := s.connectResponse(session, ttl, sessionToken)
+	err := r.Context().Err()
+	if err == nil {
+		err = writeResponse(w, http.StatusOK, response)
+	}
+	if err == nil {
+		err = http.NewResponseController(w).Flush()
+	}
+	if err == nil {
+		s.storeConnectResponse(session, response)
+		return true
+	}
+
+	slog.Warn("failed to send connect response", slog.String("session_id", session.Id), slog.Any("err", err))
+	s.lock.Lock()
+	if s.sessions[session.Id] == session {
+		delete(s.sessions, session.Id)
+	}
+	s.lock.Unlock()
+	s.rollbackSession(session, err)
+	return false
+}
+
+// abortConnect closes the session established on the next hop when connect can't be completed on this bridge.
+func (s *Service) abortConnect(session *Session) {
+	slog.Info("abort connect, disconnect next hop", slog.String("session_id", session.Id),
+		slog.String("host", session.NextHops[0]))
+
+	ctx, cancel := context.WithTimeout(hoppolicy.WithClient(context.Background(), session.Owner), 30*time.Second)
+	defer cancel()
+
+	err := s.disconnectNextHop(ctx, session)
+	if err != nil {
+		slog.Error("failed to disconnect next hop", slog.String("session_id", session.Id),
+			slog.String("host", session.NextHops[0]), slog.Any("err", err))
+	}
+}
+
+// connectResponse composes response for downstream client of the session.
+func (s *Service) connectResponse(session *Session, ttl int, sessionToken string) *ConnectResponse {
 	serverIP4, serverIP6 := s.wgServer.GetIPs()
 	var serverIP4Str, serverIP6Str string
 	if serverIP4 != nil {
@@ -245,32 +615,30 @@ func (s *Service) handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var internalIP4Len, internalIP6Len int
-	if internalIP4Str != "" {
+	if session.ServerProfile.InternalIP4 != "" {
 		internalIP4Len = 32
 	}
-	if internalIP6Str != "" {
+	if session.ServerProfile.InternalIP6 != "" {
 		internalIP6Len = 128
 	}
 
-	slog.Info("connected", slog.String("username", request.Username), slog.String("session_id", rresponse.SessionID),
-		slog.String("internal_ip", rresponse.InternalIP), slog.String("internal_ip6", rresponse.InternalIP6))
-
-	writeResponse(w, http.StatusOK, ConnectResponse{
+	return &ConnectResponse{
 		Result:                      "OK",
 		SessionID:                   session.Id,
 		ServerPublicKey:             s.wgServer.GetPublicKey(),
-		InternalIP:                  internalIP4Str,
+		InternalIP:                  session.ServerProfile.InternalIP4,
 		InternalIPLen:               internalIP4Len,
-		InternalIP6:                 internalIP6Str,
+		InternalIP6:                 session.ServerProfile.InternalIP6,
 		InternalIP6Len:              internalIP6Len,
 		ConnectIP:                   serverIP4Str,
 		ConnectIP6:                  serverIP6Str,
 		ConnectPort:                 s.wgServer.GetListenPort(),
-		DNS:                         rresponse.DNS,
-		DNS6:                        rresponse.DNS6,
-		MTU:                         rresponse.MTU,
-		PersistentKeepaliveInterval: rresponse.PersistentKeepaliveInterval,
-		RXTimeout:                   rresponse.RXTimeout,
-		TTL:                         rresponse.TTL,
-	})
+		DNS:                         session.DNS4,
+		DNS6:                        session.DNS6,
+		MTU:                         session.MTU,
+		PersistentKeepaliveInterval: session.PersistentKeepaliveInterval,
+		RXTimeout:                   session.RXTimeout,
+		TTL:                         ttl,
+		SessionToken:                sessionToken,
+	}
 }
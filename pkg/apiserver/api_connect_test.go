@@ -0,0 +1,415 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"pbridge/pkg/sessionstore"
+	"pbridge/pkg/wgclient"
+	"pbridge/pkg/wgserver"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected failure")
+
+type fakeWgServer struct {
+	failStep string
+
+	lock     sync.Mutex
+	nextIP   byte
+	acquired map[string]struct{}
+	peers    map[*wgserver.ProfileHandle]struct{}
+	// last packet time by internal IP
+	lastActivity map[string]time.Time
+}
+
+func newFakeWgServer(failStep string) *fakeWgServer {
+	return &fakeWgServer{
+		failStep: failStep,
+		nextIP:   2,
+		acquired: map[string]struct{}{},
+		peers:    map[*wgserver.ProfileHandle]struct{}{},
+
+		lastActivity: map[string]time.Time{},
+	}
+}
+
+func (s *fakeWgServer) Add(profile *wgserver.ServerProfile) (*wgserver.ProfileHandle, error) {
+	if s.failStep == "server_add" {
+		return nil, errInjected
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	handle := &wgserver.ProfileHandle{IP4: net.ParseIP(profile.InternalIP4)}
+	s.peers[handle] = struct{}{}
+	return handle, nil
+}
+
+func (s *fakeWgServer) Remove(handle *wgserver.ProfileHandle) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.peers, handle)
+	delete(s.acquired, handle.IP4.String())
+	return nil
+}
+
+func (s *fakeWgServer) SetupForwarding(*wgserver.ProfileHandle, net.IP, net.IP, uint32) error {
+	if s.failStep == "server_forwarding" {
+		return errInjected
+	}
+	return nil
+}
+
+func (s *fakeWgServer) SetupExit(*wgserver.ProfileHandle) error {
+	if s.failStep == "exit" {
+		return errInjected
+	}
+	return nil
+}
+
+func (s *fakeWgServer) LastActivity(handle *wgserver.ProfileHandle) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastActivity[handle.IP4.String()]
+}
+
+func (s *fakeWgServer) AllocateInternalIPs() (net.IP, net.IP, error) {
+	if s.failStep == "allocate" {
+		return nil, nil, errInjected
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ip4 := net.IPv4(10, 1, 0, s.nextIP)
+	s.nextIP++
+	s.acquired[ip4.String()] = struct{}{}
+	return ip4, nil, nil
+}
+
+func (s *fakeWgServer) ReserveInternalIPs(ip4, ip6 net.IP) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.acquired[ip4.String()] = struct{}{}
+}
+
+func (s *fakeWgServer) ReleaseInternalIPs(ip4, ip6 net.IP) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ip4 != nil {
+		delete(s.acquired, ip4.String())
+	}
+}
+
+func (s *fakeWgServer) GetPublicKey() string {
+	return "server-public-key"
+}
+
+func (s *fakeWgServer) GetListenPort() int {
+	return 51820
+}
+
+func (s *fakeWgServer) GetIPs() (net.IP, net.IP) {
+	return net.IPv4(192, 0, 2, 1), nil
+}
+
+func (s *fakeWgServer) GetLink() uint32 {
+	return 1
+}
+
+type fakeWgClient struct {
+	failStep string
+
+	lock     sync.Mutex
+	profiles map[*wgclient.ProfileHandle]struct{}
+}
+
+func newFakeWgClient(failStep string) *fakeWgClient {
+	return &fakeWgClient{
+		failStep: failStep,
+		profiles: map[*wgclient.ProfileHandle]struct{}{},
+	}
+}
+
+func (c *fakeWgClient) Add(*wgclient.Profile) (*wgclient.ProfileHandle, error) {
+	if c.failStep == "client_add" {
+		return nil, errInjected
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	handle := &wgclient.ProfileHandle{}
+	c.profiles[handle] = struct{}{}
+	return handle, nil
+}
+
+func (c *fakeWgClient) Remove(handle *wgclient.ProfileHandle) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.profiles, handle)
+	return nil
+}
+
+func (c *fakeWgClient) SetupForwarding(*wgclient.ProfileHandle, net.IP, net.IP, uint32) error {
+	if c.failStep == "client_forwarding" {
+		return errInjected
+	}
+	return nil
+}
+
+func (c *fakeWgClient) GetLink(*wgclient.ProfileHandle) uint32 {
+	return 2
+}
+
+func (c *fakeWgClient) SetStaleHandler(func(*wgclient.ProfileHandle)) {
+}
+
+// failingWriter simulates client which closed connection before connect response is delivered.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) FlushError() error {
+	return errors.New("connection closed")
+}
+
+type fakeNextHop struct {
+	*httptest.Server
+
+	// prefix of issued session ids
+	prefix string
+
+	lock        sync.Mutex
+	connects    int
+	lastConnect ConnectRequest
+	// basic auth username of the last connect
+	lastConnectUser string
+	disconnects     []DisconnectRequest
+	// number of disconnect requests to fail before accepting
+	failDisconnects int
+	// sessions are forgotten, e.g. after restart
+	lost bool
+	// called before connect response is sent
+	onConnect func()
+}
+
+func newFakeNextHop(t *testing.T) *fakeNextHop {
+	h := &fakeNextHop{prefix: "upstream"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /wireguard/connect", func(w http.ResponseWriter, r *http.Request) {
+		var request ConnectRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+
+		h.lock.Lock()
+		h.connects++
+		h.lastConnect = request
+		h.lastConnectUser, _, _ = r.BasicAuth()
+		sessionId := fmt.Sprintf("%s-%d", h.prefix, h.connects)
+		onConnect := h.onConnect
+		h.lock.Unlock()
+
+		if onConnect != nil {
+			onConnect()
+		}
+
+		writeResponse(w, http.StatusOK, &ConnectResponse{
+			Result:          "OK",
+			SessionID:       sessionId,
+			ServerPublicKey: "upstream-public-key",
+			InternalIP:      "10.2.0.2",
+			ConnectIP:       "192.0.2.2",
+			ConnectPort:     51820,
+			MTU:             1420,
+			TTL:             3600,
+			SessionToken:    "upstream-token",
+		})
+	})
+	mux.HandleFunc("POST /wireguard/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		var request DisconnectRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.failDisconnects > 0 {
+			h.failDisconnects--
+			ErrInternalServerError.Handle(w)
+			return
+		}
+		h.disconnects = append(h.disconnects, request)
+
+		writeResponse(w, http.StatusOK, &DisconnectResponse{Result: "OK"})
+	})
+	mux.HandleFunc("POST /wireguard/update", func(w http.ResponseWriter, r *http.Request) {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.lost {
+			ErrSessionNotFound.Handle(w)
+			return
+		}
+		writeResponse(w, http.StatusOK, &UpdateResponse{Result: "OK", TTL: 3600})
+	})
+	mux.HandleFunc("POST /wireguard/watch", func(w http.ResponseWriter, r *http.Request) {
+		// body has to be consumed to detect closed connection
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	})
+	h.Server = httptest.NewServer(mux)
+	t.Cleanup(h.Close)
+	return h
+}
+
+func connectRequest(t *testing.T, nextHops ...string) *http.Request {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	return jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+		ClientPublicKey: key.PublicKey().String(),
+		NextHops:        nextHops,
+	})
+}
+
+// stopService shuts the service down when the test ends, so its workers don't write into the removed storage.
+func stopService(t *testing.T, s *Service) {
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+}
+
+func jsonRequest(t *testing.T, path string, request any) *http.Request {
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	return httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+}
+
+func TestConnectRollback(t *testing.T) {
+	for _, failStep := range []string{"allocate", "client_add", "server_add", "server_forwarding",
+		"client_forwarding", "response"} {
+		t.Run(failStep, func(t *testing.T) {
+			nextHop := newFakeNextHop(t)
+			wgServer := newFakeWgServer(failStep)
+			wgClient := newFakeWgClient(failStep)
+
+			s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, wgServer, wgClient)
+			require.NoError(t, err)
+			stopService(t, s)
+
+			rec := httptest.NewRecorder()
+			var w http.ResponseWriter = rec
+			if failStep == "response" {
+				w = failingWriter{rec}
+			}
+			s.ServeHTTP(w, connectRequest(t, nextHop.URL))
+
+			if failStep != "response" {
+				require.Equal(t, http.StatusInternalServerError, rec.Code)
+			}
+
+			nextHop.lock.Lock()
+			require.Equal(t, []DisconnectRequest{{SessionID: "upstream-1", SessionToken: "upstream-token"}},
+				nextHop.disconnects)
+			nextHop.lock.Unlock()
+
+			require.Empty(t, wgServer.acquired)
+			require.Empty(t, wgServer.peers)
+			require.Empty(t, wgClient.profiles)
+			require.Empty(t, s.sessions)
+		})
+	}
+}
+
+func TestExitConnectRollback(t *testing.T) {
+	for _, failStep := range []string{"server_add", "exit"} {
+		t.Run(failStep, func(t *testing.T) {
+			wgServer := newFakeWgServer(failStep)
+			cfg := config.APIConfig{
+				SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory},
+				Exit:         config.ExitConfig{Enabled: true},
+			}
+			s, err := New(cfg, wgServer, newFakeWgClient(""))
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, connectRequest(t))
+			require.Equal(t, http.StatusInternalServerError, rec.Code)
+			require.Contains(t, rec.Body.String(), errInjected.Error())
+
+			require.Empty(t, wgServer.acquired)
+			require.Empty(t, wgServer.peers)
+			require.Empty(t, s.sessions)
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response ConnectResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	require.Equal(t, "upstream-1", response.SessionID)
+	require.Equal(t, "10.1.0.2", response.InternalIP)
+	require.NotEmpty(t, response.SessionToken)
+
+	require.Empty(t, nextHop.disconnects)
+	require.Len(t, wgServer.peers, 1)
+	require.Len(t, wgClient.profiles, 1)
+	require.Contains(t, s.sessions, "upstream-1")
+}
+
+func TestMaxSessions(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	cfg := config.APIConfig{
+		SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory},
+		Clients:      []config.ClientRecord{{Username: "alice", Password: "secret", MaxSessions: 2}},
+	}
+	s, err := New(cfg, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+
+	requests := make([]*http.Request, 8)
+	for i := range requests {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		requests[i] = jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+			ClientPublicKey: key.PublicKey().String(),
+			NextHops:        []string{nextHop.URL},
+		})
+		requests[i].SetBasicAuth("alice", "secret")
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, len(requests))
+	for i, r := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, r)
+			codes[i] = rec.Code
+		}()
+	}
+	wg.Wait()
+
+	// parallel connects don't exceed the limit
+	require.Equal(t, 2, slices.Index(slices.Sorted(slices.Values(codes)), http.StatusForbidden))
+	require.Len(t, s.sessions, 2)
+	require.Empty(t, s.pendingSessions)
+}
@@ -0,0 +1,31 @@
+package apiserver
+
+import "net/http"
+
+// HopCredentials are credentials of a client for a single bridge in the chain.
+type HopCredentials struct {
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+// splitCredentials returns credentials for this bridge and per-hop credentials which should be forwarded to the
+// next hop. In legacy mode (no hop_credentials) top-level credentials belong to the whole chain.
+func (r *ConnectRequest) splitCredentials() (HopCredentials, []HopCredentials) {
+	if len(r.HopCredentials) == 0 {
+		return HopCredentials{
+			Username:    r.Username,
+			Password:    r.Password,
+			AccessToken: r.AccessToken,
+		}, nil
+	}
+	return r.HopCredentials[0], r.HopCredentials[1:]
+}
+
+// setBasicAuth authenticates request to the next hop with its own credentials.
+func (c *HopCredentials) setBasicAuth(r *http.Request) {
+	if c == nil || c.Username == "" {
+		return
+	}
+	r.SetBasicAuth(c.Username, c.Password)
+}
@@ -0,0 +1,39 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ConnectTimeoutHeader carries milliseconds left for connect through the rest of the chain. The budget is relative,
+// so clocks of the bridges don't have to be in sync.
+const ConnectTimeoutHeader = "X-Pbridge-Timeout"
+
+// connectDeadline returns time by which connect has to be completed, the budget from the previous hop is capped by
+// connect timeout of this bridge.
+func (s *Service) connectDeadline(r *http.Request) (time.Time, error) {
+	now := time.Now()
+	timeout := s.cfg.GetConnectTimeout()
+	header := r.Header.Get(ConnectTimeoutHeader)
+	if header == "" {
+		return now.Add(timeout), nil
+	}
+
+	budget, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || budget < 0 {
+		return time.Time{}, ErrBadRequest.WithErrorMsg(fmt.Sprintf("Invalid %s header", ConnectTimeoutHeader))
+	}
+	if time.Duration(budget)*time.Millisecond < timeout {
+		timeout = time.Duration(budget) * time.Millisecond
+	}
+	return now.Add(timeout), nil
+}
+
+// errConnectTimeout identifies the hop which has run out of time.
+func errConnectTimeout(hop string) *ApiError {
+	apiError := ErrNextHopTimeout.WithErrorMsg(fmt.Sprintf("Connect timed out on %s", hop))
+	apiError.Hop = hop
+	return apiError
+}
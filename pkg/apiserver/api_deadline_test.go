@@ -0,0 +1,75 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pbridge/pkg/config"
+	"strconv"
+	"testing"
+)
+
+func TestConnectDeadline(t *testing.T) {
+	budgets := make(chan int64, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		budget, err := strconv.ParseInt(r.Header.Get(ConnectTimeoutHeader), 10, 64)
+		require.NoError(t, err)
+		budgets <- budget
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	deep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		writeError(w, errConnectTimeout("deep.example.com"))
+	}))
+	defer deep.Close()
+
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	connect := func(nextHop string, timeout string) (int, *ApiError) {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		req := jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+			ClientPublicKey: key.PublicKey().String(),
+			NextHops:        []string{nextHop},
+		})
+		req.Header.Set(ConnectTimeoutHeader, timeout)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+
+		var response ApiError
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return rec.Code, &response
+	}
+
+	// the budget is passed on without time reserved for setup
+	code, response := connect(slow.URL, "1500")
+	require.Equal(t, http.StatusGatewayTimeout, code)
+	require.Equal(t, "NEXT_HOP_TIMEOUT", response.Result)
+	slowURL, err := url.Parse(slow.URL)
+	require.NoError(t, err)
+	require.Equal(t, slowURL.Host, response.Hop)
+	require.LessOrEqual(t, <-budgets, int64(500))
+
+	// hop which has run out of time further in the chain is kept
+	code, response = connect(deep.URL, "")
+	require.Equal(t, http.StatusGatewayTimeout, code)
+	require.Equal(t, "deep.example.com", response.Hop)
+
+	// nothing is left for the next hop
+	code, response = connect(slow.URL, "800")
+	require.Equal(t, http.StatusGatewayTimeout, code)
+	require.Equal(t, "NEXT_HOP_TIMEOUT", response.Result)
+	require.Empty(t, s.sessions)
+
+	code, _ = connect(slow.URL, "soon")
+	require.Equal(t, http.StatusBadRequest, code)
+}
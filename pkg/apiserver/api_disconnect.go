@@ -2,10 +2,14 @@ package apiserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"pbridge/pkg/hoppolicy"
+	"time"
 )
 
 type DisconnectRequest struct {
@@ -13,6 +17,8 @@ type DisconnectRequest struct {
 	Password    string `json:"password"`
 	AccessToken string `json:"access_token"`
 	SessionID   string `json:"session_id"`
+	// session token issued by connect, replaces client credentials
+	SessionToken string `json:"session_token,omitempty"`
 }
 
 type DisconnectResponse struct {
@@ -20,11 +26,6 @@ type DisconnectResponse struct {
 }
 
 func (s *Service) handleDisconnect(w http.ResponseWriter, r *http.Request) {
-	if err := s.authClient(r); err != nil {
-		writeError(w, err)
-		return
-	}
-
 	defer r.Body.Close()
 	var request DisconnectRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
@@ -34,11 +35,19 @@ func (s *Service) handleDisconnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// search for session
+	sess, err := s.authSession(r, request.SessionID, request.SessionToken, request.AccessToken)
+	if err != nil {
+		slog.Warn("session not authorized on disconnect", slog.String("session_id", request.SessionID),
+			slog.Any("err", err))
+		writeError(w, err)
+		return
+	}
+
+	// session could be removed concurrently
 	s.lock.Lock()
-	sess, ok := s.sessions[request.SessionID]
+	ok := s.sessions[sess.Id] == sess
 	if ok {
-		delete(s.sessions, request.SessionID)
+		delete(s.sessions, sess.Id)
 	}
 	s.lock.Unlock()
 
@@ -48,6 +57,9 @@ func (s *Service) handleDisconnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.addTombstone(sess, SessionEventDisconnected)
+	s.signalSave()
+
 	// remove session
 	err = s.wgServer.Remove(sess.ServerProfileHandle)
 	if err != nil {
@@ -55,6 +67,11 @@ func (s *Service) handleDisconnect(w http.ResponseWriter, r *http.Request) {
 		// ignore error, disconnect still needs to be propagated
 	}
 
+	if sess.IsExit() {
+		writeResponse(w, http.StatusOK, DisconnectResponse{Result: "OK"})
+		return
+	}
+
 	err = s.wgClient.Remove(sess.ClientProfileHandle)
 	if err != nil {
 		slog.Error("failed to remove profile", slog.Any("err", err))
@@ -69,15 +86,15 @@ func (s *Service) handleDisconnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nextHopRequest := request
-	nextHopRequestBytes, err := json.Marshal(nextHopRequest)
+	nextHopRequestBytes, err := json.Marshal(sess.nextHopDisconnectRequest())
 	if err != nil {
 		slog.Error("failed to marshal disconnect request", slog.Any("err", err))
 		ErrInternalServerError.WithError(err).Handle(w)
 		return
 	}
 
-	nextHopReq, err := http.NewRequest(http.MethodPost, nextHopUrl, bytes.NewReader(nextHopRequestBytes))
+	ctx := hoppolicy.WithClient(context.Background(), sess.Owner)
+	nextHopReq, err := http.NewRequestWithContext(ctx, http.MethodPost, nextHopUrl, bytes.NewReader(nextHopRequestBytes))
 	if err != nil {
 		slog.Error("failed to create disconnect request", slog.Any("err", err))
 		ErrInternalServerError.WithError(err).Handle(w)
@@ -85,37 +102,27 @@ func (s *Service) handleDisconnect(w http.ResponseWriter, r *http.Request) {
 	}
 	nextHopReq.Header.Set("Content-Type", "application/json")
 	nextHopReq.Header.Set("Accept", "application/json")
+	sess.NextHopCredentials.setBasicAuth(nextHopReq)
 	// Skip origin IP address forwarding
 	//nextHopReq.Header.Set("X-Forwarded-For", getNextHeader(r))
 
+	startTime := time.Now()
 	nextHopResp, err := s.c.Do(nextHopReq)
 	if err != nil {
-		ErrInternalServerError.WithError(err).Handle(w)
+		slog.Warn("failed to send disconnect request to next hop", slog.String("host", sess.NextHops[0]),
+			slog.Any("err", err))
+		s.traceHop(nextHopRequestError(nextHopReq, err), nextHopReq, startTime).Handle(w)
 		return
 	}
 	defer nextHopResp.Body.Close()
 
 	if nextHopResp.StatusCode != http.StatusOK {
-		var nextHopError ApiError
-		err = json.NewDecoder(nextHopResp.Body).Decode(&nextHopError)
-		if err != nil {
-			slog.Error("failed to decode error from next hop disconnect",
-				slog.String("host", sess.NextHops[0]),
-				slog.String("status", nextHopResp.Status),
-				slog.Any("err", err))
-			ErrInternalServerError.WithError(err).Handle(w)
-			return
-		}
-
+		nextHopError := decodeNextHopError(nextHopResp)
 		slog.Warn("error from next hop disconnect",
 			slog.String("host", sess.NextHops[0]),
 			slog.String("result", nextHopError.Result),
 			slog.String("error_msg", nextHopError.ErrorMsg))
-
-		nextHopError.HttpCode = nextHopResp.StatusCode
-		nextHopError.ErrorMsg = "Error from " + nextHopUrl + ": " + nextHopError.ErrorMsg
-
-		writeResponse(w, nextHopResp.StatusCode, &nextHopError)
+		s.traceHop(nextHopError, nextHopReq, startTime).Handle(w)
 		return
 	}
 
@@ -125,9 +132,75 @@ func (s *Service) handleDisconnect(w http.ResponseWriter, r *http.Request) {
 		slog.Error("failed to decode response from next hop disconnect",
 			slog.String("host", sess.NextHops[0]),
 			slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
+		s.traceHop(ErrNextHopInvalidResponse.WithError(err), nextHopReq, startTime).Handle(w)
 		return
 	}
 
 	writeResponse(w, http.StatusOK, DisconnectResponse{Result: "OK"})
 }
+
+func (sess *Session) nextHopDisconnectRequest() DisconnectRequest {
+	request := DisconnectRequest{
+		SessionID:    sess.nextHopSessionId(),
+		SessionToken: sess.NextHopSessionToken,
+	}
+	if sess.NextHopSessionToken == "" {
+		credentials := sess.nextHopCredentials()
+		request.Username = credentials.Username
+		request.Password = credentials.Password
+		request.AccessToken = credentials.AccessToken
+	}
+	return request
+}
+
+// disconnectNextHop closes the session on the next hop without involving the client.
+func (s *Service) disconnectNextHop(ctx context.Context, sess *Session) error {
+	nextHopUrl, err := url.JoinPath(sess.NextHops[0], "/wireguard/disconnect")
+	if err != nil {
+		return fmt.Errorf("join next hop url: %v", err)
+	}
+
+	return s.postJSON(ctx, nextHopUrl, sess.nextHopDisconnectRequest(), nil, sess.NextHopCredentials)
+}
+
+// postJSON sends request to another bridge and decodes response if it is not nil, error response is returned as
+// *ApiError.
+func (s *Service) postJSON(ctx context.Context, requestUrl string, request, response any,
+	credentials *HopCredentials) error {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestUrl, bytes.NewReader(requestBytes))
+	if err != nil {
+		return fmt.Errorf("create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	credentials.setBasicAuth(req)
+
+	resp, err := s.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiError ApiError
+		err = json.NewDecoder(resp.Body).Decode(&apiError)
+		if err != nil {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		apiError.HttpCode = resp.StatusCode
+		return &apiError
+	}
+
+	if response != nil {
+		err = json.NewDecoder(resp.Body).Decode(response)
+		if err != nil {
+			return fmt.Errorf("decode response: %v", err)
+		}
+	}
+	return nil
+}
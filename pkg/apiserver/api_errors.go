@@ -12,6 +12,13 @@ type ApiError struct {
 	HttpCode int    `json:"-"`
 	Result   string `json:"result"`
 	ErrorMsg string `json:"error"`
+	// why watch has returned and suggested delay in seconds before the next attempt
+	Reason     string `json:"reason,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	// hop which has caused the error, e.g. ran out of connect time
+	Hop string `json:"hop,omitempty"`
+	// bridges the error has passed on the way back to the client
+	Hops []HopTrace `json:"hops,omitempty"`
 }
 
 var ErrInternalServerError = &ApiError{
@@ -59,12 +66,44 @@ var ErrSessionNotFound = &ApiError{
 	ErrorMsg: "Session not found",
 }
 
+// when session was terminated by one of the bridges in chain
+var ErrSessionTerminated = &ApiError{
+	HttpCode: http.StatusGone,
+	Result:   "SESSION_TERMINATED",
+	ErrorMsg: "Session terminated",
+}
+
 var ErrNextHopUnavailable = &ApiError{
 	HttpCode: http.StatusBadGateway,
 	Result:   "NEXT_HOP_UNAVAILABLE",
 	ErrorMsg: "Next hop unavailable",
 }
 
+// when name of the next hop can't be resolved
+var ErrNextHopDNS = &ApiError{
+	HttpCode: http.StatusBadGateway,
+	Result:   "NEXT_HOP_DNS_ERROR",
+}
+
+// when TLS handshake with the next hop fails, e.g. untrusted certificate
+var ErrNextHopTLS = &ApiError{
+	HttpCode: http.StatusBadGateway,
+	Result:   "NEXT_HOP_TLS_ERROR",
+}
+
+// when the next hop responds with something else than api response
+var ErrNextHopInvalidResponse = &ApiError{
+	HttpCode: http.StatusBadGateway,
+	Result:   "NEXT_HOP_INVALID_RESPONSE",
+}
+
+// when connect has not completed within the deadline budget
+var ErrNextHopTimeout = &ApiError{
+	HttpCode: http.StatusGatewayTimeout,
+	Result:   "NEXT_HOP_TIMEOUT",
+	ErrorMsg: "Next hop timeout",
+}
+
 func (s ApiError) WithErrorMsg(errorMsg string) *ApiError {
 	s.ErrorMsg = errorMsg
 	return &s
@@ -83,11 +122,11 @@ func (s *ApiError) Handle(w http.ResponseWriter) {
 	writeError(w, s)
 }
 
-func writeResponse(w http.ResponseWriter, statusCode int, r any) {
+func writeResponse(w http.ResponseWriter, statusCode int, r any) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	e := json.NewEncoder(w)
-	_ = e.Encode(r)
+	return e.Encode(r)
 }
 
 func writeError(w http.ResponseWriter, err error) {
@@ -0,0 +1,365 @@
+package apiserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"pbridge/pkg/hoppolicy"
+	"strings"
+	"time"
+)
+
+// session event types pushed to clients
+const (
+	EventTypeTTL           = "ttl"
+	EventTypeReestablished = "reestablished"
+	EventTypeQuotaWarning  = "quota_warning"
+	EventTypeShutdown      = "shutdown"
+	EventTypeStats         = "stats"
+	EventTypeClosed        = "closed"
+)
+
+const (
+	eventsStatsInterval     = 30 * time.Second
+	eventsHeartbeatInterval = 15 * time.Second
+	eventsBufferSize        = 16
+	eventsTicketTTL         = 30 * time.Second
+)
+
+// AccessTokenHeader carries client access token of requests without body.
+const AccessTokenHeader = "X-Pbridge-Access-Token"
+
+type SessionEvent struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+	// name of the bridge which has emitted the event
+	Source string    `json:"source,omitempty"`
+	Time   time.Time `json:"time"`
+
+	TTL        int           `json:"ttl,omitempty"`
+	Reason     string        `json:"reason,omitempty"`
+	RetryAfter int           `json:"retry_after,omitempty"`
+	Stats      *SessionStats `json:"stats,omitempty"`
+}
+
+type SessionStats struct {
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+}
+
+func (s *Service) newEvent(sess *Session, eventType string) *SessionEvent {
+	return &SessionEvent{
+		Type:      eventType,
+		SessionID: sess.Id,
+		Source:    s.cfg.ServerName,
+		Time:      time.Now(),
+	}
+}
+
+// publish pushes event to all subscribers of the session, slow subscribers miss events.
+func (s *Service) publish(sess *Session, event *SessionEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for ch := range sess.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (s *Service) publishTTL(sess *Session, ttl int) {
+	event := s.newEvent(sess, EventTypeTTL)
+	event.TTL = ttl
+	s.publish(sess, event)
+}
+
+func (s *Service) subscribe(sess *Session) chan *SessionEvent {
+	ch := make(chan *SessionEvent, eventsBufferSize)
+
+	s.lock.Lock()
+	if sess.subscribers == nil {
+		sess.subscribers = map[chan *SessionEvent]struct{}{}
+	}
+	sess.subscribers[ch] = struct{}{}
+	s.lock.Unlock()
+
+	return ch
+}
+
+func (s *Service) unsubscribe(sess *Session, ch chan *SessionEvent) {
+	s.lock.Lock()
+	delete(sess.subscribers, ch)
+	s.lock.Unlock()
+}
+
+type EventsTicketRequest struct {
+	SessionID    string `json:"session_id"`
+	SessionToken string `json:"session_token,omitempty"`
+	AccessToken  string `json:"access_token,omitempty"`
+}
+
+type EventsTicketResponse struct {
+	Result string `json:"result"`
+	Ticket string `json:"ticket"`
+	// seconds to open the stream with the ticket
+	TTL int `json:"ttl"`
+}
+
+type eventsTicket struct {
+	sessionId  string
+	expireTime time.Time
+}
+
+// handleEventsTicket issues single-use ticket to open events stream of the session for clients which can't set
+// headers, e.g. EventSource. Unlike tokens, the ticket may be passed in the query string.
+func (s *Service) handleEventsTicket(w http.ResponseWriter, r *http.Request) {
+	var request EventsTicketRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		slog.Warn("failed to decode events ticket request", slog.Any("err", err))
+		ErrBadRequest.WithErrorMsg("Invalid json").Handle(w)
+		return
+	}
+
+	sess, err := s.authSession(r, request.SessionID, request.SessionToken, request.AccessToken)
+	if err != nil {
+		slog.Warn("session not authorized on events ticket", slog.String("session_id", request.SessionID),
+			slog.Any("err", err))
+		writeError(w, err)
+		return
+	}
+
+	ticket, ticketHash, err := newToken()
+	if err != nil {
+		slog.Error("failed to generate events ticket", slog.Any("err", err))
+		ErrInternalServerError.WithError(err).Handle(w)
+		return
+	}
+
+	s.lock.Lock()
+	s.eventsTickets[ticketHash] = eventsTicket{sessionId: sess.Id, expireTime: time.Now().Add(eventsTicketTTL)}
+	s.lock.Unlock()
+
+	writeResponse(w, http.StatusOK, &EventsTicketResponse{
+		Result: "OK",
+		Ticket: ticket,
+		TTL:    int(eventsTicketTTL / time.Second),
+	})
+}
+
+// redeemEventsTicket returns the session of the ticket, the ticket can't be used again.
+func (s *Service) redeemEventsTicket(sessionId, ticket string) (*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ticketHash := hashToken(ticket)
+	t, ok := s.eventsTickets[ticketHash]
+	delete(s.eventsTickets, ticketHash)
+	if !ok || t.sessionId != sessionId || time.Now().After(t.expireTime) {
+		return nil, ErrUnauthorized.WithErrorMsg("Invalid ticket")
+	}
+
+	sess, ok := s.sessions[sessionId]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+func (s *Service) dropExpiredEventsTickets() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for ticketHash, t := range s.eventsTickets {
+		if time.Now().After(t.expireTime) {
+			delete(s.eventsTickets, ticketHash)
+		}
+	}
+}
+
+// handleEvents streams lifecycle events of the session as Server-Sent Events. The session token is passed
+// in Authorization header as Bearer token and access token in X-Pbridge-Access-Token header, tokens in the query
+// string would end up in access logs. Clients which can't set headers use a ticket from handleEventsTicket.
+func (s *Service) handleEvents(w http.ResponseWriter, r *http.Request) {
+	sessionId := r.URL.Query().Get("session_id")
+
+	var sess *Session
+	var err error
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		sess, err = s.redeemEventsTicket(sessionId, ticket)
+	} else {
+		sessionToken, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		sess, err = s.authSession(r, sessionId, sessionToken, r.Header.Get(AccessTokenHeader))
+	}
+	if err != nil {
+		slog.Warn("session not authorized on events", slog.String("session_id", sessionId), slog.Any("err", err))
+		writeError(w, err)
+		return
+	}
+
+	slog.Info("events request", slog.String("session_id", sess.Id))
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	err = rc.Flush()
+	if err != nil {
+		slog.Warn("events stream is not supported", slog.Any("err", err))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(hoppolicy.WithClient(r.Context(), sess.Owner))
+	defer cancel()
+
+	events := s.subscribe(sess)
+	defer s.unsubscribe(sess, events)
+
+	if !sess.IsExit() {
+		go s.relayNextHopEvents(ctx, sess, events)
+	}
+
+	s.lock.Lock()
+	done := sess.done
+	s.lock.Unlock()
+
+	statsTicker := time.NewTicker(eventsStatsInterval)
+	defer statsTicker.Stop()
+	heartbeatTicker := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for {
+		var event *SessionEvent
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			s.lock.Lock()
+			reason := sess.closeEvent
+			s.lock.Unlock()
+
+			event = s.newEvent(sess, EventTypeClosed)
+			event.Reason = reason
+			event.RetryAfter = retryAfter(reason)
+			_ = writeEvent(w, rc, event)
+			return
+		case <-s.shutdownCh:
+			event = s.newEvent(sess, EventTypeShutdown)
+			event.RetryAfter = retryAfter(WatchReasonShutdown)
+			_ = writeEvent(w, rc, event)
+			return
+		case <-heartbeatTicker.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+			continue
+		case <-statsTicker.C:
+			event = s.newEvent(sess, EventTypeStats)
+			event.Stats = sess.stats()
+		case event = <-events:
+		}
+
+		err = writeEvent(w, rc, event)
+		if err != nil {
+			slog.Info("events stream closed", slog.String("session_id", sess.Id), slog.Any("err", err))
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, rc *http.ResponseController, event *SessionEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	if err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// relayNextHopEvents subscribes to events of the session on the next hop and passes them to the local stream.
+// Next hops without events support are ignored.
+func (s *Service) relayNextHopEvents(ctx context.Context, sess *Session, events chan *SessionEvent) {
+	nextHopUrl, err := url.JoinPath(sess.NextHops[0], "/wireguard/events")
+	if err != nil {
+		return
+	}
+	nextHopUrl += "?" + url.Values{"session_id": {sess.nextHopSessionId()}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nextHopUrl, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if sess.NextHopSessionToken != "" {
+		req.Header.Set("Authorization", "Bearer "+sess.NextHopSessionToken)
+	} else {
+		// next hop without session tokens authenticates the client as on connect
+		credentials := sess.nextHopCredentials()
+		if credentials.Username != "" {
+			req.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+		if credentials.AccessToken != "" {
+			req.Header.Set(AccessTokenHeader, credentials.AccessToken)
+		}
+	}
+
+	resp, err := s.c.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("failed to subscribe to next hop events", slog.String("host", sess.NextHops[0]),
+				slog.Any("err", err))
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Info("next hop doesn't stream events", slog.String("host", sess.NextHops[0]),
+			slog.String("status", resp.Status))
+		return
+	}
+
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+
+		var event SessionEvent
+		err = json.Unmarshal([]byte(data.String()), &event)
+		data.Reset()
+		if err != nil {
+			slog.Warn("failed to decode next hop event", slog.String("host", sess.NextHops[0]), slog.Any("err", err))
+			continue
+		}
+		// the session may have another id on the next hop
+		event.SessionID = sess.Id
+
+		select {
+		case events <- &event:
+		default:
+		}
+	}
+}
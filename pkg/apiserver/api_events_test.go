@@ -0,0 +1,196 @@
+package apiserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	exit, err := New(config.APIConfig{
+		ServerName:     "exit",
+		SessionStorage: t.TempDir(),
+		Exit:           config.ExitConfig{Enabled: true},
+	}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, exit)
+	exitServer := httptest.NewServer(exit)
+	defer exitServer.Close()
+
+	bridge, err := New(config.APIConfig{
+		ServerName:     "bridge",
+		SessionStorage: t.TempDir(),
+	}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, bridge)
+	bridgeServer := httptest.NewServer(bridge)
+	defer bridgeServer.Close()
+
+	rec := httptest.NewRecorder()
+	bridge.ServeHTTP(rec, connectRequest(t, exitServer.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response ConnectResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+
+	// session token is required
+	resp, err := http.Get(bridgeServer.URL + "/wireguard/events?session_id=" + response.SessionID)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, bridgeServer.URL+"/wireguard/events?session_id="+response.SessionID, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+response.SessionToken)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan SessionEvent, 8)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var event SessionEvent
+				if json.Unmarshal([]byte(data), &event) == nil {
+					events <- event
+				}
+			}
+		}
+		close(events)
+	}()
+
+	// wait for relay subscription on the exit
+	require.Eventually(t, func() bool {
+		exit.lock.Lock()
+		defer exit.lock.Unlock()
+		sess, ok := exit.sessions[response.SessionID]
+		return ok && len(sess.subscribers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	bridge.ServeHTTP(rec, jsonRequest(t, "/wireguard/update", &UpdateRequest{
+		SessionID:    response.SessionID,
+		SessionToken: response.SessionToken,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	sources := map[string]SessionEvent{}
+	for len(sources) < 2 {
+		select {
+		case event := <-events:
+			sources[event.Source] = event
+		case <-time.After(5 * time.Second):
+			t.Fatal("events are not received")
+		}
+	}
+	require.Equal(t, EventTypeTTL, sources["bridge"].Type)
+	require.Equal(t, EventTypeTTL, sources["exit"].Type)
+	require.Equal(t, 3600, sources["exit"].TTL)
+
+	// stream ends with closed event
+	bridge.lock.Lock()
+	sess := bridge.sessions[response.SessionID]
+	delete(bridge.sessions, response.SessionID)
+	bridge.lock.Unlock()
+	bridge.closeSession(sess, SessionEventTerminated)
+
+	var last SessionEvent
+	for event := range events {
+		last = event
+	}
+	require.Equal(t, EventTypeClosed, last.Type)
+	require.Equal(t, SessionEventTerminated, last.Reason)
+}
+
+func TestEventsTicket(t *testing.T) {
+	exit, err := New(config.APIConfig{
+		ServerName:     "exit",
+		SessionStorage: t.TempDir(),
+		Exit:           config.ExitConfig{Enabled: true},
+	}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, exit)
+	exitServer := httptest.NewServer(exit)
+	defer exitServer.Close()
+
+	rec := httptest.NewRecorder()
+	exit.ServeHTTP(rec, connectRequest(t))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response ConnectResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	eventsUrl := exitServer.URL + "/wireguard/events?session_id=" + response.SessionID
+
+	// tokens are not accepted in the query string
+	resp, err := http.Get(eventsUrl + "&session_token=" + response.SessionToken)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	rec = httptest.NewRecorder()
+	exit.ServeHTTP(rec, jsonRequest(t, "/wireguard/events/ticket", &EventsTicketRequest{
+		SessionID:    response.SessionID,
+		SessionToken: "invalid",
+	}))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = httptest.NewRecorder()
+	exit.ServeHTTP(rec, jsonRequest(t, "/wireguard/events/ticket", &EventsTicketRequest{
+		SessionID:    response.SessionID,
+		SessionToken: response.SessionToken,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var ticket EventsTicketResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&ticket))
+	require.NotEmpty(t, ticket.Ticket)
+
+	resp, err = http.Get(eventsUrl + "&ticket=" + ticket.Ticket)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	resp.Body.Close()
+
+	// ticket is single-use
+	resp, err = http.Get(eventsUrl + "&ticket=" + ticket.Ticket)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRelayNextHopEventsCredentials(t *testing.T) {
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	requests := make(chan *http.Request, 1)
+	nextHop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		ErrUnauthorized.Handle(w)
+	}))
+	defer nextHop.Close()
+
+	// legacy mode, the next hop requires the client access token
+	sess := &Session{
+		Id:          "session-1",
+		NextHops:    []string{nextHop.URL},
+		Username:    "user",
+		Password:    "password",
+		AccessToken: "access-token",
+	}
+	s.relayNextHopEvents(context.Background(), sess, make(chan *SessionEvent, 1))
+
+	r := <-requests
+	username, password, ok := r.BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "user", username)
+	require.Equal(t, "password", password)
+	require.Equal(t, "access-token", r.Header.Get(AccessTokenHeader))
+}
@@ -0,0 +1,112 @@
+package apiserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"pbridge/pkg/wgserver"
+	"time"
+)
+
+// handleExitConnect terminates the chain on this bridge: the client peer is added to the wireguard server and its
+// traffic is passed to the kernel network stack to be masqueraded out of the external interface.
+func (s *Service) handleExitConnect(w http.ResponseWriter, r *http.Request, request *ConnectRequest,
+	credentials HopCredentials, owner string) {
+	slog.Info("incoming exit connect", slog.String("username", credentials.Username),
+		slog.String("client_public_key", request.ClientPublicKey))
+
+	var sessionIdBytes [16]byte
+	_, err := rand.Read(sessionIdBytes[:])
+	if err != nil {
+		slog.Error("failed to generate session id", slog.Any("err", err))
+		ErrInternalServerError.WithError(err).Handle(w)
+		return
+	}
+
+	sessionToken, sessionTokenHash, err := newToken()
+	if err != nil {
+		slog.Error("failed to generate session token", slog.Any("err", err))
+		ErrInternalServerError.WithError(err).Handle(w)
+		return
+	}
+
+	internalIP4, internalIP6, err := s.wgServer.AllocateInternalIPs()
+	if err != nil {
+		slog.Error("failed to allocate internal IPs", slog.Any("err", err))
+		ErrInternalServerError.WithError(err).Handle(w)
+		return
+	}
+	var internalIP4Str, internalIP6Str string
+	if internalIP4 != nil {
+		internalIP4Str = internalIP4.String()
+	}
+	if internalIP6 != nil {
+		internalIP6Str = internalIP6.String()
+	}
+
+	exitCfg := s.cfg.Exit
+	ttl := exitCfg.GetTTL()
+
+	currentTime := time.Now()
+	session := &Session{
+		Id:              hex.EncodeToString(sessionIdBytes[:]),
+		StartTime:       currentTime,
+		UpdateTime:      currentTime,
+		ExpireTime:      currentTime.Add(time.Duration(ttl) * time.Second),
+		Username:        credentials.Username,
+		Owner:           owner,
+		ClientPublicKey: request.ClientPublicKey,
+
+		SessionTokenHash: sessionTokenHash,
+		idempotencyKey:   request.IdempotencyKey,
+		CallbackURL:      request.CallbackURL,
+		CallbackToken:    request.CallbackToken,
+
+		DNS4:                        exitCfg.GetDNS4(),
+		MTU:                         exitCfg.GetMTU(),
+		PersistentKeepaliveInterval: exitCfg.GetPersistentKeepaliveInterval(),
+		RXTimeout:                   exitCfg.RXTimeout,
+
+		ServerProfile: &wgserver.ServerProfile{
+			ClientPublicKey: request.ClientPublicKey,
+			ServerPublicKey: s.wgServer.GetPublicKey(),
+			KeepAlive:       exitCfg.GetPersistentKeepaliveInterval(),
+			InternalIP4:     internalIP4Str,
+			InternalIP6:     internalIP6Str,
+		},
+	}
+	if internalIP6Str != "" {
+		session.DNS6 = exitCfg.GetDNS6()
+	}
+
+	err = s.setupSession(session)
+	if err != nil {
+		slog.Error("failed to setup session", slog.Any("err", err))
+		ErrInternalServerError.WithError(err).Handle(w)
+		return
+	}
+
+	if !s.sendConnectResponse(w, r, session, ttl, sessionToken) {
+		return
+	}
+
+	slog.Info("connected as exit", slog.String("username", credentials.Username), slog.String("session_id", session.Id),
+		slog.String("internal_ip", internalIP4Str), slog.String("internal_ip6", internalIP6Str))
+}
+
+// handleExitUpdate renews exit session with configured TTL.
+func (s *Service) handleExitUpdate(w http.ResponseWriter, sess *Session) {
+	ttl := s.cfg.Exit.GetTTL()
+
+	s.lock.Lock()
+	currentTime := time.Now()
+	sess.UpdateTime = currentTime
+	sess.ExpireTime = currentTime.Add(time.Duration(ttl) * time.Second)
+	s.lock.Unlock()
+
+	// renewed expiry is persisted, so the session is not dropped as expired after restart
+	s.signalSave(sess.Id)
+	s.publishTTL(sess, ttl)
+	writeResponse(w, http.StatusOK, &UpdateResponse{Result: "OK", TTL: ttl})
+}
@@ -0,0 +1,93 @@
+package apiserver
+
+import (
+	"context"
+	"time"
+)
+
+// max length of idempotency_key in connect request
+const maxIdempotencyKeyLen = 128
+
+// idempotentConnect is connect identified by client idempotency key, its response is kept for retries.
+type idempotentConnect struct {
+	// closed when the connect has completed
+	done       chan struct{}
+	response   *ConnectResponse
+	expireTime time.Time
+}
+
+// idempotencyCacheKey scopes idempotency key to the client, so nobody else can get its session token.
+func idempotencyCacheKey(owner string, clientPublicKey string, idempotencyKey string) string {
+	return owner + "\x00" + clientPublicKey + "\x00" + idempotencyKey
+}
+
+// beginIdempotentConnect returns response of the completed connect with the same key or registers this one, retries
+// arriving while the connect is in progress wait for it. Response of the session which has been closed since is
+// not returned.
+func (s *Service) beginIdempotentConnect(ctx context.Context, key string) (*ConnectResponse, error) {
+	for {
+		s.lock.Lock()
+		c, ok := s.connects[key]
+		if ok && c.response != nil && (time.Now().After(c.expireTime) || s.sessions[c.response.SessionID] == nil) {
+			delete(s.connects, key)
+			ok = false
+		}
+		if !ok {
+			s.connects[key] = &idempotentConnect{done: make(chan struct{})}
+			s.lock.Unlock()
+			return nil, nil
+		}
+		if c.response != nil {
+			s.lock.Unlock()
+			return c.response, nil
+		}
+		s.lock.Unlock()
+
+		// the connect in progress may fail, then this one takes over
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// finishIdempotentConnect wakes up waiting retries, the key is released if the connect has failed.
+func (s *Service) finishIdempotentConnect(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.connects[key]
+	if !ok {
+		return
+	}
+	if c.response == nil {
+		delete(s.connects, key)
+	}
+	close(c.done)
+}
+
+// storeConnectResponse keeps response delivered to the client for retries with the same idempotency key.
+func (s *Service) storeConnectResponse(session *Session, response *ConnectResponse) {
+	if session.idempotencyKey == "" {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.connects[idempotencyCacheKey(session.Owner, session.ClientPublicKey, session.idempotencyKey)]
+	if ok {
+		c.response = response
+		c.expireTime = time.Now().Add(s.cfg.Idempotency.GetTTL())
+	}
+}
+
+// dropExpiredConnects forgets responses of connects which can't be retried anymore.
+func (s *Service) dropExpiredConnects() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, c := range s.connects {
+		if c.response != nil && time.Now().After(c.expireTime) {
+			delete(s.connects, key)
+		}
+	}
+}
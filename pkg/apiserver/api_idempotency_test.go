@@ -0,0 +1,68 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"sync"
+	"testing"
+)
+
+func TestIdempotentConnect(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	connect := func(idempotencyKey string) *ConnectResponse {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+			ClientPublicKey: key.PublicKey().String(),
+			NextHops:        []string{nextHop.URL},
+			IdempotencyKey:  idempotencyKey,
+		}))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var response ConnectResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return &response
+	}
+
+	// concurrent retries get the session of the first attempt
+	responses := make([]*ConnectResponse, 3)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = connect("retry-1")
+		}()
+	}
+	wg.Wait()
+	for _, response := range responses {
+		require.Equal(t, responses[0], response)
+	}
+	require.Equal(t, 1, nextHop.connects)
+	require.Equal(t, "retry-1", nextHop.lastConnect.IdempotencyKey)
+	require.Len(t, s.sessions, 1)
+
+	// another key creates another session
+	response := connect("retry-2")
+	require.NotEqual(t, responses[0].SessionID, response.SessionID)
+	require.Equal(t, 2, nextHop.connects)
+
+	// closed session is not returned
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/disconnect", &DisconnectRequest{
+		SessionID:    response.SessionID,
+		SessionToken: response.SessionToken,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEqual(t, response.SessionID, connect("retry-2").SessionID)
+	require.Equal(t, 3, nextHop.connects)
+}
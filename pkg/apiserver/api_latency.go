@@ -0,0 +1,108 @@
+package apiserver
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"pbridge/pkg/hoppolicy"
+	"pbridge/pkg/prober"
+	"time"
+)
+
+// LatencyProber measures round trip time to next hops.
+type LatencyProber interface {
+	Measure(ctx context.Context, nextHops []string) []*prober.Result
+}
+
+type NextHopLatency struct {
+	NextHop string `json:"next_hop"`
+	Healthy bool   `json:"healthy"`
+	// round trip time in milliseconds
+	RTT         float64   `json:"rtt,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	MeasureTime time.Time `json:"measure_time"`
+}
+
+type LatencyResponse struct {
+	Result   string            `json:"result"`
+	NextHops []*NextHopLatency `json:"next_hops"`
+}
+
+// selectNextHop orders candidates by latency and returns the fastest healthy one as next hop and the others as
+// alternatives. If none of them answers probes, e.g. they don't run the XDP responder, the order is kept.
+func (s *Service) selectNextHop(ctx context.Context, candidates []string) ([]string, []string) {
+	results := s.prober.Measure(ctx, candidates)
+	prober.SortByLatency(results)
+	if !results[0].Healthy() {
+		slog.Warn("no healthy next hop candidate, keep requested order", slog.Any("candidates", candidates))
+		return candidates[:1], candidates[1:]
+	}
+
+	slog.Info("next hop selected by latency", slog.String("next_hop", results[0].NextHop),
+		slog.Duration("rtt", results[0].RTT))
+	alternatives := make([]string, 0, len(results)-1)
+	for _, result := range results[1:] {
+		alternatives = append(alternatives, result.NextHop)
+	}
+	return []string{results[0].NextHop}, alternatives
+}
+
+// handleLatency measures latency to next hops passed in next_hop query parameters. Access token is passed in
+// X-Pbridge-Access-Token header, tokens in the query string would end up in access logs.
+func (s *Service) handleLatency(w http.ResponseWriter, r *http.Request) {
+	identity, err := s.authClient(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.authAccessToken(r.Context(), identity, r.Header.Get(AccessTokenHeader))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	nextHops := r.URL.Query()["next_hop"]
+	if len(nextHops) == 0 {
+		ErrBadRequest.WithErrorMsg("next_hop is required").Handle(w)
+		return
+	}
+	if len(nextHops) > s.cfg.Probe.GetMaxCandidates() {
+		ErrBadRequest.WithErrorMsg("Too many next_hop").Handle(w)
+		return
+	}
+
+	// the bridge doesn't probe hosts the client isn't allowed to use
+	ctx := hoppolicy.WithClient(r.Context(), identity.Username)
+	for _, nextHop := range nextHops {
+		err = s.hopPolicy.Check(ctx, identity.Username, nextHop)
+		if err != nil {
+			slog.Warn("next hop is not allowed", slog.String("url", nextHop), slog.String("client", identity.Username),
+				slog.Any("err", err))
+			ErrHopNotAllowed.WithError(err).Handle(w)
+			return
+		}
+
+		if len(identity.AllowedHops) > 0 && !hoppolicy.MatchPatterns(identity.AllowedHops, nextHop) {
+			ErrHopNotAllowed.WithErrorMsg("Next hop is not allowed by access token").Handle(w)
+			return
+		}
+	}
+
+	response := &LatencyResponse{Result: "OK", NextHops: make([]*NextHopLatency, 0, len(nextHops))}
+	for _, result := range s.prober.Measure(ctx, nextHops) {
+		latency := &NextHopLatency{
+			NextHop:     result.NextHop,
+			Healthy:     result.Healthy(),
+			MeasureTime: result.Time,
+		}
+		if result.Healthy() {
+			latency.RTT = float64(result.RTT.Microseconds()) / 1000
+		} else {
+			latency.Error = result.Err.Error()
+		}
+		response.NextHops = append(response.NextHops, latency)
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
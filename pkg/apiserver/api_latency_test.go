@@ -0,0 +1,139 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pbridge/pkg/config"
+	"pbridge/pkg/prober"
+	"testing"
+	"time"
+)
+
+// fakeProber returns fixed round trip times, next hops without one are unhealthy.
+type fakeProber map[string]time.Duration
+
+func (p fakeProber) Measure(_ context.Context, nextHops []string) []*prober.Result {
+	results := make([]*prober.Result, 0, len(nextHops))
+	for _, nextHop := range nextHops {
+		result := &prober.Result{NextHop: nextHop, Time: time.Now()}
+		rtt, ok := p[nextHop]
+		if ok {
+			result.RTT = rtt
+		} else {
+			result.Err = errors.New("timeout")
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestExitCandidates(t *testing.T) {
+	slow := newFakeNextHop(t)
+	fast := newFakeNextHop(t)
+	down := newFakeNextHop(t)
+
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+	s.prober = fakeProber{slow.URL: 80 * time.Millisecond, fast.URL: 10 * time.Millisecond}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	candidates := []string{down.URL, slow.URL, fast.URL}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+		ClientPublicKey: key.PublicKey().String(),
+		ExitCandidates:  candidates,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	sess := s.sessions["upstream-1"]
+	require.Equal(t, []string{fast.URL}, sess.NextHops)
+	require.Equal(t, []string{slow.URL, down.URL}, sess.NextHopAlternatives)
+	require.Empty(t, fast.lastConnect.NextHops)
+	require.Empty(t, fast.lastConnect.ExitCandidates)
+
+	// candidates are passed to the bridge before the exit
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+		ClientPublicKey: key.PublicKey().String(),
+		NextHops:        []string{slow.URL},
+		ExitCandidates:  candidates,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, candidates, slow.lastConnect.ExitCandidates)
+
+	rec = httptest.NewRecorder()
+	query := url.Values{"next_hop": candidates}
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/wireguard/latency?"+query.Encode(), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response LatencyResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	require.Len(t, response.NextHops, 3)
+	require.False(t, response.NextHops[0].Healthy)
+	require.NotEmpty(t, response.NextHops[0].Error)
+	require.Equal(t, 80.0, response.NextHops[1].RTT)
+}
+
+func TestLatencyAccessToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "EC", "kid": "ec1", "crv": "P-256",
+			"x": base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			"y": base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		AccessToken: config.AccessTokenConfig{
+			Required: true,
+			Issuers: []config.TokenIssuerConfig{{
+				Issuer:    "https://idp.example.com",
+				Audiences: []string{"pbridge"},
+				JWKSURL:   jwks.URL,
+			}},
+		},
+	}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+	s.prober = fakeProber{"https://exit.example.com": 10 * time.Millisecond}
+
+	accessToken := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": "https://idp.example.com",
+		"sub": "user1",
+		"aud": "pbridge",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	accessToken.Header["kid"] = "ec1"
+	signedToken, err := accessToken.SignedString(key)
+	require.NoError(t, err)
+
+	// token in the query string is not accepted
+	query := url.Values{"next_hop": {"https://exit.example.com"}, "access_token": {signedToken}}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/wireguard/latency?"+query.Encode(), nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/wireguard/latency?next_hop=https://exit.example.com", nil)
+	req.Header.Set(AccessTokenHeader, signedToken)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+}
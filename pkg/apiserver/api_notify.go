@@ -0,0 +1,143 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"pbridge/pkg/hoppolicy"
+	"time"
+)
+
+// session termination events reported to previous hops
+const (
+	SessionEventTerminated    = "terminated"
+	SessionEventExpired       = "expired"
+	SessionEventQuotaExceeded = "quota_exceeded"
+	SessionEventIdle          = "idle"
+)
+
+// tombstones are kept to tell the client why its session has disappeared
+const tombstoneTTL = time.Hour
+
+type tombstone struct {
+	event string
+	time  time.Time
+}
+
+type NotifyRequest struct {
+	SessionID     string `json:"session_id"`
+	CallbackToken string `json:"callback_token"`
+	Event         string `json:"event"`
+}
+
+type NotifyResponse struct {
+	Result string `json:"result"`
+}
+
+// handleNotify is called by the next hop when it terminates the session. Local resources are released and
+// the notification is passed further to the previous hop.
+func (s *Service) handleNotify(w http.ResponseWriter, r *http.Request) {
+	var request NotifyRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		slog.Warn("failed to decode notify request", slog.Any("err", err))
+		ErrBadRequest.WithErrorMsg("Invalid json").Handle(w)
+		return
+	}
+
+	switch request.Event {
+	case SessionEventTerminated, SessionEventExpired, SessionEventQuotaExceeded, SessionEventIdle,
+		WatchReasonUpstreamFailure:
+	default:
+		// unknown events from newer versions still terminate the session
+		request.Event = SessionEventTerminated
+	}
+
+	s.lock.Lock()
+	sess, ok := s.findNextHopSession(request.SessionID)
+	if ok && !checkToken(request.CallbackToken, sess.CallbackTokenHash) {
+		s.lock.Unlock()
+		slog.Warn("invalid callback token", slog.String("session_id", request.SessionID))
+		ErrUnauthorized.WithErrorMsg("Invalid callback token").Handle(w)
+		return
+	}
+	if ok {
+		delete(s.sessions, sess.Id)
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		slog.Warn("session not found on notify", slog.String("session_id", request.SessionID))
+		ErrSessionNotFound.Handle(w)
+		return
+	}
+
+	slog.Info("session terminated by next hop", slog.String("session_id", sess.Id),
+		slog.String("host", sess.NextHops[0]), slog.String("event", request.Event))
+
+	s.releaseSession(sess)
+	s.addTombstone(sess, request.Event)
+	if sess.CallbackURL != "" {
+		s.enqueueTeardown(&teardownTask{sess: sess, reason: request.Event, notify: true})
+	}
+	s.signalSave()
+
+	writeResponse(w, http.StatusOK, &NotifyResponse{Result: "OK"})
+}
+
+// findNextHopSession finds the session by its id on the next hop. Must be called with lock held.
+func (s *Service) findNextHopSession(nextHopSessionId string) (*Session, bool) {
+	sess, ok := s.sessions[nextHopSessionId]
+	if ok && sess.NextHopSessionID == "" {
+		return sess, true
+	}
+
+	// reestablished sessions have another id on the next hop
+	for _, sess = range s.sessions {
+		if sess.NextHopSessionID == nextHopSessionId {
+			return sess, true
+		}
+	}
+	return nil, false
+}
+
+// notifyPreviousHop reports session termination to the previous hop.
+func (s *Service) notifyPreviousHop(ctx context.Context, sess *Session, event string) error {
+	return s.postJSON(hoppolicy.WithCallback(ctx), sess.CallbackURL, &NotifyRequest{
+		SessionID:     sess.Id,
+		CallbackToken: sess.CallbackToken,
+		Event:         event,
+	}, nil, nil)
+}
+
+// addTombstone remembers why the session was terminated and wakes up its watchers.
+func (s *Service) addTombstone(sess *Session, event string) {
+	s.lock.Lock()
+	s.tombstones[sess.Id] = tombstone{event: event, time: time.Now()}
+	s.lock.Unlock()
+
+	s.markClosed(sess, event)
+}
+
+// terminatedError returns error for session which was terminated recently, nil if it is unknown.
+func (s *Service) terminatedError(sessionId string) error {
+	s.lock.Lock()
+	t, ok := s.tombstones[sessionId]
+	s.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return ErrSessionTerminated.WithErrorMsg("Session " + t.event)
+}
+
+func (s *Service) dropExpiredTombstones() {
+	s.lock.Lock()
+	for id, t := range s.tombstones {
+		if time.Since(t.time) > tombstoneTTL {
+			delete(s.tombstones, id)
+		}
+	}
+	s.lock.Unlock()
+}
@@ -0,0 +1,121 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"pbridge/pkg/sessionstore"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	// previous hop which expects to be notified
+	notifications := make(chan NotifyRequest, 1)
+	previousHop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request NotifyRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		notifications <- request
+		writeResponse(w, http.StatusOK, &NotifyResponse{Result: "OK"})
+	}))
+	defer previousHop.Close()
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		PublicURL:      "https://bridge.example.com",
+		// previous hop runs on loopback
+		HopPolicy: config.HopPolicyConfig{CallbackAllowCIDRs: []string{"127.0.0.0/8"}},
+	}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	connectReq := connectRequest(t, nextHop.URL)
+	var request ConnectRequest
+	require.NoError(t, json.NewDecoder(connectReq.Body).Decode(&request))
+	request.CallbackURL = previousHop.URL
+	request.CallbackToken = "previous-hop-token"
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &request))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response ConnectResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+
+	callback := nextHop.lastConnect
+	require.Equal(t, "https://bridge.example.com/wireguard/notify", callback.CallbackURL)
+	require.NotEmpty(t, callback.CallbackToken)
+
+	// invalid token is rejected
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/notify", &NotifyRequest{
+		SessionID:     response.SessionID,
+		CallbackToken: "invalid",
+		Event:         SessionEventExpired,
+	}))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/notify", &NotifyRequest{
+		SessionID:     response.SessionID,
+		CallbackToken: callback.CallbackToken,
+		Event:         SessionEventExpired,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Empty(t, wgServer.peers)
+	require.Empty(t, wgClient.profiles)
+
+	select {
+	case notification := <-notifications:
+		require.Equal(t, NotifyRequest{
+			SessionID:     response.SessionID,
+			CallbackToken: "previous-hop-token",
+			Event:         SessionEventExpired,
+		}, notification)
+	case <-time.After(5 * time.Second):
+		t.Fatal("previous hop is not notified")
+	}
+
+	// client learns why the session has disappeared
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/update", &UpdateRequest{
+		SessionID:    response.SessionID,
+		SessionToken: response.SessionToken,
+	}))
+	require.Equal(t, http.StatusGone, rec.Code)
+	require.Contains(t, rec.Body.String(), "SESSION_TERMINATED")
+
+	// terminated by next hop, so it is not disconnected
+	require.Empty(t, nextHop.disconnects)
+}
+
+func TestNotifyCallbackRefused(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	s, err := New(config.APIConfig{SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory}},
+		newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+
+	for _, callback := range []string{"http://127.0.0.1:8080/wireguard/notify", "http://169.254.169.254/latest",
+		"http://[fe80::1]/wireguard/notify"} {
+		connectReq := connectRequest(t, nextHop.URL)
+		var request ConnectRequest
+		require.NoError(t, json.NewDecoder(connectReq.Body).Decode(&request))
+		request.CallbackURL = callback
+		request.CallbackToken = "previous-hop-token"
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &request))
+		require.Equal(t, http.StatusForbidden, rec.Code, callback)
+		require.Contains(t, rec.Body.String(), "HOP_NOT_ALLOWED")
+	}
+
+	require.Zero(t, nextHop.connects)
+	require.Empty(t, s.sessions)
+}
@@ -0,0 +1,56 @@
+package apiserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type KeyResponse struct {
+	Result     string `json:"result"`
+	ServerName string `json:"server_name"`
+	PublicKey  string `json:"public_key"`
+}
+
+// handleKey advertises the public key which clients use to encrypt onion layers for this bridge.
+func (s *Service) handleKey(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, &KeyResponse{
+		Result:     "OK",
+		ServerName: s.cfg.ServerName,
+		PublicKey:  s.onionKey.PublicKey().String(),
+	})
+}
+
+func loadOnionKey(keyFile string) (wgtypes.Key, error) {
+	if keyFile == "" {
+		slog.Warn("onion key file is not configured, using temporary key")
+		return wgtypes.GeneratePrivateKey()
+	}
+
+	slog.Info("load onion private key", slog.String("file", keyFile))
+	keyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return wgtypes.Key{}, fmt.Errorf("reading onion private key file: %w", err)
+		}
+
+		slog.Info("onion private key file not found, generating a new one")
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return wgtypes.Key{}, fmt.Errorf("generate onion private key: %w", err)
+		}
+		if err := os.WriteFile(keyFile, []byte(key.String()), 0o600); err != nil {
+			return wgtypes.Key{}, fmt.Errorf("write onion private key file: %w", err)
+		}
+		return key, nil
+	}
+
+	key, err := wgtypes.ParseKey(string(keyData))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("parse onion private key: %w", err)
+	}
+	return key, nil
+}
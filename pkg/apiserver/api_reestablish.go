@@ -0,0 +1,238 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"pbridge/pkg/hoppolicy"
+	"pbridge/pkg/wgclient"
+	"slices"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// why the session is reestablished on the next hop
+const (
+	ReestablishReasonSessionLost      = "session_lost"
+	ReestablishReasonHandshakeTimeout = "handshake_timeout"
+	// next hop doesn't respond, session fails over to an alternative
+	ReestablishReasonNextHopUnavailable = "next_hop_unavailable"
+)
+
+var errReestablishNotAvailable = errors.New("session can't be reestablished")
+
+// reestablishSession connects the session again on the next hop or on one of its alternatives with a fresh key and
+// switches forwarding of the downstream peer to the new upstream interface. The downstream client keeps its peer,
+// internal IP and session id. TTL of the new upstream session is returned.
+func (s *Service) reestablishSession(ctx context.Context, sess *Session, reason string) (int, error) {
+	s.lock.Lock()
+	if sess.reestablishing || sess.NextHopRoute == nil || s.sessions[sess.Id] != sess {
+		s.lock.Unlock()
+		return 0, errReestablishNotAvailable
+	}
+	sess.reestablishing = true
+	// the request is authenticated as the connect which has created the session
+	credentials := sess.nextHopCredentials()
+	request := ConnectRequest{
+		Username:       credentials.Username,
+		Password:       credentials.Password,
+		AccessToken:    credentials.AccessToken,
+		NextHops:       sess.NextHopRoute.NextHops,
+		Onion:          sess.NextHopRoute.Onion,
+		ExitCandidates: sess.NextHopRoute.ExitCandidates,
+	}
+	if sess.NextHopCredentials != nil && credentials != (HopCredentials{}) {
+		request.HopCredentials = []HopCredentials{credentials}
+	}
+	candidates := append([]string{sess.NextHops[0]}, sess.NextHopAlternatives...)
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		sess.reestablishing = false
+		s.lock.Unlock()
+	}()
+
+	log := slog.With(slog.String("session_id", sess.Id), slog.String("host", sess.NextHops[0]),
+		slog.String("reason", reason))
+	log.Info("reestablish session on next hop")
+
+	ctx = hoppolicy.WithClient(ctx, sess.Owner)
+	nextHopPrivateKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		return 0, fmt.Errorf("generate wireguard key pair: %v", err)
+	}
+	request.ClientPublicKey = nextHopPrivateKey.PublicKey().String()
+
+	var callbackTokenHash string
+	if s.cfg.PublicURL != "" {
+		request.CallbackURL, err = url.JoinPath(s.cfg.PublicURL, "/wireguard/notify")
+		if err != nil {
+			return 0, fmt.Errorf("join callback url: %v", err)
+		}
+		request.CallbackToken, callbackTokenHash, err = newToken()
+		if err != nil {
+			return 0, fmt.Errorf("generate callback token: %v", err)
+		}
+	}
+
+	requestBytes, err := json.Marshal(&request)
+	if err != nil {
+		return 0, fmt.Errorf("marshal connect request: %v", err)
+	}
+
+	deadline := time.Now().Add(s.cfg.GetConnectTimeout())
+	var response *ConnectResponse
+	var nextHop string
+	for i, candidate := range candidates {
+		err = s.hopPolicy.Check(ctx, sess.Owner, candidate)
+		if err == nil {
+			response, err = s.connectNextHop(ctx, candidate, requestBytes, sess.NextHopCredentials, deadline,
+				len(candidates) > 1)
+		}
+		if err == nil {
+			nextHop = candidate
+			break
+		}
+		if i == len(candidates)-1 {
+			return 0, fmt.Errorf("connect next hop: %v", err)
+		}
+		log.Warn("failed to reestablish session on next hop, try alternative", slog.String("candidate", candidate),
+			slog.Any("err", err))
+	}
+	nextHops := append([]string{nextHop}, sess.NextHops[1:]...)
+
+	// session on the next hop to close if the switch fails or the previous one is still alive
+	upstream := &Session{
+		Id:                  sess.Id,
+		Owner:               sess.Owner,
+		NextHops:            nextHops,
+		NextHopSessionID:    response.SessionID,
+		NextHopSessionToken: response.SessionToken,
+		NextHopCredentials:  sess.NextHopCredentials,
+		Username:            sess.Username,
+		Password:            sess.Password,
+		AccessToken:         sess.AccessToken,
+	}
+
+	clientProfile := &wgclient.Profile{
+		ServerIP:                    response.ConnectIP,
+		ServerPort:                  response.ConnectPort,
+		ServerPublicKey:             response.ServerPublicKey,
+		ClientPrivateKey:            nextHopPrivateKey.String(),
+		ClientPublicKey:             nextHopPrivateKey.PublicKey().String(),
+		InternalIP4:                 response.InternalIP,
+		InternalIP6:                 response.InternalIP6,
+		PersistentKeepaliveInterval: response.PersistentKeepaliveInterval,
+		MTU:                         response.MTU,
+	}
+	clientProfileHandle, err := s.switchUpstream(sess, clientProfile)
+	if err != nil {
+		s.enqueueTeardown(&teardownTask{sess: upstream, reason: SessionEventTerminated})
+		return 0, err
+	}
+
+	s.lock.Lock()
+	if s.sessions[sess.Id] != sess {
+		// session was closed meanwhile, its teardown doesn't know about the new upstream
+		s.lock.Unlock()
+		log.Warn("session closed during reestablish")
+		if err := s.wgClient.Remove(clientProfileHandle); err != nil {
+			log.Error("failed to remove client profile", slog.Any("err", err))
+		}
+		s.enqueueTeardown(&teardownTask{sess: upstream, reason: SessionEventTerminated})
+		return 0, errReestablishNotAvailable
+	}
+	// the previous upstream session is disconnected below in case the next hop still has it
+	upstream.NextHops = sess.NextHops
+	upstream.NextHopSessionID = sess.NextHopSessionID
+	upstream.NextHopSessionToken = sess.NextHopSessionToken
+	oldClientProfileHandle := sess.ClientProfileHandle
+
+	if nextHop != sess.NextHops[0] {
+		log.Info("fail over to alternative next hop", slog.String("alternative", nextHop))
+		// the previous next hop stays the last resort
+		sess.NextHopAlternatives = append(slices.DeleteFunc(slices.Clone(sess.NextHopAlternatives),
+			func(alternative string) bool { return alternative == nextHop }), sess.NextHops[0])
+		sess.NextHops = nextHops
+	}
+
+	currentTime := time.Now()
+	sess.UpdateTime = currentTime
+	sess.setupTime = currentTime
+	sess.ExpireTime = currentTime.Add(time.Duration(response.TTL) * time.Second)
+	sess.NextHopSessionID = response.SessionID
+	if response.SessionID == sess.Id {
+		sess.NextHopSessionID = ""
+	}
+	sess.NextHopSessionToken = response.SessionToken
+	if callbackTokenHash != "" {
+		sess.CallbackTokenHash = callbackTokenHash
+	}
+	sess.NextHopServerPublicKey = response.ServerPublicKey
+	sess.NextHopConnectIP4 = response.ConnectIP
+	sess.NextHopConnectIP6 = response.ConnectIP6
+	sess.NextHopConnectPort = response.ConnectPort
+	sess.NextHopInternalIP4 = response.InternalIP
+	sess.NextHopInternalIP6 = response.InternalIP6
+	sess.ClientProfile = clientProfile
+	sess.ClientProfileHandle = clientProfileHandle
+	s.lock.Unlock()
+
+	err = s.wgClient.Remove(oldClientProfileHandle)
+	if err != nil {
+		log.Error("failed to remove previous client profile", slog.Any("err", err))
+	}
+
+	if reason != ReestablishReasonSessionLost {
+		s.enqueueTeardown(&teardownTask{sess: upstream, reason: SessionEventTerminated})
+	}
+
+	s.signalSave(sess.Id)
+
+	event := s.newEvent(sess, EventTypeReestablished)
+	event.Reason = reason
+	event.TTL = response.TTL
+	s.publish(sess, event)
+
+	log.Info("session reestablished", slog.String("next_hop", nextHop),
+		slog.String("next_hop_session_id", response.SessionID),
+		slog.String("next_hop_internal_ip", response.InternalIP))
+	return response.TTL, nil
+}
+
+// switchUpstream adds the new upstream interface and rewrites forwarding rules of the downstream peer to it.
+func (s *Service) switchUpstream(sess *Session, clientProfile *wgclient.Profile) (*wgclient.ProfileHandle, error) {
+	clientProfileHandle, err := s.wgClient.Add(clientProfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add client profile: %v", err)
+	}
+
+	err = s.wgClient.SetupForwarding(clientProfileHandle, sess.ServerProfileHandle.IP4, sess.ServerProfileHandle.IP6,
+		s.wgServer.GetLink())
+	if err == nil {
+		err = s.wgServer.SetupForwarding(sess.ServerProfileHandle, net.ParseIP(clientProfile.InternalIP4),
+			net.ParseIP(clientProfile.InternalIP6), s.wgClient.GetLink(clientProfileHandle))
+	}
+	if err != nil {
+		// downstream traffic is pointed back to the previous interface
+		restoreErr := s.wgServer.SetupForwarding(sess.ServerProfileHandle, net.ParseIP(sess.NextHopInternalIP4),
+			net.ParseIP(sess.NextHopInternalIP6), s.wgClient.GetLink(sess.ClientProfileHandle))
+		if restoreErr != nil {
+			slog.Error("failed to restore server forwarding", slog.String("session_id", sess.Id),
+				slog.Any("err", restoreErr))
+		}
+		if removeErr := s.wgClient.Remove(clientProfileHandle); removeErr != nil {
+			slog.Error("failed to cleanup client profile", slog.Any("originalErr", err),
+				slog.Any("cleanupErr", removeErr))
+		}
+		return nil, fmt.Errorf("failed to setup forwarding: %v", err)
+	}
+
+	return clientProfileHandle, nil
+}
@@ -0,0 +1,316 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestReestablish(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Reestablish:    config.ReestablishConfig{Enabled: true},
+	}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var connectResponse ConnectResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&connectResponse))
+	sess := s.sessions[connectResponse.SessionID]
+	firstKey := nextHop.lastConnect.ClientPublicKey
+	firstHandle := sess.ClientProfileHandle
+
+	// next hop has restarted, update connects the session again
+	nextHop.lock.Lock()
+	nextHop.lost = true
+	nextHop.lock.Unlock()
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/update", &UpdateRequest{
+		SessionID:    connectResponse.SessionID,
+		SessionToken: connectResponse.SessionToken,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	nextHop.lock.Lock()
+	require.Equal(t, 2, nextHop.connects)
+	require.NotEqual(t, firstKey, nextHop.lastConnect.ClientPublicKey)
+	nextHop.lock.Unlock()
+
+	require.Equal(t, "upstream-2", sess.NextHopSessionID)
+	require.Equal(t, "10.1.0.2", sess.ServerProfile.InternalIP4)
+	require.Contains(t, s.sessions, connectResponse.SessionID)
+	require.NotSame(t, firstHandle, sess.ClientProfileHandle)
+	require.Len(t, wgClient.profiles, 1)
+	require.Len(t, wgServer.peers, 1)
+
+	// upstream without handshake is replaced and the stale session is disconnected on the next hop
+	s.handleStaleUpstream(sess.ClientProfileHandle)
+
+	require.Eventually(t, func() bool {
+		nextHop.lock.Lock()
+		defer nextHop.lock.Unlock()
+		return nextHop.connects == 3 && len(nextHop.disconnects) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	nextHop.lock.Lock()
+	require.Equal(t, "upstream-2", nextHop.disconnects[0].SessionID)
+	nextHop.lock.Unlock()
+
+	s.lock.Lock()
+	require.Equal(t, "upstream-3", sess.NextHopSessionID)
+	s.lock.Unlock()
+}
+
+func TestStaleUpstreamTeardown(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{
+		SessionStorage:  t.TempDir(),
+		OnStaleUpstream: StaleUpstreamTeardown,
+	}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	sess := s.sessions["upstream-1"]
+	s.handleStaleUpstream(sess.ClientProfileHandle)
+
+	require.Empty(t, s.sessions)
+	require.Empty(t, wgClient.profiles)
+	require.Equal(t, WatchReasonUpstreamFailure, s.tombstones["upstream-1"].event)
+	require.Eventually(t, func() bool {
+		nextHop.lock.Lock()
+		defer nextHop.lock.Unlock()
+		return len(nextHop.disconnects) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = New(config.APIConfig{OnStaleUpstream: "restart"}, wgServer, wgClient)
+	require.Error(t, err)
+}
+
+func TestNextHopFailover(t *testing.T) {
+	primary := newFakeNextHop(t)
+	alternative := newFakeNextHop(t)
+	alternative.prefix = "alternative"
+	dead := newFakeNextHop(t)
+	dead.Close()
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	connect := func(nextHop string, alternatives ...string) *ConnectResponse {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+			ClientPublicKey:     key.PublicKey().String(),
+			NextHops:            []string{nextHop},
+			NextHopAlternatives: alternatives,
+		}))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var response ConnectResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return &response
+	}
+
+	// unavailable next hop is skipped on connect
+	connect(dead.URL, primary.URL)
+	sess := s.sessions["upstream-1"]
+	require.Equal(t, []string{primary.URL}, sess.NextHops)
+	require.Equal(t, []string{dead.URL}, sess.NextHopAlternatives)
+
+	// established session fails over when its next hop dies
+	connectResponse := connect(alternative.URL, primary.URL)
+	require.Equal(t, "alternative-1", connectResponse.SessionID)
+	sess = s.sessions[connectResponse.SessionID]
+	alternative.Close()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/update", &UpdateRequest{
+		SessionID:    connectResponse.SessionID,
+		SessionToken: connectResponse.SessionToken,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Equal(t, []string{primary.URL}, sess.NextHops)
+	require.Equal(t, []string{alternative.URL}, sess.NextHopAlternatives)
+	require.Equal(t, "upstream-2", sess.NextHopSessionID)
+	require.Len(t, wgClient.profiles, 2)
+
+	// number of alternatives is limited
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+		NextHops:            []string{primary.URL},
+		NextHopAlternatives: []string{alternative.URL, alternative.URL, alternative.URL, alternative.URL},
+	}))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestNextHopFailoverTimeout(t *testing.T) {
+	slow := newFakeNextHop(t)
+	alternative := newFakeNextHop(t)
+	alternative.prefix = "alternative"
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Failover:       config.FailoverConfig{AttemptTimeout: 1},
+	}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	// the slow next hop creates the session after the bridge has moved on to the alternative
+	slow.onConnect = func() {
+		slow.lock.Lock()
+		first := slow.connects == 1
+		slow.lock.Unlock()
+		if first {
+			time.Sleep(1500 * time.Millisecond)
+		}
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+		ClientPublicKey:     key.PublicKey().String(),
+		NextHops:            []string{slow.URL},
+		NextHopAlternatives: []string{alternative.URL},
+		IdempotencyKey:      "connect-1",
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, s.sessions, "alternative-1")
+
+	// connect is replayed with its idempotency key and the session it returns is disconnected
+	require.Eventually(t, func() bool {
+		slow.lock.Lock()
+		defer slow.lock.Unlock()
+		return len(slow.disconnects) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	slow.lock.Lock()
+	require.Equal(t, "connect-1", slow.lastConnect.IdempotencyKey)
+	require.Equal(t, DisconnectRequest{SessionID: "upstream-2", SessionToken: "upstream-token"}, slow.disconnects[0])
+	slow.lock.Unlock()
+}
+
+func TestReestablishClosedSession(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Reestablish:    config.ReestablishConfig{Enabled: true},
+	}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+	sess := s.sessions["upstream-1"]
+
+	// client disconnects while the session is connected again on the next hop
+	nextHop.lock.Lock()
+	nextHop.onConnect = func() {
+		s.lock.Lock()
+		delete(s.sessions, sess.Id)
+		s.lock.Unlock()
+		s.closeSession(sess, SessionEventTerminated)
+	}
+	nextHop.lock.Unlock()
+
+	_, err = s.reestablishSession(context.Background(), sess, ReestablishReasonSessionLost)
+	require.ErrorIs(t, err, errReestablishNotAvailable)
+
+	wgClient.lock.Lock()
+	require.Empty(t, wgClient.profiles)
+	wgClient.lock.Unlock()
+	require.Eventually(t, func() bool {
+		nextHop.lock.Lock()
+		defer nextHop.lock.Unlock()
+		for _, disconnect := range nextHop.disconnects {
+			if disconnect.SessionID == "upstream-2" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReestablishHopCredentials(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Reestablish:    config.ReestablishConfig{Enabled: true},
+	}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	connect := func(hopCredentials ...HopCredentials) *Session {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+			ClientPublicKey: key.PublicKey().String(),
+			NextHops:        []string{nextHop.URL, "https://exit.example.com"},
+			HopCredentials:  hopCredentials,
+		}))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var response ConnectResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return s.sessions[response.SessionID]
+	}
+	bridge := HopCredentials{Username: "bridge", Password: "bridge-password"}
+	next := HopCredentials{Username: "next", Password: "next-password"}
+
+	// reestablish is authenticated with credentials of the next hop like the connect
+	sess := connect(bridge, next)
+	_, err = s.reestablishSession(context.Background(), sess, ReestablishReasonSessionLost)
+	require.NoError(t, err)
+	nextHop.lock.Lock()
+	require.Equal(t, 2, nextHop.connects)
+	require.Equal(t, "next", nextHop.lastConnectUser)
+	require.Equal(t, []HopCredentials{next}, nextHop.lastConnect.HopCredentials)
+	require.Equal(t, []string{"https://exit.example.com"}, nextHop.lastConnect.NextHops)
+	nextHop.lock.Unlock()
+
+	// credentials of the hops behind the next one are not stored
+	sess = connect(bridge, next, HopCredentials{Username: "exit", Password: "exit-password"})
+	require.Nil(t, sess.NextHopRoute)
+	_, err = s.reestablishSession(context.Background(), sess, ReestablishReasonSessionLost)
+	require.ErrorIs(t, err, errReestablishNotAvailable)
+
+	require.NoError(t, s.Save())
+	s.saveLock.Lock()
+	for _, data := range s.saved {
+		require.NotContains(t, string(data), "exit-password")
+		require.NotContains(t, string(data), "bridge-password")
+	}
+	s.saveLock.Unlock()
+}
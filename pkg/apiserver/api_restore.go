@@ -0,0 +1,198 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"pbridge/pkg/config"
+	"pbridge/pkg/sessionstore"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RestoreEntry tells why the stored session has not been restored.
+type RestoreEntry struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason"`
+	// failed session has been moved to the quarantine directory
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// RestoreReport is the outcome of restoring stored sessions on startup.
+type RestoreReport struct {
+	StartTime  time.Time      `json:"start_time"`
+	DurationMs int64          `json:"duration_ms"`
+	Restored   int            `json:"restored"`
+	Skipped    []RestoreEntry `json:"skipped"`
+	Failed     []RestoreEntry `json:"failed"`
+}
+
+// storedSession is a decoded session with the key it is stored under, which may differ from the session id of
+// a damaged record.
+type storedSession struct {
+	key     string
+	session *Session
+}
+
+// quarantinedSession is kept for the operator to inspect the failure.
+type quarantinedSession struct {
+	Reason  string          `json:"reason"`
+	Time    time.Time       `json:"time"`
+	Session json.RawMessage `json:"session,omitempty"`
+	// stored data which is not valid json
+	Data []byte `json:"data,omitempty"`
+}
+
+// restoreSessions sets up stored sessions with bounded concurrency. Expired sessions and sessions of another server
+// key are skipped, sessions which fail to decode or set up are moved to quarantine, so they neither block startup
+// nor get lost.
+func (s *Service) restoreSessions(stored map[string][]byte) {
+	report := &RestoreReport{StartTime: time.Now(), Skipped: []RestoreEntry{}, Failed: []RestoreEntry{}}
+
+	serverPublicKey := s.wgServer.GetPublicKey()
+	var sessionList []storedSession
+	for _, id := range slices.Sorted(maps.Keys(stored)) {
+		var session Session
+		err := json.Unmarshal(stored[id], &session)
+		if err == nil {
+			err = validateStoredSession(&session)
+		}
+		if session.Owner == "" {
+			// stored before sessions had owners, owner is the client which connected it
+			session.Owner = session.Username
+		}
+		switch {
+		case err != nil:
+			report.Failed = append(report.Failed, RestoreEntry{SessionID: id, Reason: err.Error()})
+		case time.Since(session.ExpireTime) > 0:
+			report.Skipped = append(report.Skipped, RestoreEntry{SessionID: id, Reason: "expired"})
+		case session.ServerProfile.ServerPublicKey != serverPublicKey:
+			report.Skipped = append(report.Skipped, RestoreEntry{SessionID: id, Reason: "server key changed"})
+		default:
+			// reserved up front, so parallel setups don't take internal IPs of each other
+			s.wgServer.ReserveInternalIPs(
+				net.ParseIP(session.ServerProfile.InternalIP4),
+				net.ParseIP(session.ServerProfile.InternalIP6),
+			)
+			sessionList = append(sessionList, storedSession{key: id, session: &session})
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.cfg.Restore.GetConcurrency())
+	for _, stored := range sessionList {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := s.setupSession(stored.session)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				slog.Error("failed to restore session", slog.String("session_id", stored.session.Id),
+					slog.String("key", stored.key), slog.Any("err", err))
+				// reported and quarantined under the store key, so the record is moved rather than left behind
+				report.Failed = append(report.Failed, RestoreEntry{SessionID: stored.key, Reason: err.Error()})
+				return
+			}
+			report.Restored++
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(report.Failed, func(a, b RestoreEntry) int { return strings.Compare(a.SessionID, b.SessionID) })
+	s.quarantineSessions(report.Failed, stored)
+
+	report.DurationMs = time.Since(report.StartTime).Milliseconds()
+	s.lock.Lock()
+	s.restoreReport = report
+	s.lock.Unlock()
+
+	slog.Info("sessions restored", slog.Int("restored", report.Restored), slog.Int("skipped", len(report.Skipped)),
+		slog.Int("failed", len(report.Failed)), slog.Int64("duration_ms", report.DurationMs))
+	if len(report.Skipped) > 0 || len(report.Failed) > 0 {
+		s.signalSave()
+	}
+}
+
+// validateStoredSession rejects sessions which would crash the setup.
+func validateStoredSession(session *Session) error {
+	if session.Id == "" {
+		return errors.New("missing session id")
+	}
+	if session.ServerProfile == nil {
+		return errors.New("missing server profile")
+	}
+	if !session.IsExit() && session.ClientProfile == nil {
+		return errors.New("missing client profile")
+	}
+	return nil
+}
+
+// quarantineSessions moves failed sessions to the quarantine directory, encrypted the same way as the session store.
+// Sessions which can't be quarantined are left in the store.
+func (s *Service) quarantineSessions(failed []RestoreEntry, stored map[string][]byte) {
+	if len(failed) == 0 {
+		return
+	}
+
+	var quarantine sessionstore.Store
+	var err error
+	quarantineDir := s.cfg.GetQuarantineDir()
+	if quarantineDir == "" {
+		err = errors.New("quarantine directory is not configured")
+	} else {
+		quarantine, err = sessionstore.Open(config.SessionStoreConfig{
+			Type:       sessionstore.TypeDir,
+			Encryption: s.cfg.SessionStore.Encryption,
+		}, quarantineDir)
+	}
+
+	put := map[string][]byte{}
+	if err == nil {
+		for _, entry := range failed {
+			record := quarantinedSession{Reason: entry.Reason, Time: time.Now()}
+			if json.Valid(stored[entry.SessionID]) {
+				record.Session = stored[entry.SessionID]
+			} else {
+				record.Data = stored[entry.SessionID]
+			}
+			put[entry.SessionID], err = json.MarshalIndent(&record, "", "  ")
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = quarantine.Apply(put, nil)
+	}
+	if quarantine != nil {
+		_ = quarantine.Close()
+	}
+
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	for i := range failed {
+		if err != nil {
+			// never written and never deleted by saves
+			delete(s.saved, failed[i].SessionID)
+			continue
+		}
+		failed[i].Quarantined = true
+	}
+	if err != nil {
+		slog.Error("failed to quarantine sessions, they are left in the store", slog.Int("sessions", len(failed)),
+			slog.Any("err", err))
+		return
+	}
+	slog.Warn("sessions moved to quarantine", slog.Int("sessions", len(failed)),
+		slog.String("dir", quarantineDir))
+}
@@ -0,0 +1,94 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pbridge/pkg/config"
+	"pbridge/pkg/sessionstore"
+	"testing"
+	"time"
+)
+
+func TestRestoreReport(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	cfg := config.APIConfig{SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory}}
+	s, err := New(cfg, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, s.Save())
+	stored, err := s.store.Load()
+	require.NoError(t, err)
+
+	variant := func(id string, modify func(*Session)) []byte {
+		var session Session
+		require.NoError(t, json.Unmarshal(stored["upstream-1"], &session))
+		session.Id = id
+		modify(&session)
+		data, err := json.Marshal(&session)
+		require.NoError(t, err)
+		return data
+	}
+	store := sessionstore.NewMemoryStore()
+	require.NoError(t, store.Apply(map[string][]byte{
+		// client profile can't be added on restore
+		"upstream-1": stored["upstream-1"],
+		// stored under a key other than its id
+		"renamed-1": stored["upstream-1"],
+		"exit-1": variant("exit-1", func(session *Session) {
+			session.NextHops = nil
+			session.Owner = ""
+			session.Username = "bob"
+			session.ServerProfile.InternalIP4 = "10.1.0.100"
+		}),
+		"expired-1": variant("expired-1", func(session *Session) {
+			session.ExpireTime = time.Now().Add(-time.Minute)
+		}),
+		"garbage-1":   []byte("{"),
+		"noprofile-1": []byte(`{"id":"noprofile-1"}`),
+	}, nil))
+
+	cfg.Restore.QuarantineDir = t.TempDir()
+	wgServer := newFakeWgServer("")
+	restored, err := New(cfg, wgServer, newFakeWgClient("client_add"))
+	require.NoError(t, err)
+	restored.store = store
+	require.NoError(t, restored.Load())
+
+	report := restored.restoreReport
+	require.Equal(t, 1, report.Restored)
+	require.Equal(t, []RestoreEntry{{SessionID: "expired-1", Reason: "expired"}}, report.Skipped)
+	require.Len(t, report.Failed, 4)
+	for i, id := range []string{"garbage-1", "noprofile-1", "renamed-1", "upstream-1"} {
+		require.Equal(t, id, report.Failed[i].SessionID)
+		require.True(t, report.Failed[i].Quarantined)
+		require.FileExists(t, filepath.Join(cfg.Restore.QuarantineDir, id+".json"))
+	}
+	require.Equal(t, "missing server profile", report.Failed[1].Reason)
+	require.Contains(t, report.Failed[2].Reason, errInjected.Error())
+	require.Contains(t, report.Failed[3].Reason, errInjected.Error())
+	// internal IP of the failed session is released
+	require.Len(t, wgServer.acquired, 1)
+
+	data, err := os.ReadFile(filepath.Join(cfg.Restore.QuarantineDir, "upstream-1.json"))
+	require.NoError(t, err)
+	var record quarantinedSession
+	require.NoError(t, json.Unmarshal(data, &record))
+	require.JSONEq(t, string(stored["upstream-1"]), string(record.Session))
+
+	// quarantined and skipped sessions are removed from the store
+	require.NoError(t, restored.Save())
+	sessions, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Contains(t, sessions, "exit-1")
+	// sessions stored without owner are owned by the client which connected them
+	require.Equal(t, "bob", restored.sessions["exit-1"].Owner)
+
+}
@@ -1,170 +1,134 @@
 package apiserver
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"net"
-	"os"
-	"path"
-	"strings"
+	"maps"
+	"pbridge/pkg/sessionstore"
 	"time"
 )
 
+// Save writes sessions changed since the previous save to the store and deletes closed ones.
 func (s *Service) Save() error {
-	s.lock.Lock()
-	sessionList := make([]*Session, 0, len(s.sessions))
-	for _, session := range s.sessions {
-		if time.Since(session.ExpireTime) > 0 {
-			continue
-		}
-		sessionList = append(sessionList, session)
-	}
-	s.lock.Unlock()
-
-	return saveSessions(sessionList, s.cfg.SessionStorage)
+	return s.save(true)
 }
 
-func (s *Service) Load() error {
-	sessionList, err := loadSessions(s.cfg.SessionStorage)
-	if err != nil {
-		return err
-	}
+// save encodes all sessions or only the ones marked by signalSave and writes those which differ from the store.
+// Closed and expired sessions are deleted in both cases.
+func (s *Service) save(all bool) error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
 
-	serverPublicKey := s.wgServer.GetPublicKey()
-	for _, session := range sessionList {
+	s.lock.Lock()
+	var sessionList []*Session
+	add := func(session *Session) {
 		if time.Since(session.ExpireTime) > 0 {
-			continue
+			return
 		}
-
-		if session.ServerProfile.ServerPublicKey != serverPublicKey {
-			continue
+		// copy, sessions are updated under lock while they are encoded
+		sessionCopy := *session
+		sessionList = append(sessionList, &sessionCopy)
+	}
+	if all {
+		for _, session := range s.sessions {
+			add(session)
+		}
+	} else {
+		for id := range s.dirty {
+			if session, ok := s.sessions[id]; ok {
+				add(session)
+			}
 		}
-
-		s.wgServer.ReserveInternalIPs(
-			net.ParseIP(session.ServerProfile.InternalIP4),
-			net.ParseIP(session.ServerProfile.InternalIP6),
-		)
-
-		err = s.setupSession(session)
-		if err != nil {
-			return fmt.Errorf("failed to setup session: %v", err)
+	}
+	var del []string
+	for id, data := range s.saved {
+		session, ok := s.sessions[id]
+		switch {
+		case !ok || time.Since(session.ExpireTime) > 0:
+			del = append(del, id)
+		case data == nil && !all:
+			// the store asks for the session to be rewritten
+			if _, ok := s.dirty[id]; !ok {
+				add(session)
+			}
 		}
 	}
+	dirty := s.dirty
+	s.dirty = map[string]struct{}{}
+	s.lock.Unlock()
 
-	return nil
-}
-
-func saveSessions(sessionList []*Session, sessionDir string) error {
-	err := os.MkdirAll(sessionDir, 0755)
+	err := s.apply(sessionList, del)
 	if err != nil {
-		return fmt.Errorf("failed to create session storage directory: %v", err)
+		// changes are written by the next save
+		s.lock.Lock()
+		for id := range dirty {
+			s.dirty[id] = struct{}{}
+		}
+		s.lock.Unlock()
 	}
+	return err
+}
 
-	savedSessionMap := make(map[string]struct{})
+func (s *Service) apply(sessionList []*Session, del []string) error {
+	put := map[string][]byte{}
+	encoded := make(map[string][]byte, len(sessionList))
 	for _, session := range sessionList {
-		tempSessionFile := path.Join(sessionDir, fmt.Sprintf("%s.tmp.json", session.Id))
-		sessionFile := path.Join(sessionDir, fmt.Sprintf("%s.json", session.Id))
-
-		fd, err := os.Create(tempSessionFile)
-		if err != nil {
-			return fmt.Errorf("failed to create session file: %v", err)
-		}
-
-		e := json.NewEncoder(fd)
-		e.SetIndent("", "  ")
-		err = e.Encode(session)
+		data, err := json.MarshalIndent(session, "", "  ")
 		if err != nil {
 			return fmt.Errorf("failed to encode session: %v", err)
 		}
+		data = append(data, '\n')
 
-		err = fd.Close()
-		if err != nil {
-			return fmt.Errorf("failed to close session file: %v", err)
-		}
-
-		err = os.Rename(tempSessionFile, sessionFile)
-		if err != nil {
-			return fmt.Errorf("failed to rename session file: %v", err)
+		encoded[session.Id] = data
+		if !bytes.Equal(s.saved[session.Id], data) {
+			put[session.Id] = data
 		}
-
-		savedSessionMap[session.Id] = struct{}{}
+	}
+	if len(put) == 0 && len(del) == 0 {
+		return nil
 	}
 
-	fileList, err := os.ReadDir(sessionDir)
+	err := s.store.Apply(put, del)
 	if err != nil {
-		return fmt.Errorf("failed to read session storage directory: %v", err)
+		return err
 	}
-
-	for _, file := range fileList {
-		if file.IsDir() {
-			continue
-		}
-
-		// Remove temp session files
-		if strings.HasSuffix(file.Name(), ".tmp.json") {
-			err := os.Remove(path.Join(sessionDir, file.Name()))
-			if err != nil {
-				return fmt.Errorf("failed to remove temp session file: %v", err)
-			}
-			continue
-		}
-
-		if !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
-
-		// Remove session files that are not in the session map
-		id := strings.TrimSuffix(file.Name(), ".json")
-		if _, ok := savedSessionMap[id]; !ok {
-			err := os.Remove(path.Join(sessionDir, file.Name()))
-			if err != nil {
-				return fmt.Errorf("failed to remove session file: %v", err)
-			}
-			continue
-		}
+	for id, data := range encoded {
+		s.saved[id] = data
+	}
+	for _, id := range del {
+		delete(s.saved, id)
 	}
-
 	return nil
 }
 
-func loadSessions(sessionDir string) ([]*Session, error) {
-	fileList, err := os.ReadDir(sessionDir)
+// Load restores stored sessions. Only failure to read the store is returned, sessions which can't be restored are
+// reported and moved to quarantine.
+func (s *Service) Load() error {
+	s.saveLock.Lock()
+	stored, err := s.store.Load()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("failed to read session storage directory: %v", err)
+		s.saveLock.Unlock()
+		return err
 	}
-
-	sessionList := make([]*Session, 0, len(fileList))
-	for _, file := range fileList {
-		if file.IsDir() {
-			continue
-		}
-
-		if !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
-
-		fd, err := os.Open(path.Join(sessionDir, file.Name()))
-		if err != nil {
-			return nil, fmt.Errorf("failed to open session file: %v", err)
-		}
-
-		var session Session
-		d := json.NewDecoder(fd)
-		err = d.Decode(&session)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode session: %v", err)
+	// the next save deletes sessions which are not restored and rewrites the ones the store asks for
+	s.saved = make(map[string][]byte, len(stored))
+	maps.Copy(s.saved, stored)
+	if rewriter, ok := s.store.(sessionstore.Rewriter); ok {
+		for id := range s.saved {
+			if rewriter.NeedsRewrite(id) {
+				s.saved[id] = nil
+			}
 		}
+	}
+	s.saveLock.Unlock()
 
-		err = fd.Close()
-		if err != nil {
-			return nil, fmt.Errorf("failed to close session file: %v", err)
+	for id, data := range stored {
+		if !json.Valid(data) && sessionstore.IsEncrypted(data) {
+			return fmt.Errorf("session %s is encrypted, configure session_store encryption key", id)
 		}
-
-		sessionList = append(sessionList, &session)
 	}
 
-	return sessionList, nil
+	s.restoreSessions(stored)
+	return nil
 }
@@ -0,0 +1,192 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"pbridge/pkg/config"
+	"pbridge/pkg/sessionstore"
+	"testing"
+	"time"
+)
+
+// countingStore counts applied changes and written sessions of the wrapped store.
+type countingStore struct {
+	sessionstore.Store
+	applies int
+	puts    int
+	closed  bool
+}
+
+func (s *countingStore) Apply(put map[string][]byte, del []string) error {
+	if s.closed {
+		return errors.New("store is closed")
+	}
+	s.applies++
+	s.puts += len(put)
+	return s.Store.Apply(put, del)
+}
+
+func (s *countingStore) Close() error {
+	s.closed = true
+	return s.Store.Close()
+}
+
+func TestSaveLoad(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	cfg := config.APIConfig{SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory}}
+	s, err := New(cfg, wgServer, newFakeWgClient(""))
+	require.NoError(t, err)
+	store := &countingStore{Store: s.store}
+	s.store = store
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// only changed sessions are written
+	require.NoError(t, s.Save())
+	require.NoError(t, s.Save())
+	require.Equal(t, 1, store.applies)
+
+	restored, err := New(cfg, wgServer, newFakeWgClient(""))
+	require.NoError(t, err)
+	restored.store = store
+	require.NoError(t, restored.Load())
+	require.Contains(t, restored.sessions, "upstream-1")
+
+	s.lock.Lock()
+	delete(s.sessions, "upstream-1")
+	s.lock.Unlock()
+	require.NoError(t, s.Save())
+	require.Equal(t, 2, store.applies)
+	sessions, err := store.Load()
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+}
+
+func TestSaveDirty(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	cfg := config.APIConfig{SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory}}
+	s, err := New(cfg, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	store := &countingStore{Store: s.store}
+	s.store = store
+
+	for range 3 {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.NoError(t, s.Save())
+	s.saveLock.Lock()
+	puts := store.puts
+	s.saveLock.Unlock()
+
+	s.lock.Lock()
+	for _, session := range s.sessions {
+		session.ExpireTime = session.ExpireTime.Add(time.Hour)
+	}
+	s.dirty["upstream-1"] = struct{}{}
+	delete(s.sessions, "upstream-3")
+	s.lock.Unlock()
+
+	// only the marked session is written, the closed one is deleted
+	require.NoError(t, s.save(false))
+	s.saveLock.Lock()
+	require.Equal(t, puts+1, store.puts)
+	s.saveLock.Unlock()
+	sessions, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+
+	// full save catches changes which were not marked
+	require.NoError(t, s.Save())
+	s.saveLock.Lock()
+	require.Equal(t, puts+2, store.puts)
+	s.saveLock.Unlock()
+}
+
+func TestLoadEncryptedWithoutKey(t *testing.T) {
+	key := make([]byte, 32)
+	store, err := sessionstore.NewEncryptedStore(sessionstore.NewMemoryStore(), [][]byte{key})
+	require.NoError(t, err)
+	require.NoError(t, store.Apply(map[string][]byte{"a": []byte("{}")}, nil))
+
+	s, err := New(config.APIConfig{SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory}},
+		newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	s.store = store.Store
+	require.ErrorContains(t, s.Load(), "configure session_store encryption key")
+}
+
+func TestShutdownClosesStore(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	cfg := config.APIConfig{
+		SessionStore:   config.SessionStoreConfig{Type: sessionstore.TypeBolt},
+		SessionStorage: filepath.Join(t.TempDir(), "sessions.db"),
+	}
+	s, err := New(cfg, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	store := &countingStore{Store: s.store}
+	s.store = store
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// workers are stopped, the last save is done before the store is closed
+	s.Shutdown(context.Background())
+	require.True(t, store.closed)
+
+	// lock of the store file is released
+	restored, err := New(cfg, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, restored)
+	require.NoError(t, restored.Load())
+	require.Contains(t, restored.sessions, "upstream-1")
+}
+
+func TestDisconnectSaved(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	cfg := config.APIConfig{SessionStore: config.SessionStoreConfig{Type: sessionstore.TypeMemory}}
+	s, err := New(cfg, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	store := s.store
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response ConnectResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	// the connect is saved and its signal consumed
+	require.Eventually(t, func() bool {
+		sessions, err := store.Load()
+		return err == nil && len(sessions) == 1 && len(s.saveCh) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, jsonRequest(t, "/wireguard/disconnect", &DisconnectRequest{
+		SessionID:    response.SessionID,
+		SessionToken: response.SessionToken,
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// the disconnect is journaled without waiting for the periodic save, a restart doesn't bring the session back
+	require.Eventually(t, func() bool {
+		sessions, err := store.Load()
+		return err == nil && len(sessions) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	restored, err := New(cfg, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, restored)
+	restored.store = store
+	require.NoError(t, restored.Load())
+	require.Empty(t, restored.sessions)
+}
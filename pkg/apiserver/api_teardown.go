@@ -0,0 +1,271 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"pbridge/pkg/hoppolicy"
+	"sync"
+	"time"
+)
+
+const teardownWorkers = 4
+
+// teardownTask is a disconnect of the next hop or a notification of the previous hop for the session closed by
+// this bridge.
+type teardownTask struct {
+	sess   *Session
+	reason string
+	// notify previous hop instead of disconnecting next hop
+	notify bool
+	// connect which has timed out, it is replayed with the same idempotency key to learn the session to disconnect
+	connect []byte
+	attempt int
+}
+
+// closeSession removes session which is already deleted from the session map, disconnects it on the next hop and
+// notifies the previous hop in background.
+func (s *Service) closeSession(sess *Session, event string) {
+	slog.Info("close session", slog.String("session_id", sess.Id), slog.String("event", event))
+	s.releaseSession(sess)
+	s.addTombstone(sess, event)
+
+	if !sess.IsExit() {
+		s.enqueueTeardown(&teardownTask{sess: sess, reason: event})
+	}
+	if sess.CallbackURL != "" {
+		s.enqueueTeardown(&teardownTask{sess: sess, reason: event, notify: true})
+	}
+
+	s.signalSave()
+}
+
+// releaseSession removes wireguard profiles of the session.
+func (s *Service) releaseSession(sess *Session) {
+	if sess.ServerProfileHandle != nil {
+		err := s.wgServer.Remove(sess.ServerProfileHandle)
+		if err != nil {
+			slog.Error("failed to remove peer", slog.Any("err", err))
+		}
+	}
+
+	if sess.ClientProfileHandle != nil {
+		err := s.wgClient.Remove(sess.ClientProfileHandle)
+		if err != nil {
+			slog.Error("failed to remove profile", slog.Any("err", err))
+		}
+	}
+}
+
+func (s *Service) enqueueTeardown(task *teardownTask) {
+	// queued and retried teardowns are not delivered after shutdown, the hop closes the session on its TTL
+	select {
+	case <-s.shutdownCh:
+		slog.Warn("shutting down, hop is not informed", slog.String("session_id", task.sess.Id),
+			slog.String("host", task.host()), slog.String("reason", task.reason))
+		return
+	default:
+	}
+
+	select {
+	case s.teardownCh <- task:
+	default:
+		slog.Error("teardown queue is full, hop is not informed", slog.String("session_id", task.sess.Id),
+			slog.String("host", task.host()), slog.String("reason", task.reason))
+	}
+}
+
+func (task *teardownTask) host() string {
+	if task.notify {
+		return task.sess.CallbackURL
+	}
+	return task.sess.NextHops[0]
+}
+
+func (s *Service) teardownWorker() {
+	defer s.workers.Done()
+	for {
+		select {
+		case task := <-s.teardownCh:
+			s.deliverTeardown(task)
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *Service) deliverTeardown(task *teardownTask) {
+	task.attempt++
+	log := slog.With(slog.String("session_id", task.sess.Id), slog.String("host", task.host()),
+		slog.String("reason", task.reason), slog.Int("attempt", task.attempt))
+
+	ctx, cancel := context.WithTimeout(hoppolicy.WithClient(context.Background(), task.sess.Owner), 30*time.Second)
+	// shutdown doesn't wait for a slow hop
+	go func() {
+		select {
+		case <-s.shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var err error
+	if task.notify {
+		err = s.notifyPreviousHop(ctx, task.sess, task.reason)
+	} else if task.connect != nil {
+		err = s.disconnectTimedOutConnect(ctx, task)
+	} else {
+		err = s.disconnectNextHop(ctx, task.sess)
+	}
+	cancel()
+	if err == nil {
+		if task.notify {
+			log.Info("previous hop notified")
+		} else {
+			log.Info("next hop disconnected")
+		}
+		return
+	}
+
+	// the hop has answered, retry won't change the result
+	var apiError *ApiError
+	if errors.As(err, &apiError) && apiError.HttpCode < http.StatusInternalServerError {
+		log.Warn("hop rejected teardown", slog.Any("err", err))
+		return
+	}
+
+	if task.attempt >= s.cfg.Teardown.GetAttempts() {
+		log.Error("failed to deliver teardown, giving up", slog.Any("err", err))
+		return
+	}
+
+	delay := s.cfg.Teardown.GetRetryInterval() << (task.attempt - 1)
+	log.Warn("failed to deliver teardown, retry later", slog.Duration("delay", delay), slog.Any("err", err))
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			s.enqueueTeardown(task)
+		case <-s.shutdownCh:
+			log.Warn("shutting down, teardown is not retried")
+		}
+	}()
+}
+
+// disconnectTimedOutConnect disconnects the session which the next hop has created for the connect after this bridge
+// has given up on it. The next hop answers the replayed connect with the same session, or with a new one if the first
+// attempt has failed there, both are disconnected the same way.
+func (s *Service) disconnectTimedOutConnect(ctx context.Context, task *teardownTask) error {
+	if task.sess.Id == "" {
+		deadline, _ := ctx.Deadline()
+		response, err := s.connectNextHop(ctx, task.host(), task.connect, task.sess.NextHopCredentials, deadline,
+			false)
+		if err != nil {
+			return err
+		}
+		task.sess.Id = response.SessionID
+		task.sess.NextHopSessionToken = response.SessionToken
+		slog.Info("session of timed out connect found on next hop", slog.String("session_id", response.SessionID),
+			slog.String("host", task.host()))
+	}
+	return s.disconnectNextHop(ctx, task.sess)
+}
+
+// Shutdown disconnects all sessions if it is enabled in configuration. Otherwise, sessions are kept in storage to
+// be restored after restart. Background workers are stopped and the session store is closed, only the first call
+// has effect.
+func (s *Service) Shutdown(ctx context.Context) {
+	s.shutdownOnce.Do(func() {
+		s.shutdown(ctx)
+	})
+}
+
+func (s *Service) shutdown(ctx context.Context) {
+	// watchers are told to come back after restart, workers stop and pending teardowns are dropped
+	close(s.shutdownCh)
+	s.workers.Wait()
+
+	if s.cfg.Teardown.OnShutdown {
+		s.disconnectSessions(ctx)
+	}
+
+	// the store is closed after the last save, so sessions are restored as they were
+	err := s.Save()
+	if err != nil {
+		slog.Error("failed to save sessions", slog.Any("err", err))
+	}
+	err = s.store.Close()
+	if err != nil {
+		slog.Error("failed to close session store", slog.Any("err", err))
+	}
+}
+
+// disconnectSessions closes all sessions on shutdown and tells previous and next hops about it.
+func (s *Service) disconnectSessions(ctx context.Context) {
+	s.lock.Lock()
+	sessions := s.sessions
+	s.sessions = map[string]*Session{}
+	s.lock.Unlock()
+
+	slog.Info("disconnect sessions on shutdown", slog.Int("sessions", len(sessions)))
+
+	var wg sync.WaitGroup
+	for _, sess := range sessions {
+		s.releaseSession(sess)
+		s.markClosed(sess, SessionEventTerminated)
+
+		if sess.CallbackURL != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := s.notifyPreviousHop(hoppolicy.WithClient(ctx, sess.Owner), sess, SessionEventTerminated)
+				if err != nil {
+					slog.Error("failed to notify previous hop on shutdown", slog.String("session_id", sess.Id),
+						slog.String("host", sess.CallbackURL), slog.Any("err", err))
+				}
+			}()
+		}
+
+		if sess.IsExit() {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.disconnectNextHop(hoppolicy.WithClient(ctx, sess.Owner), sess)
+			if err != nil {
+				slog.Error("failed to disconnect next hop on shutdown", slog.String("session_id", sess.Id),
+					slog.String("host", sess.NextHops[0]), slog.Any("err", err))
+				return
+			}
+			slog.Info("next hop disconnected", slog.String("session_id", sess.Id),
+				slog.String("host", sess.NextHops[0]), slog.String("reason", "shutdown"))
+		}()
+	}
+	wg.Wait()
+}
+
+type AdminDisconnectResponse struct {
+	Result string `json:"result"`
+}
+
+func (s *Service) handleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	sessionId := r.PathValue("id")
+
+	s.lock.Lock()
+	sess, ok := s.sessions[sessionId]
+	if ok {
+		delete(s.sessions, sessionId)
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		ErrSessionNotFound.Handle(w)
+		return
+	}
+
+	s.closeSession(sess, SessionEventTerminated)
+	writeResponse(w, http.StatusOK, &AdminDisconnectResponse{Result: "OK"})
+}
@@ -0,0 +1,83 @@
+package apiserver
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestExpiredSessionTeardown(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	nextHop.failDisconnects = 1
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Teardown:       config.TeardownConfig{RetryInterval: 1},
+	}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	s.lock.Lock()
+	s.sessions["upstream-1"].ExpireTime = time.Now().Add(-time.Second)
+	s.lock.Unlock()
+
+	s.dropExpiredSessions()
+
+	s.lock.Lock()
+	require.Empty(t, s.sessions)
+	s.lock.Unlock()
+	require.Empty(t, wgServer.peers)
+	require.Empty(t, wgClient.profiles)
+
+	// the first attempt fails, disconnect is delivered on retry
+	require.Eventually(t, func() bool {
+		nextHop.lock.Lock()
+		defer nextHop.lock.Unlock()
+		return len(nextHop.disconnects) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, DisconnectRequest{SessionID: "upstream-1", SessionToken: "upstream-token"}, nextHop.disconnects[0])
+}
+
+func TestTeardownStopsOnShutdown(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	nextHop.failDisconnects = 1
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Teardown:       config.TeardownConfig{RetryInterval: 1},
+	}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	s.lock.Lock()
+	s.sessions["upstream-1"].ExpireTime = time.Now().Add(-time.Second)
+	s.lock.Unlock()
+	s.dropExpiredSessions()
+
+	// the first attempt fails and the retry is pending when the bridge shuts down
+	require.Eventually(t, func() bool {
+		nextHop.lock.Lock()
+		defer nextHop.lock.Unlock()
+		return nextHop.failDisconnects == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	s.Shutdown(context.Background())
+
+	time.Sleep(1500 * time.Millisecond)
+	nextHop.lock.Lock()
+	require.Empty(t, nextHop.disconnects)
+	nextHop.lock.Unlock()
+}
@@ -0,0 +1,80 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HopTrace describes how the error has passed one bridge of the chain. Entries are appended by every bridge on the
+// way back, so the first one is the deepest, index is position of the bridge in the chain starting with 0 for the
+// bridge the client has contacted.
+type HopTrace struct {
+	Index      int    `json:"index"`
+	ServerName string `json:"server_name,omitempty"`
+	// host of the next hop the bridge has sent the request to
+	NextHop    string `json:"next_hop,omitempty"`
+	Result     string `json:"result"`
+	HttpStatus int    `json:"http_status"`
+	// time in milliseconds the bridge has waited for the next hop
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// traceHop appends entry of this bridge to the hops trace of the error received from or caused by the next hop.
+func (s *Service) traceHop(apiError *ApiError, nextHopReq *http.Request, startTime time.Time) *ApiError {
+	apiError.Hops = append(apiError.Hops, HopTrace{
+		ServerName: s.cfg.ServerName,
+		NextHop:    nextHopReq.URL.Host,
+		Result:     apiError.Result,
+		HttpStatus: apiError.HttpCode,
+		LatencyMs:  time.Since(startTime).Milliseconds(),
+	})
+	for i := range apiError.Hops {
+		apiError.Hops[i].Index = len(apiError.Hops) - 1 - i
+	}
+	return apiError
+}
+
+// nextHopRequestError classifies failure to get response from the next hop.
+func nextHopRequestError(nextHopReq *http.Request, err error) *ApiError {
+	var dnsError *net.DNSError
+	var certificateError *tls.CertificateVerificationError
+	var recordHeaderError tls.RecordHeaderError
+	var alertError tls.AlertError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var netError net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netError) && netError.Timeout():
+		return errConnectTimeout(nextHopReq.URL.Host)
+	case errors.As(err, &dnsError):
+		return ErrNextHopDNS.WithError(err)
+	case errors.As(err, &certificateError) || errors.As(err, &recordHeaderError) || errors.As(err, &alertError) ||
+		errors.As(err, &unknownAuthorityError) || errors.As(err, &hostnameError):
+		return ErrNextHopTLS.WithError(err)
+	default:
+		return ErrNextHopUnavailable.WithError(err)
+	}
+}
+
+// decodeNextHopError reads error response of the next hop, the response which is not an api error is reported as
+// invalid.
+func decodeNextHopError(nextHopResp *http.Response) *ApiError {
+	var nextHopError ApiError
+	err := json.NewDecoder(nextHopResp.Body).Decode(&nextHopError)
+	if err != nil || nextHopError.Result == "" {
+		slog.Warn("failed to decode error from next hop", slog.String("host", nextHopResp.Request.URL.Host),
+			slog.String("status", nextHopResp.Status), slog.Any("err", err))
+		return ErrNextHopInvalidResponse.WithErrorMsg(fmt.Sprintf("Invalid error response from next hop: %s",
+			nextHopResp.Status))
+	}
+	nextHopError.HttpCode = nextHopResp.StatusCode
+	return &nextHopError
+}
@@ -0,0 +1,78 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pbridge/pkg/config"
+	"testing"
+)
+
+func TestHopTrace(t *testing.T) {
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer invalid.Close()
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+
+	second, err := New(config.APIConfig{ServerName: "second", SessionStorage: t.TempDir()}, newFakeWgServer(""),
+		newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, second)
+	secondServer := httptest.NewServer(second)
+	defer secondServer.Close()
+
+	first, err := New(config.APIConfig{ServerName: "first", SessionStorage: t.TempDir()}, newFakeWgServer(""),
+		newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, first)
+
+	connect := func(nextHops ...string) (int, *ApiError) {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		first.ServeHTTP(rec, jsonRequest(t, "/wireguard/connect", &ConnectRequest{
+			ClientPublicKey: key.PublicKey().String(),
+			NextHops:        nextHops,
+		}))
+
+		var response ApiError
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return rec.Code, &response
+	}
+	host := func(rawURL string) string {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		return u.Host
+	}
+
+	// every bridge appends its entry on the way back
+	code, response := connect(secondServer.URL, invalid.URL)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.Equal(t, "NEXT_HOP_INVALID_RESPONSE", response.Result)
+	require.Len(t, response.Hops, 2)
+	require.Equal(t, 1, response.Hops[0].Index)
+	require.Equal(t, "second", response.Hops[0].ServerName)
+	require.Equal(t, host(invalid.URL), response.Hops[0].NextHop)
+	require.Equal(t, http.StatusBadGateway, response.Hops[0].HttpStatus)
+	require.Equal(t, 0, response.Hops[1].Index)
+	require.Equal(t, "first", response.Hops[1].ServerName)
+	require.Equal(t, host(secondServer.URL), response.Hops[1].NextHop)
+	require.Equal(t, "NEXT_HOP_INVALID_RESPONSE", response.Hops[1].Result)
+
+	code, response = connect(untrusted.URL)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.Equal(t, "NEXT_HOP_TLS_ERROR", response.Result)
+	require.Len(t, response.Hops, 1)
+
+	req := httptest.NewRequest(http.MethodPost, "http://missing.example.com/wireguard/connect", nil)
+	dnsErr := &url.Error{Op: "Post", URL: req.URL.String(), Err: &net.OpError{Op: "dial",
+		Err: &net.DNSError{Err: "no such host", Name: "missing.example.com", IsNotFound: true}}}
+	require.Equal(t, "NEXT_HOP_DNS_ERROR", nextHopRequestError(req, dnsErr).Result)
+}
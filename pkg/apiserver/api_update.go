@@ -2,10 +2,12 @@ package apiserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"pbridge/pkg/hoppolicy"
 	"time"
 )
 
@@ -14,6 +16,8 @@ type UpdateRequest struct {
 	Password    string `json:"password"`
 	AccessToken string `json:"access_token"`
 	SessionID   string `json:"session_id"`
+	// session token issued by connect, replaces client credentials
+	SessionToken string `json:"session_token,omitempty"`
 }
 
 type UpdateResponse struct {
@@ -22,11 +26,6 @@ type UpdateResponse struct {
 }
 
 func (s *Service) handleUpdate(w http.ResponseWriter, r *http.Request) {
-	if err := s.authClient(r); err != nil {
-		writeError(w, err)
-		return
-	}
-
 	var request UpdateRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
@@ -40,13 +39,16 @@ func (s *Service) handleUpdate(w http.ResponseWriter, r *http.Request) {
 
 	slog.Info("update request", slog.String("session_id", request.SessionID))
 
-	s.lock.Lock()
-	sess, ok := s.sessions[request.SessionID]
-	s.lock.Unlock()
+	sess, err := s.authSession(r, request.SessionID, request.SessionToken, request.AccessToken)
+	if err != nil {
+		slog.Warn("session not authorized on update", slog.String("session_id", request.SessionID),
+			slog.Any("err", err))
+		writeError(w, err)
+		return
+	}
 
-	if !ok {
-		slog.Warn("session not found on update", slog.String("session_id", request.SessionID))
-		ErrSessionNotFound.Handle(w)
+	if sess.IsExit() {
+		s.handleExitUpdate(w, sess)
 		return
 	}
 
@@ -57,7 +59,16 @@ func (s *Service) handleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nextHopRequest := request
+	nextHopRequest := UpdateRequest{
+		SessionID:    sess.nextHopSessionId(),
+		SessionToken: sess.NextHopSessionToken,
+	}
+	if sess.NextHopSessionToken == "" {
+		credentials := sess.nextHopCredentials()
+		nextHopRequest.Username = credentials.Username
+		nextHopRequest.Password = credentials.Password
+		nextHopRequest.AccessToken = credentials.AccessToken
+	}
 	nextHopRequestBytes, err := json.Marshal(nextHopRequest)
 	if err != nil {
 		slog.Error("failed to marshal update request", slog.Any("err", err))
@@ -65,7 +76,8 @@ func (s *Service) handleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nextHopReq, err := http.NewRequest(http.MethodPost, nextHopUrl, bytes.NewReader(nextHopRequestBytes))
+	ctx := hoppolicy.WithClient(context.Background(), sess.Owner)
+	nextHopReq, err := http.NewRequestWithContext(ctx, http.MethodPost, nextHopUrl, bytes.NewReader(nextHopRequestBytes))
 	if err != nil {
 		slog.Error("failed to create update request", slog.Any("err", err))
 		ErrInternalServerError.WithError(err).Handle(w)
@@ -73,37 +85,42 @@ func (s *Service) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 	nextHopReq.Header.Set("Content-Type", "application/json")
 	nextHopReq.Header.Set("Accept", "application/json")
+	sess.NextHopCredentials.setBasicAuth(nextHopReq)
 	// Skip origin IP address forwarding
 	//nextHopReq.Header.Set("X-Forwarded-For", getNextHeader(r))
 
+	startTime := time.Now()
 	nextHopResp, err := s.c.Do(nextHopReq)
 	if err != nil {
-		ErrInternalServerError.WithError(err).Handle(w)
+		nextHopErr := s.traceHop(nextHopRequestError(nextHopReq, err), nextHopReq, startTime)
+		if len(sess.NextHopAlternatives) > 0 {
+			slog.Warn("next hop unavailable on update, fail over", slog.String("session_id", sess.Id),
+				slog.String("host", sess.NextHops[0]), slog.Any("err", err))
+			s.writeReestablishedUpdate(w, r, sess, ReestablishReasonNextHopUnavailable, nextHopErr)
+			return
+		}
+		slog.Warn("failed to send update request to next hop", slog.String("host", sess.NextHops[0]),
+			slog.Any("err", err))
+		nextHopErr.Handle(w)
 		return
 	}
 	defer nextHopResp.Body.Close()
 
 	if nextHopResp.StatusCode != http.StatusOK {
-		var nextHopError ApiError
-		err = json.NewDecoder(nextHopResp.Body).Decode(&nextHopError)
-		if err != nil {
-			slog.Error("failed to decode error from next hop update",
-				slog.String("host", sess.NextHops[0]),
-				slog.String("status", nextHopResp.Status),
-				slog.Any("err", err))
-			ErrInternalServerError.WithError(err).Handle(w)
-			return
-		}
-
+		nextHopError := decodeNextHopError(nextHopResp)
 		slog.Warn("error from next hop update",
 			slog.String("host", sess.NextHops[0]),
 			slog.String("result", nextHopError.Result),
 			slog.String("error_msg", nextHopError.ErrorMsg))
+		s.traceHop(nextHopError, nextHopReq, startTime)
 
-		nextHopError.HttpCode = nextHopResp.StatusCode
-		nextHopError.ErrorMsg = "Error from " + nextHopUrl + ": " + nextHopError.ErrorMsg
+		// next hop has lost the session, e.g. after restart
+		if nextHopError.Result == ErrSessionNotFound.Result && sess.NextHopRoute != nil {
+			s.writeReestablishedUpdate(w, r, sess, ReestablishReasonSessionLost, nextHopError)
+			return
+		}
 
-		writeResponse(w, nextHopResp.StatusCode, &nextHopError)
+		nextHopError.Handle(w)
 		return
 	}
 
@@ -113,7 +130,7 @@ func (s *Service) handleUpdate(w http.ResponseWriter, r *http.Request) {
 		slog.Error("failed to decode response from next hop update",
 			slog.String("host", sess.NextHops[0]),
 			slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
+		s.traceHop(ErrNextHopInvalidResponse.WithError(err), nextHopReq, startTime).Handle(w)
 		return
 	}
 
@@ -123,5 +140,23 @@ func (s *Service) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	sess.ExpireTime = currentTime.Add(time.Duration(nextHopResponse.TTL) * time.Second)
 	s.lock.Unlock()
 
+	s.signalSave(sess.Id)
+	s.publishTTL(sess, nextHopResponse.TTL)
+
 	writeResponse(w, http.StatusOK, &nextHopResponse)
 }
+
+// writeReestablishedUpdate reestablishes the session lost by the next hop and responds to update with TTL of the new
+// upstream session. If it fails, the original next hop error is returned.
+func (s *Service) writeReestablishedUpdate(w http.ResponseWriter, r *http.Request, sess *Session, reason string,
+	nextHopErr error) {
+	ttl, err := s.reestablishSession(r.Context(), sess, reason)
+	if err != nil {
+		slog.Error("failed to reestablish session", slog.String("session_id", sess.Id),
+			slog.String("host", sess.NextHops[0]), slog.Any("err", err))
+		writeError(w, nextHopErr)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &UpdateResponse{Result: "OK", TTL: ttl})
+}
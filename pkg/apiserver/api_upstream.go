@@ -0,0 +1,59 @@
+package apiserver
+
+import (
+	"context"
+	"log/slog"
+	"pbridge/pkg/wgclient"
+	"time"
+)
+
+// actions for sessions whose upstream has no recent handshake
+const (
+	StaleUpstreamNone        = "none"
+	StaleUpstreamReestablish = "reestablish"
+	StaleUpstreamTeardown    = "teardown"
+)
+
+// handleStaleUpstream is called by upstream monitor for client interfaces without recent handshake with the next hop.
+func (s *Service) handleStaleUpstream(handle *wgclient.ProfileHandle) {
+	action := s.cfg.GetOnStaleUpstream()
+
+	var sess *Session
+	s.lock.Lock()
+	for _, candidate := range s.sessions {
+		if candidate.ClientProfileHandle == handle && !candidate.reestablishing {
+			sess = candidate
+			break
+		}
+	}
+	// client has requested failover with next hop alternatives
+	if sess != nil && action == StaleUpstreamNone && len(sess.NextHopAlternatives) > 0 {
+		action = StaleUpstreamReestablish
+	}
+	if sess != nil && action == StaleUpstreamTeardown {
+		delete(s.sessions, sess.Id)
+	}
+	s.lock.Unlock()
+
+	if sess == nil {
+		return
+	}
+
+	switch action {
+	case StaleUpstreamTeardown:
+		slog.Warn("close session with stale upstream", slog.String("session_id", sess.Id),
+			slog.String("host", sess.NextHops[0]))
+		s.closeSession(sess, WatchReasonUpstreamFailure)
+	case StaleUpstreamReestablish:
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			_, err := s.reestablishSession(ctx, sess, ReestablishReasonHandshakeTimeout)
+			if err != nil {
+				slog.Error("failed to reestablish session", slog.String("session_id", sess.Id),
+					slog.String("host", sess.NextHops[0]), slog.Any("err", err))
+			}
+		}()
+	}
+}
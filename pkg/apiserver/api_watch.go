@@ -4,26 +4,82 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"pbridge/pkg/hoppolicy"
 	"time"
 )
 
+const (
+	// how long the exit holds watch request
+	watchTimeout = 20 * time.Second
+	// how long a bridge waits for the next hop, longer than watchTimeout to cover the chain latency
+	upstreamWatchTimeout = 25 * time.Second
+)
+
+// watch reasons in addition to session events
+const (
+	WatchReasonTimeout         = "timeout"
+	WatchReasonShutdown        = "shutdown"
+	WatchReasonUpstreamFailure = "upstream_failure"
+)
+
+// SessionEventDisconnected is reported to watchers when the session is disconnected by the client.
+const SessionEventDisconnected = "disconnected"
+
 type WatchRequest struct {
 	SessionID string `json:"session_id"`
+	// session token issued by connect
+	SessionToken string `json:"session_token,omitempty"`
 }
 
 type WatchResponse struct {
 	Result string `json:"result"`
+	// why the watch has returned, e.g. timeout or shutdown
+	Reason string `json:"reason,omitempty"`
+	// suggested delay in seconds before the next watch
+	RetryAfter int `json:"retry_after,omitempty"`
 }
 
-func (s *Service) handleWatch(w http.ResponseWriter, r *http.Request) {
-	if err := s.authClient(r); err != nil {
-		writeError(w, err)
+// watchResult is outcome of the watch request to the next hop.
+type watchResult struct {
+	statusCode int
+	response   *WatchResponse
+	apiError   *ApiError
+	err        error
+}
+
+// retryAfter suggests delay in seconds before the client watches, reconnects or retries again.
+func retryAfter(reason string) int {
+	switch reason {
+	case WatchReasonShutdown:
+		return 10
+	case WatchReasonUpstreamFailure:
+		return 5
+	case SessionEventQuotaExceeded:
+		return 60
+	case WatchReasonTimeout, SessionEventDisconnected:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// markClosed wakes up watchers of the session.
+func (s *Service) markClosed(sess *Session, event string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sess.done == nil || sess.closeEvent != "" {
 		return
 	}
+	sess.closeEvent = event
+	close(sess.done)
+}
 
+func (s *Service) handleWatch(w http.ResponseWriter, r *http.Request) {
 	var request WatchRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
@@ -34,73 +90,119 @@ func (s *Service) handleWatch(w http.ResponseWriter, r *http.Request) {
 
 	slog.Info("watch request", slog.String("session_id", request.SessionID))
 
+	sess, err := s.authSession(r, request.SessionID, request.SessionToken, "")
+	if err != nil {
+		slog.Warn("session not authorized on watch", slog.String("session_id", request.SessionID),
+			slog.Any("err", err))
+		writeError(w, err)
+		return
+	}
+
+	timeout := upstreamWatchTimeout
+	if sess.IsExit() {
+		timeout = watchTimeout
+	}
+	ctx, cancel := context.WithTimeout(hoppolicy.WithClient(r.Context(), sess.Owner), timeout)
+	defer cancel()
+
+	// exit has no next hop, only local events are watched
+	var upstreamCh chan *watchResult
+	if !sess.IsExit() {
+		upstreamCh = make(chan *watchResult, 1)
+		go func() {
+			upstreamCh <- s.watchNextHop(ctx, sess)
+		}()
+	}
+
 	s.lock.Lock()
-	sess, ok := s.sessions[request.SessionID]
+	done := sess.done
 	s.lock.Unlock()
 
-	if !ok {
-		slog.Warn("session not found on watch", slog.String("session_id", request.SessionID))
-		ErrSessionNotFound.Handle(w)
-		return
+	select {
+	case <-done:
+		s.lock.Lock()
+		event := sess.closeEvent
+		s.lock.Unlock()
+
+		slog.Info("watched session closed", slog.String("session_id", sess.Id), slog.String("event", event))
+		apiError := ErrSessionTerminated.WithErrorMsg("Session " + event)
+		apiError.Reason = event
+		apiError.RetryAfter = retryAfter(event)
+		apiError.Handle(w)
+	case <-s.shutdownCh:
+		writeResponse(w, http.StatusOK, &WatchResponse{Result: "OK", Reason: WatchReasonShutdown,
+			RetryAfter: retryAfter(WatchReasonShutdown)})
+	case result := <-upstreamCh:
+		s.writeWatchResult(w, sess, result)
+	case <-ctx.Done():
+		writeResponse(w, http.StatusOK, &WatchResponse{Result: "OK", Reason: WatchReasonTimeout})
 	}
+}
+
+func (s *Service) writeWatchResult(w http.ResponseWriter, sess *Session, result *watchResult) {
+	switch {
+	case result.err != nil:
+		if errors.Is(result.err, context.DeadlineExceeded) {
+			writeResponse(w, http.StatusOK, &WatchResponse{Result: "OK", Reason: WatchReasonTimeout})
+			return
+		}
 
+		slog.Warn("failed to watch next hop", slog.String("host", sess.NextHops[0]), slog.Any("err", result.err))
+		apiError := ErrNextHopUnavailable.WithError(result.err)
+		// request errors are already classified and traced
+		errors.As(result.err, &apiError)
+		apiError.Reason = WatchReasonUpstreamFailure
+		apiError.RetryAfter = retryAfter(WatchReasonUpstreamFailure)
+		apiError.Handle(w)
+	case result.apiError != nil:
+		writeResponse(w, result.statusCode, result.apiError)
+	default:
+		writeResponse(w, http.StatusOK, result.response)
+	}
+}
+
+// watchNextHop forwards watch request to the next hop.
+func (s *Service) watchNextHop(ctx context.Context, sess *Session) *watchResult {
 	nextHopUrl, err := url.JoinPath(sess.NextHops[0], "/wireguard/watch")
 	if err != nil {
-		slog.Error("failed to join next hop url", slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
+		return &watchResult{err: err}
 	}
 
-	nextHopRequest := request
+	nextHopRequest := WatchRequest{
+		SessionID:    sess.nextHopSessionId(),
+		SessionToken: sess.NextHopSessionToken,
+	}
 	nextHopRequestBytes, err := json.Marshal(nextHopRequest)
 	if err != nil {
-		slog.Error("failed to marshal watch request", slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
+		return &watchResult{err: err}
 	}
 
-	ctx := r.Context()
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
-	defer cancel()
-
 	nextHopReq, err := http.NewRequestWithContext(ctx, http.MethodPost, nextHopUrl, bytes.NewReader(nextHopRequestBytes))
 	if err != nil {
-		slog.Error("failed to create watch request", slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
+		return &watchResult{err: err}
 	}
 	nextHopReq.Header.Set("Content-Type", "application/json")
 	nextHopReq.Header.Set("Accept", "application/json")
+	sess.NextHopCredentials.setBasicAuth(nextHopReq)
 
+	startTime := time.Now()
 	nextHopResp, err := s.c.Do(nextHopReq)
 	if err != nil {
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &watchResult{err: err}
+		}
+		return &watchResult{err: s.traceHop(nextHopRequestError(nextHopReq, err), nextHopReq, startTime)}
 	}
 	defer nextHopResp.Body.Close()
 
 	if nextHopResp.StatusCode != http.StatusOK {
-		var nextHopError ApiError
-		err = json.NewDecoder(nextHopResp.Body).Decode(&nextHopError)
-		if err != nil {
-			slog.Error("failed to decode error from next hop watch",
-				slog.String("host", sess.NextHops[0]),
-				slog.String("status", nextHopResp.Status),
-				slog.Any("err", err))
-			ErrInternalServerError.WithError(err).Handle(w)
-			return
-		}
-
+		nextHopError := decodeNextHopError(nextHopResp)
 		slog.Warn("error from next hop watch",
 			slog.String("host", sess.NextHops[0]),
 			slog.String("result", nextHopError.Result),
 			slog.String("error_msg", nextHopError.ErrorMsg))
-
-		nextHopError.HttpCode = nextHopResp.StatusCode
-		nextHopError.ErrorMsg = "Error from " + nextHopUrl + ": " + nextHopError.ErrorMsg
-
-		writeResponse(w, nextHopResp.StatusCode, &nextHopError)
-		return
+		return &watchResult{statusCode: nextHopError.HttpCode,
+			apiError: s.traceHop(nextHopError, nextHopReq, startTime)}
 	}
 
 	var nextHopResponse WatchResponse
@@ -109,9 +211,9 @@ func (s *Service) handleWatch(w http.ResponseWriter, r *http.Request) {
 		slog.Error("failed to decode response from next hop watch",
 			slog.String("host", sess.NextHops[0]),
 			slog.Any("err", err))
-		ErrInternalServerError.WithError(err).Handle(w)
-		return
+		apiError := s.traceHop(ErrNextHopInvalidResponse.WithError(err), nextHopReq, startTime)
+		return &watchResult{statusCode: apiError.HttpCode, apiError: apiError}
 	}
 
-	writeResponse(w, http.StatusOK, &nextHopResponse)
+	return &watchResult{statusCode: http.StatusOK, response: &nextHopResponse}
 }
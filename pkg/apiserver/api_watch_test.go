@@ -0,0 +1,84 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"testing"
+	"time"
+)
+
+func watch(t *testing.T, s *Service, response *ConnectResponse) <-chan *httptest.ResponseRecorder {
+	ch := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, jsonRequest(t, "/wireguard/watch", &WatchRequest{
+			SessionID:    response.SessionID,
+			SessionToken: response.SessionToken,
+		}))
+		ch <- rec
+	}()
+	return ch
+}
+
+func waitWatch(t *testing.T, ch <-chan *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	select {
+	case rec := <-ch:
+		return rec
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch has not returned")
+		return nil
+	}
+}
+
+func TestWatchLocalEvents(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	s, err := New(config.APIConfig{SessionStorage: t.TempDir()}, newFakeWgServer(""), newFakeWgClient(""))
+	require.NoError(t, err)
+	stopService(t, s)
+
+	connect := func() *ConnectResponse {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var response ConnectResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return &response
+	}
+
+	// expiry
+	response := connect()
+	ch := watch(t, s, response)
+	time.Sleep(100 * time.Millisecond)
+
+	s.lock.Lock()
+	s.sessions[response.SessionID].ExpireTime = time.Now().Add(-time.Second)
+	s.lock.Unlock()
+	s.dropExpiredSessions()
+
+	rec := waitWatch(t, ch)
+	require.Equal(t, http.StatusGone, rec.Code)
+	var apiError ApiError
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&apiError))
+	require.Equal(t, "SESSION_TERMINATED", apiError.Result)
+	require.Equal(t, SessionEventExpired, apiError.Reason)
+
+	// planned shutdown, session is kept
+	response = connect()
+	ch = watch(t, s, response)
+	time.Sleep(100 * time.Millisecond)
+
+	s.Shutdown(context.Background())
+	// repeated shutdown is a no-op
+	s.Shutdown(context.Background())
+
+	rec = waitWatch(t, ch)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var watchResponse WatchResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&watchResponse))
+	require.Equal(t, WatchResponse{Result: "OK", Reason: WatchReasonShutdown, RetryAfter: 10}, watchResponse)
+}
@@ -4,10 +4,48 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"pbridge/pkg/wgclient"
+	"pbridge/pkg/wgserver"
+	"time"
 )
 
-func (s *Service) setupSession(session *Session) error {
-	var err error
+// WireguardServer manages peers of the downstream wireguard interface.
+type WireguardServer interface {
+	Add(profile *wgserver.ServerProfile) (*wgserver.ProfileHandle, error)
+	Remove(handle *wgserver.ProfileHandle) error
+	SetupForwarding(handle *wgserver.ProfileHandle, ip4, ip6 net.IP, link uint32) error
+	SetupExit(handle *wgserver.ProfileHandle) error
+	LastActivity(handle *wgserver.ProfileHandle) time.Time
+	AllocateInternalIPs() (net.IP, net.IP, error)
+	ReserveInternalIPs(ip4, ip6 net.IP)
+	ReleaseInternalIPs(ip4, ip6 net.IP)
+	GetPublicKey() string
+	GetListenPort() int
+	GetIPs() (net.IP, net.IP)
+	GetLink() uint32
+}
+
+// WireguardClient manages upstream wireguard interfaces.
+type WireguardClient interface {
+	Add(profile *wgclient.Profile) (*wgclient.ProfileHandle, error)
+	Remove(handle *wgclient.ProfileHandle) error
+	SetupForwarding(handle *wgclient.ProfileHandle, ip4, ip6 net.IP, link uint32) error
+	GetLink(handle *wgclient.ProfileHandle) uint32
+	SetStaleHandler(handler func(*wgclient.ProfileHandle))
+}
+
+// setupSession configures wireguard peers and forwarding of the session. On error everything set up so far is
+// removed and internal IPs of the session are returned to the pool.
+func (s *Service) setupSession(session *Session) (err error) {
+	defer func() {
+		if err != nil {
+			s.rollbackSession(session, err)
+		}
+	}()
+
+	if session.IsExit() {
+		return s.setupExitSession(session)
+	}
 
 	slog.Info("start wireguard connection to upstream", slog.String("username", session.Username))
 	session.ClientProfileHandle, err = s.wgClient.Add(session.ClientProfile)
@@ -18,56 +56,77 @@ func (s *Service) setupSession(session *Session) error {
 	slog.Info("start wireguard connection to downstream", slog.String("username", session.Username))
 	session.ServerProfileHandle, err = s.wgServer.Add(session.ServerProfile)
 	if err != nil {
-		if err := s.wgClient.Remove(session.ClientProfileHandle); err != nil {
-			slog.Error("failed to cleanup client profile",
-				slog.Any("originalErr", err), slog.Any("cleanupErr", err))
-		}
-
 		return fmt.Errorf("failed to add peer: %v", err)
 	}
 
 	slog.Info("setup server forwarding", slog.String("username", session.Username))
-	err = session.ServerProfileHandle.SetupForwarding(net.ParseIP(session.NextHopInternalIP4), net.ParseIP(session.NextHopInternalIP6), session.ClientProfileHandle.GetLink())
+	err = s.wgServer.SetupForwarding(session.ServerProfileHandle, net.ParseIP(session.NextHopInternalIP4),
+		net.ParseIP(session.NextHopInternalIP6), s.wgClient.GetLink(session.ClientProfileHandle))
 	if err != nil {
-		if err := s.wgClient.Remove(session.ClientProfileHandle); err != nil {
-			slog.Error("failed to cleanup client profile",
-				slog.Any("originalErr", err), slog.Any("cleanupErr", err))
-		}
-
-		if err := s.wgServer.Remove(session.ServerProfileHandle); err != nil {
-			slog.Error("failed to cleanup server profile",
-				slog.Any("originalErr", err), slog.Any("cleanupErr", err))
-		}
-
 		return fmt.Errorf("failed to setup server forwarding: %v", err)
 	}
 
 	slog.Info("setup client forwarding", slog.String("username", session.Username))
-	err = session.ClientProfileHandle.SetupForwarding(session.ServerProfileHandle.IP4, session.ServerProfileHandle.IP6, s.wgServer.GetLink())
+	err = s.wgClient.SetupForwarding(session.ClientProfileHandle, session.ServerProfileHandle.IP4,
+		session.ServerProfileHandle.IP6, s.wgServer.GetLink())
 	if err != nil {
+		return fmt.Errorf("failed to setup client forwarding: %v", err)
+	}
+
+	s.addSession(session)
+	return nil
+}
+
+func (s *Service) setupExitSession(session *Session) error {
+	var err error
+
+	slog.Info("start wireguard connection to downstream", slog.String("username", session.Username))
+	session.ServerProfileHandle, err = s.wgServer.Add(session.ServerProfile)
+	if err != nil {
+		return fmt.Errorf("failed to add peer: %v", err)
+	}
+
+	slog.Info("setup exit forwarding", slog.String("username", session.Username))
+	err = s.wgServer.SetupExit(session.ServerProfileHandle)
+	if err != nil {
+		return fmt.Errorf("failed to setup exit forwarding: %v", err)
+	}
+
+	s.addSession(session)
+	return nil
+}
+
+// rollbackSession removes wireguard profiles of partially set up session.
+func (s *Service) rollbackSession(session *Session, setupErr error) {
+	if session.ClientProfileHandle != nil {
 		if err := s.wgClient.Remove(session.ClientProfileHandle); err != nil {
 			slog.Error("failed to cleanup client profile",
-				slog.Any("originalErr", err), slog.Any("cleanupErr", err))
+				slog.Any("originalErr", setupErr), slog.Any("cleanupErr", err))
 		}
+		session.ClientProfileHandle = nil
+	}
 
+	if session.ServerProfileHandle != nil {
+		// internal IPs are released together with the peer
 		if err := s.wgServer.Remove(session.ServerProfileHandle); err != nil {
 			slog.Error("failed to cleanup server profile",
-				slog.Any("originalErr", err), slog.Any("cleanupErr", err))
+				slog.Any("originalErr", setupErr), slog.Any("cleanupErr", err))
 		}
-
-		return fmt.Errorf("failed to setup client forwarding: %v", err)
+		session.ServerProfileHandle = nil
+	} else {
+		s.wgServer.ReleaseInternalIPs(net.ParseIP(session.ServerProfile.InternalIP4),
+			net.ParseIP(session.ServerProfile.InternalIP6))
 	}
+}
 
+func (s *Service) addSession(session *Session) {
 	s.lock.Lock()
+	session.done = make(chan struct{})
+	session.setupTime = time.Now()
 	s.sessions[session.Id] = session
 	s.lock.Unlock()
 
 	slog.Info("session setup complete", slog.String("username", session.Username))
 
-	select {
-	case s.saveCh <- struct{}{}:
-	default:
-	}
-
-	return nil
+	s.signalSave(session.Id)
 }
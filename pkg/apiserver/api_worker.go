@@ -6,43 +6,125 @@ import (
 )
 
 func (s *Service) expireWorker() {
-	for range time.Tick(10 * time.Second) {
+	defer s.workers.Done()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.shutdownCh:
+			return
+		}
+
 		s.dropExpiredSessions()
+		if s.cfg.Idle.Enabled {
+			s.dropIdleSessions()
+		}
 	}
 }
 
 func (s *Service) saveWorker() {
+	defer s.workers.Done()
 	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
 	for {
+		// signalled saves write changed sessions only, periodic ones also catch changes which were not signalled
+		all := false
 		select {
 		case <-ticker.C:
+			all = true
 		case <-s.saveCh:
+		case <-s.shutdownCh:
+			return
 		}
 
-		err := s.Save()
+		err := s.save(all)
 		if err != nil {
 			slog.Error("failed to save session", slog.Any("err", err))
 		}
 	}
 }
 
+// signalSave triggers saving of sessions by save worker. Sessions with given ids are written, closed ones are
+// deleted.
+func (s *Service) signalSave(ids ...string) {
+	if len(ids) > 0 {
+		s.lock.Lock()
+		for _, id := range ids {
+			s.dirty[id] = struct{}{}
+		}
+		s.lock.Unlock()
+	}
+
+	select {
+	case s.saveCh <- struct{}{}:
+	default:
+	}
+}
+
 func (s *Service) dropExpiredSessions() {
+	var expired []*Session
 	s.lock.Lock()
-	for pubKey, sess := range s.sessions {
+	for id, sess := range s.sessions {
 		if time.Since(sess.ExpireTime) > 0 {
-			delete(s.sessions, pubKey)
+			delete(s.sessions, id)
+			expired = append(expired, sess)
+		}
+	}
+	s.lock.Unlock()
 
-			var err error
-			err = s.wgServer.Remove(sess.ServerProfileHandle)
-			if err != nil {
-				slog.Error("failed to remove peer", slog.Any("err", err))
-			}
+	for _, sess := range expired {
+		s.closeSession(sess, SessionEventExpired)
+	}
+
+	s.dropExpiredTombstones()
+	s.dropExpiredConnects()
+	s.dropExpiredEventsTickets()
+}
+
+// idleTimeout returns how long the session may stay without traffic from the client, zero if it is not limited.
+func (s *Service) idleTimeout(sess *Session) time.Duration {
+	timeout := sess.RXTimeout
+	if s.cfg.Idle.Timeout > 0 && (timeout == 0 || s.cfg.Idle.Timeout < timeout) {
+		timeout = s.cfg.Idle.Timeout
+	}
+	return time.Duration(timeout) * time.Second
+}
 
-			err = s.wgClient.Remove(sess.ClientProfileHandle)
-			if err != nil {
-				slog.Error("failed to remove profile", slog.Any("err", err))
-			}
+// dropIdleSessions closes sessions whose client hasn't sent traffic for longer than idle timeout.
+func (s *Service) dropIdleSessions() {
+	var candidates []*Session
+	setupTimes := map[*Session]time.Time{}
+	s.lock.Lock()
+	for _, sess := range s.sessions {
+		if sess.ServerProfileHandle != nil && s.idleTimeout(sess) > 0 {
+			candidates = append(candidates, sess)
+			setupTimes[sess] = sess.setupTime
 		}
 	}
 	s.lock.Unlock()
+
+	for _, sess := range candidates {
+		lastActivity := s.wgServer.LastActivity(sess.ServerProfileHandle)
+		if setupTimes[sess].After(lastActivity) {
+			lastActivity = setupTimes[sess]
+		}
+		idle := time.Since(lastActivity)
+		if idle < s.idleTimeout(sess) {
+			continue
+		}
+
+		// session could be removed concurrently
+		s.lock.Lock()
+		ok := s.sessions[sess.Id] == sess
+		if ok {
+			delete(s.sessions, sess.Id)
+		}
+		s.lock.Unlock()
+
+		if ok {
+			slog.Info("session is idle", slog.String("session_id", sess.Id), slog.Duration("idle", idle))
+			s.closeSession(sess, SessionEventIdle)
+		}
+	}
 }
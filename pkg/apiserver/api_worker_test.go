@@ -0,0 +1,96 @@
+package apiserver
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestDropIdleSessions(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Idle:           config.IdleConfig{Enabled: true, Timeout: 600},
+	}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	for range 3 {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	s.lock.Lock()
+	for _, sess := range s.sessions {
+		sess.setupTime = time.Now().Add(-time.Hour)
+	}
+	// active client
+	wgServer.lastActivity["10.1.0.2"] = time.Now()
+	// rx_timeout of the exit is shorter than the local timeout
+	wgServer.lastActivity["10.1.0.3"] = time.Now().Add(-2 * time.Minute)
+	s.sessions["upstream-2"].RXTimeout = 60
+	// local timeout applies without rx_timeout
+	wgServer.lastActivity["10.1.0.4"] = time.Now().Add(-5 * time.Minute)
+	s.lock.Unlock()
+
+	s.dropIdleSessions()
+
+	require.Len(t, s.sessions, 2)
+	require.Contains(t, s.sessions, "upstream-1")
+	require.Contains(t, s.sessions, "upstream-3")
+	require.Equal(t, SessionEventIdle, s.tombstones["upstream-2"].event)
+	require.NotContains(t, wgServer.acquired, "10.1.0.3")
+	require.Len(t, wgClient.profiles, 2)
+
+	require.Eventually(t, func() bool {
+		nextHop.lock.Lock()
+		defer nextHop.lock.Unlock()
+		return len(nextHop.disconnects) == 1 && nextHop.disconnects[0].SessionID == "upstream-2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDropIdleSessionsReestablished(t *testing.T) {
+	nextHop := newFakeNextHop(t)
+	wgServer := newFakeWgServer("")
+	wgClient := newFakeWgClient("")
+
+	s, err := New(config.APIConfig{
+		SessionStorage: t.TempDir(),
+		Idle:           config.IdleConfig{Enabled: true, Timeout: 600},
+		Reestablish:    config.ReestablishConfig{Enabled: true},
+	}, wgServer, wgClient)
+	require.NoError(t, err)
+	stopService(t, s)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, connectRequest(t, nextHop.URL))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	s.lock.Lock()
+	sess := s.sessions["upstream-1"]
+	sess.setupTime = time.Now().Add(-time.Hour)
+	s.lock.Unlock()
+
+	// activity of the client is forgotten with forwarding rules of the previous upstream
+	_, err = s.reestablishSession(context.Background(), sess, ReestablishReasonSessionLost)
+	require.NoError(t, err)
+
+	s.dropIdleSessions()
+	require.Contains(t, s.sessions, "upstream-1")
+
+	s.lock.Lock()
+	sess.setupTime = time.Now().Add(-time.Hour)
+	s.lock.Unlock()
+
+	s.dropIdleSessions()
+	require.NotContains(t, s.sessions, "upstream-1")
+	require.Equal(t, SessionEventIdle, s.tombstones["upstream-1"].event)
+}
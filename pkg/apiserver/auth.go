@@ -0,0 +1,153 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"pbridge/pkg/config"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// Identity is an authenticated client.
+type Identity struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+	Limits   Limits   `json:"limits"`
+	// next hop URL patterns allowed by access token, any next hop is allowed if empty
+	AllowedHops []string `json:"allowed_hops,omitempty"`
+}
+
+// Limits restrict client usage, zero value means no limit.
+type Limits struct {
+	MaxSessions int `json:"max_sessions,omitempty"`
+	MaxHops     int `json:"max_hops,omitempty"`
+}
+
+// Authenticator resolves client credentials to identity. It returns errInvalidCredentials if credentials are
+// not accepted.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// newAuthenticator returns nil if client authentication is not configured.
+func newAuthenticator(cfg config.APIConfig) (Authenticator, error) {
+	switch cfg.ClientAuth.Type {
+	case "", "static":
+		if len(cfg.Clients) == 0 {
+			return nil, nil
+		}
+		return newStaticAuthenticator(cfg.Clients), nil
+	case "htpasswd":
+		return newHtpasswdAuthenticator(cfg.ClientAuth.HtpasswdFile)
+	case "http":
+		return newHTTPAuthenticator(cfg.ClientAuth)
+	default:
+		return nil, fmt.Errorf("unknown client auth type: %s", cfg.ClientAuth.Type)
+	}
+}
+
+// authAccessToken verifies client access token and merges its claims into identity.
+func (s *Service) authAccessToken(ctx context.Context, identity *Identity, accessToken string) error {
+	if s.tokenVerifier == nil {
+		return nil
+	}
+
+	if accessToken == "" {
+		if s.cfg.AccessToken.Required {
+			return ErrUnauthorized.WithErrorMsg("Access token required")
+		}
+		return nil
+	}
+
+	claims, err := s.tokenVerifier.Verify(ctx, accessToken)
+	if err != nil {
+		slog.Warn("invalid access token", slog.Any("err", err))
+		return ErrUnauthorized.WithErrorMsg("Invalid access token")
+	}
+
+	if identity.Username == "" {
+		identity.Username = claims.Subject
+	}
+	identity.Groups = append(identity.Groups, claims.Groups...)
+	identity.AllowedHops = claims.AllowedHops
+	if claims.MaxSessions > 0 && (identity.Limits.MaxSessions == 0 || claims.MaxSessions < identity.Limits.MaxSessions) {
+		identity.Limits.MaxSessions = claims.MaxSessions
+	}
+	return nil
+}
+
+// supportedPasswordHash reports whether verifyPasswordHash can check the hash.
+func supportedPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "$argon2")
+}
+
+// verifyPasswordHash checks password against bcrypt ($2a$, $2b$, $2y$) or argon2 ($argon2id$, $argon2i$) hash.
+func verifyPasswordHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	case strings.HasPrefix(hash, "$argon2"):
+		return verifyArgon2(hash, password)
+	default:
+		return false, fmt.Errorf("unsupported password hash format")
+	}
+}
+
+// verifyArgon2 checks PHC formatted hash: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func verifyArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("invalid argon2 hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("invalid argon2 version: %w", err)
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 key: %w", err)
+	}
+
+	var computed []byte
+	switch parts[1] {
+	case "argon2id":
+		computed = argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+	case "argon2i":
+		computed = argon2.Key([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant: %s", parts[1])
+	}
+
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
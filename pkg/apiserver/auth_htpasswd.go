@@ -0,0 +1,113 @@
+package apiserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// htpasswdAuthenticator authenticates clients from htpasswd file with bcrypt or argon2 hashes, files with other
+// hashes are rejected. The file is reloaded when its modification time or size changes.
+type htpasswdAuthenticator struct {
+	path string
+
+	lock      sync.Mutex
+	checkTime time.Time
+	modTime   time.Time
+	size      int64
+	hashes    map[string]string
+}
+
+// htpasswdCheckInterval limits how often htpasswd file is checked for changes.
+const htpasswdCheckInterval = time.Second
+
+func newHtpasswdAuthenticator(path string) (*htpasswdAuthenticator, error) {
+	if path == "" {
+		return nil, fmt.Errorf("htpasswd file is not configured")
+	}
+
+	a := &htpasswdAuthenticator{path: path}
+	if err := a.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *htpasswdAuthenticator) Authenticate(_ context.Context, username, password string) (*Identity, error) {
+	a.lock.Lock()
+	if time.Since(a.checkTime) > htpasswdCheckInterval {
+		if err := a.reloadLocked(); err != nil {
+			// keep serving previous version of the file
+			slog.Error("failed to reload htpasswd file", slog.String("path", a.path), slog.Any("err", err))
+		}
+	}
+	hash, ok := a.hashes[username]
+	a.lock.Unlock()
+
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+
+	ok, err := verifyPasswordHash(hash, password)
+	if err != nil {
+		slog.Error("failed to verify htpasswd hash", slog.String("username", username), slog.Any("err", err))
+		return nil, errInvalidCredentials
+	}
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+
+	return &Identity{Username: username}, nil
+}
+
+func (a *htpasswdAuthenticator) reloadLocked() error {
+	a.checkTime = time.Now()
+
+	stat, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("stat htpasswd file: %w", err)
+	}
+	if a.hashes != nil && stat.ModTime().Equal(a.modTime) && stat.Size() == a.size {
+		return nil
+	}
+
+	fd, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("open htpasswd file: %w", err)
+	}
+	defer fd.Close()
+
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(fd)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("htpasswd file line %d: missing password hash", lineNumber)
+		}
+		// users with e.g. apr1 or SHA hashes would never be able to log in
+		if !supportedPasswordHash(hash) {
+			return fmt.Errorf("htpasswd file line %d: unsupported password hash of %s, use bcrypt or argon2",
+				lineNumber, username)
+		}
+		hashes[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read htpasswd file: %w", err)
+	}
+
+	slog.Info("htpasswd file loaded", slog.String("path", a.path), slog.Int("users", len(hashes)))
+	a.hashes = hashes
+	a.modTime = stat.ModTime()
+	a.size = stat.Size()
+	return nil
+}
@@ -0,0 +1,78 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"pbridge/pkg/config"
+)
+
+// httpAuthenticator delegates authentication to a local auth service. The service receives
+// {"username": ..., "password": ...} and responds with identity JSON on success or 401/403 on invalid credentials.
+type httpAuthenticator struct {
+	url string
+	c   *http.Client
+}
+
+type httpAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func newHTTPAuthenticator(cfg config.ClientAuthConfig) (*httpAuthenticator, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("auth service URL is not configured")
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	return &httpAuthenticator{
+		url: cfg.URL,
+		c:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (a *httpAuthenticator) Authenticate(ctx context.Context, username, password string) (*Identity, error) {
+	requestBytes, err := json.Marshal(&httpAuthRequest{Username: username, Password: password})
+	if err != nil {
+		return nil, fmt.Errorf("marshal auth request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(requestBytes))
+	if err != nil {
+		return nil, fmt.Errorf("create auth request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth service request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errInvalidCredentials
+	default:
+		return nil, fmt.Errorf("auth service response: %s", resp.Status)
+	}
+
+	var identity Identity
+	err = json.NewDecoder(resp.Body).Decode(&identity)
+	if err != nil {
+		return nil, fmt.Errorf("decode auth service response: %w", err)
+	}
+	if identity.Username == "" {
+		identity.Username = username
+	}
+	return &identity, nil
+}
@@ -0,0 +1,53 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+
+	"pbridge/pkg/config"
+)
+
+// staticAuthenticator authenticates clients from configuration file.
+type staticAuthenticator struct {
+	clients map[string]config.ClientRecord
+}
+
+func newStaticAuthenticator(clients []config.ClientRecord) *staticAuthenticator {
+	a := &staticAuthenticator{
+		clients: make(map[string]config.ClientRecord, len(clients)),
+	}
+	for _, client := range clients {
+		a.clients[client.Username] = client
+	}
+	return a
+}
+
+func (a *staticAuthenticator) Authenticate(_ context.Context, username, password string) (*Identity, error) {
+	client, ok := a.clients[username]
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+
+	if client.PasswordHash != "" {
+		ok, err := verifyPasswordHash(client.PasswordHash, password)
+		if err != nil {
+			slog.Error("failed to verify client password hash", slog.String("username", username), slog.Any("err", err))
+			return nil, errInvalidCredentials
+		}
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+	} else if subtle.ConstantTimeCompare([]byte(client.Password), []byte(password)) != 1 {
+		return nil, errInvalidCredentials
+	}
+
+	return &Identity{
+		Username: client.Username,
+		Groups:   client.Groups,
+		Limits: Limits{
+			MaxSessions: client.MaxSessions,
+			MaxHops:     client.MaxHops,
+		},
+	}, nil
+}
@@ -0,0 +1,117 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"pbridge/pkg/config"
+	"testing"
+	"time"
+)
+
+func argon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64*1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, 64*1024, 1, 1,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func bcryptHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	a := newStaticAuthenticator([]config.ClientRecord{
+		{Username: "plain", Password: "secret1"},
+		{Username: "bcrypt", PasswordHash: bcryptHash(t, "secret2"), Groups: []string{"admins"}},
+		{Username: "argon2", PasswordHash: argon2Hash("secret3"), MaxSessions: 2, MaxHops: 3},
+	})
+	ctx := context.Background()
+
+	identity, err := a.Authenticate(ctx, "plain", "secret1")
+	require.NoError(t, err)
+	require.Equal(t, "plain", identity.Username)
+
+	identity, err = a.Authenticate(ctx, "bcrypt", "secret2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"admins"}, identity.Groups)
+
+	identity, err = a.Authenticate(ctx, "argon2", "secret3")
+	require.NoError(t, err)
+	require.Equal(t, Limits{MaxSessions: 2, MaxHops: 3}, identity.Limits)
+
+	for _, c := range [][2]string{{"plain", "wrong"}, {"bcrypt", "wrong"}, {"argon2", "wrong"}, {"unknown", "secret1"}} {
+		_, err = a.Authenticate(ctx, c[0], c[1])
+		require.ErrorIs(t, err, errInvalidCredentials, c[0])
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	htpasswdFile := path.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswdFile, []byte("# comment\nuser1:"+bcryptHash(t, "pwd1")+"\n"), 0o600))
+
+	a, err := newHtpasswdAuthenticator(htpasswdFile)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = a.Authenticate(ctx, "user1", "pwd1")
+	require.NoError(t, err)
+	_, err = a.Authenticate(ctx, "user2", "pwd2")
+	require.ErrorIs(t, err, errInvalidCredentials)
+
+	// file is reloaded on change
+	require.NoError(t, os.WriteFile(htpasswdFile, []byte("user2:"+argon2Hash("pwd2")+"\n"), 0o600))
+	require.NoError(t, os.Chtimes(htpasswdFile, time.Now(), time.Now().Add(time.Minute)))
+	a.checkTime = time.Time{}
+
+	_, err = a.Authenticate(ctx, "user1", "pwd1")
+	require.ErrorIs(t, err, errInvalidCredentials)
+	_, err = a.Authenticate(ctx, "user2", "pwd2")
+	require.NoError(t, err)
+
+	// unsupported hashes are rejected on load, the previous version of the file is kept
+	require.NoError(t, os.WriteFile(htpasswdFile, []byte("user2:"+argon2Hash("pwd2")+"\n"+
+		"user3:$apr1$salt$hash\n"), 0o600))
+	require.NoError(t, os.Chtimes(htpasswdFile, time.Now(), time.Now().Add(2*time.Minute)))
+	a.checkTime = time.Time{}
+	_, err = a.Authenticate(ctx, "user2", "pwd2")
+	require.NoError(t, err)
+
+	_, err = newHtpasswdAuthenticator(htpasswdFile)
+	require.ErrorContains(t, err, "line 2")
+}
+
+func TestHTTPAuthenticator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request httpAuthRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if request.Username != "user" || request.Password != "pwd" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&Identity{Groups: []string{"g1"}, Limits: Limits{MaxSessions: 1}})
+	}))
+	defer server.Close()
+
+	a, err := newHTTPAuthenticator(config.ClientAuthConfig{URL: server.URL})
+	require.NoError(t, err)
+
+	identity, err := a.Authenticate(context.Background(), "user", "pwd")
+	require.NoError(t, err)
+	require.Equal(t, "user", identity.Username)
+	require.Equal(t, []string{"g1"}, identity.Groups)
+	require.Equal(t, 1, identity.Limits.MaxSessions)
+
+	_, err = a.Authenticate(context.Background(), "user", "wrong")
+	require.ErrorIs(t, err, errInvalidCredentials)
+}
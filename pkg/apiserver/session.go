@@ -1,6 +1,11 @@
 package apiserver
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"pbridge/pkg/wgclient"
 	"pbridge/pkg/wgserver"
 	"time"
@@ -16,9 +21,31 @@ type Session struct {
 	Username    string `json:"username,omitempty"`
 	Password    string `json:"password,omitempty"`
 	AccessToken string `json:"access_token,omitempty"`
+	// hash of session token issued to the client
+	SessionTokenHash string `json:"session_token_hash,omitempty"`
+	// session token issued by the next hop
+	NextHopSessionToken string `json:"next_hop_session_token,omitempty"`
+
+	// previous hop endpoint and token to report session termination
+	CallbackURL   string `json:"callback_url,omitempty"`
+	CallbackToken string `json:"callback_token,omitempty"`
+	// hash of callback token issued to the next hop
+	CallbackTokenHash string `json:"callback_token_hash,omitempty"`
+
+	// name of the client which owns the session
+	Owner string `json:"owner,omitempty"`
+	// credentials for the next hop, only set when client used per-hop credentials
+	NextHopCredentials *HopCredentials `json:"next_hop_credentials,omitempty"`
 
 	ClientPublicKey string   `json:"client_public_key,omitempty"`
 	NextHops        []string `json:"next_hops,omitempty"`
+	// alternatives for NextHops[0] to fail over to
+	NextHopAlternatives []string `json:"next_hop_alternatives,omitempty"`
+	// route behind the next hop kept to reestablish the session, records of earlier versions which have stored
+	// the whole connect request lose its credentials on the next save
+	NextHopRoute *NextHopRoute `json:"next_hop_connect,omitempty"`
+	// id of the session on the next hop if it differs, i.e. after the session was reestablished
+	NextHopSessionID string `json:"next_hop_session_id,omitempty"`
 
 	NextHopServerPublicKey string `json:"next_hop_server_public_key,omitempty"`
 	NextHopConnectIP4      string `json:"next_hop_connect_ip4,omitempty"`
@@ -40,12 +67,92 @@ type Session struct {
 	// runtime handlers
 	ServerProfileHandle *wgserver.ProfileHandle `json:"-"`
 	ClientProfileHandle *wgclient.ProfileHandle `json:"-"`
+
+	// closed when the session is terminated, closeEvent tells why
+	done       chan struct{}
+	closeEvent string
+	// event streams of the session
+	subscribers    map[chan *SessionEvent]struct{}
+	reestablishing bool
+	// when the session was set up, restored or switched to another upstream, idle time is counted from it if the
+	// client has sent nothing since, forwarding rules and their activity are reset on the switch
+	setupTime time.Time
+	// idempotency key of connect which has created the session
+	idempotencyKey string
+}
+
+// NextHopRoute is the part of the next hop connect request which is kept to connect the session again. Credentials
+// of the next hop are kept in the session, credentials of the hops behind it are never stored.
+type NextHopRoute struct {
+	NextHops       []string `json:"next_hops,omitempty"`
+	Onion          string   `json:"onion,omitempty"`
+	ExitCandidates []string `json:"exit_candidates,omitempty"`
+}
+
+// newToken generates a secret bound to a single session, e.g. session token authorizing update, watch and
+// disconnect requests. Only its hash is stored.
+func newToken() (string, string, error) {
+	var tokenBytes [32]byte
+	_, err := rand.Read(tokenBytes[:])
+	if err != nil {
+		return "", "", err
+	}
+	sessionToken := base64.RawURLEncoding.EncodeToString(tokenBytes[:])
+	return sessionToken, hashToken(sessionToken), nil
+}
+
+func hashToken(sessionToken string) string {
+	hash := sha256.Sum256([]byte(sessionToken))
+	return hex.EncodeToString(hash[:])
+}
+
+func checkToken(token, tokenHash string) bool {
+	if token == "" || tokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(tokenHash)) == 1
+}
+
+func (s *Session) checkSessionToken(sessionToken string) bool {
+	return checkToken(sessionToken, s.SessionTokenHash)
+}
+
+// nextHopCredentials returns credentials which should be sent to the next hop.
+func (s *Session) nextHopCredentials() HopCredentials {
+	if s.NextHopCredentials != nil {
+		return *s.NextHopCredentials
+	}
+	// legacy mode, client credentials are shared by the whole chain
+	return HopCredentials{
+		Username:    s.Username,
+		Password:    s.Password,
+		AccessToken: s.AccessToken,
+	}
+}
+
+// nextHopSessionId returns id of the session on the next hop.
+func (s *Session) nextHopSessionId() string {
+	if s.NextHopSessionID != "" {
+		return s.NextHopSessionID
+	}
+	return s.Id
 }
 
-// CloneRepresentation returns a copy of the session with raw data removed.
+// IsExit reports whether the session is terminated on this bridge.
+func (s *Session) IsExit() bool {
+	return len(s.NextHops) == 0
+}
+
+// ToOutputSession returns a copy of the session with traffic stats. It holds secrets of the session, admin API
+// exposes it as AdminSession.
 func (s *Session) ToOutputSession() *SessionWithStats {
 	txPackets, txBytes := s.ServerProfileHandle.GetStats()
-	rxPackets, rxBytes := s.ClientProfileHandle.GetStats()
+	var rxPackets, rxBytes uint64
+	var upstream *wgclient.PeerState
+	if s.ClientProfileHandle != nil {
+		rxPackets, rxBytes = s.ClientProfileHandle.GetStats()
+		upstream = s.ClientProfileHandle.PeerState()
+	}
 
 	return &SessionWithStats{
 		Session:   *s,
@@ -53,5 +160,44 @@ func (s *Session) ToOutputSession() *SessionWithStats {
 		TxBytes:   txBytes,
 		RxPackets: rxPackets,
 		RxBytes:   rxBytes,
+		Upstream:  upstream,
 	}
 }
+
+func (s *Session) stats() *SessionStats {
+	output := s.ToOutputSession()
+	return &SessionStats{
+		TxPackets: output.TxPackets,
+		TxBytes:   output.TxBytes,
+		RxPackets: output.RxPackets,
+		RxBytes:   output.RxBytes,
+	}
+}
+
+// reserveSession takes a session slot of the owner for the connect in progress. The slot is counted together with
+// active sessions until the returned function is called once the connect is done, ok is false if the owner has no
+// free slots.
+func (s *Service) reserveSession(owner string, maxSessions int) (release func(), ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := s.pendingSessions[owner]
+	for _, sess := range s.sessions {
+		if sess.Owner == owner {
+			count++
+		}
+	}
+	if count >= maxSessions {
+		return nil, false
+	}
+
+	s.pendingSessions[owner]++
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.pendingSessions[owner]--
+		if s.pendingSessions[owner] == 0 {
+			delete(s.pendingSessions, owner)
+		}
+	}, true
+}
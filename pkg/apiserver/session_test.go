@@ -0,0 +1,39 @@
+package apiserver
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthSession(t *testing.T) {
+	sessionToken, sessionTokenHash, err := newToken()
+	require.NoError(t, err)
+
+	s := &Service{
+		auth: &staticAuthenticator{},
+		sessions: map[string]*Session{
+			"token":  {Id: "token", Owner: "alice", SessionTokenHash: sessionTokenHash},
+			"legacy": {Id: "legacy", Owner: "alice"},
+		},
+	}
+
+	r := httptest.NewRequest("POST", "/wireguard/update", nil)
+
+	sess, err := s.authSession(r, "token", sessionToken, "")
+	require.NoError(t, err)
+	require.Equal(t, "token", sess.Id)
+
+	_, err = s.authSession(r, "token", "", "")
+	require.Equal(t, ErrUnauthorized.HttpCode, err.(*ApiError).HttpCode)
+
+	_, err = s.authSession(r, "token", sessionToken+"x", "")
+	require.Equal(t, ErrUnauthorized.HttpCode, err.(*ApiError).HttpCode)
+
+	_, err = s.authSession(r, "missing", sessionToken, "")
+	require.Equal(t, ErrSessionNotFound, err)
+
+	// sessions without token still require client authentication
+	_, err = s.authSession(r, "legacy", "", "")
+	require.Equal(t, ErrUnauthorized.HttpCode, err.(*ApiError).HttpCode)
+}
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"time"
 
 	"github.com/ghodss/yaml"
 )
@@ -20,6 +21,15 @@ type Config struct {
 type WireguardConfig struct {
 	Server WireguardServerConfig `json:"server"`
 	Client WireguardClientConfig `json:"client"`
+	Adopt  AdoptConfig           `json:"adopt"`
+}
+
+// AdoptConfig configures restart without dropping traffic: ebpf programs and maps are pinned in bpffs and
+// wireguard interfaces left by the previous run are reused instead of being recreated.
+type AdoptConfig struct {
+	Enabled bool `json:"enabled"`
+	// directory in bpffs for pinned programs and maps, /sys/fs/bpf/pbridge by default
+	PinPath string `json:"pin_path"`
 }
 
 type WireguardServerConfig struct {
@@ -33,7 +43,16 @@ type WireguardServerConfig struct {
 
 type WireguardClientConfig struct {
 	// Use "wgc" prefix if empty or not specified
-	NicPrefix string `json:"nic_prefix"`
+	NicPrefix string              `json:"nic_prefix"`
+	Monitor   ClientMonitorConfig `json:"monitor"`
+}
+
+// ClientMonitorConfig configures periodic reads of upstream peer state from client interfaces.
+type ClientMonitorConfig struct {
+	// interval of peer state reads in seconds
+	Interval int `json:"interval"`
+	// seconds without handshake after which the upstream is considered stale
+	HandshakeTimeout int `json:"handshake_timeout"`
 }
 
 type LoggingConfig struct {
@@ -42,13 +61,161 @@ type LoggingConfig struct {
 }
 
 type APIConfig struct {
-	ServerName     string         `json:"server_name"`
-	Listen         []ListenConfig `json:"listen"`
-	MaxHops        int            `json:"max_hops,omitempty"`
-	Admins         []AdminRecord  `json:"admins"`
-	Clients        []ClientRecord `json:"clients"`
-	SessionStorage string         `json:"session_storage"`
-	TrustCAFile    string         `json:"trust_ca_file"`
+	ServerName     string            `json:"server_name"`
+	Listen         []ListenConfig    `json:"listen"`
+	MaxHops        int               `json:"max_hops,omitempty"`
+	Admins         []AdminRecord     `json:"admins"`
+	Clients        []ClientRecord    `json:"clients"`
+	ClientAuth     ClientAuthConfig  `json:"client_auth"`
+	AccessToken    AccessTokenConfig `json:"access_token"`
+	SessionStorage string            `json:"session_storage"`
+	TrustCAFile    string            `json:"trust_ca_file"`
+	// externally reachable base URL of this bridge, next hops report terminated sessions to it
+	PublicURL string `json:"public_url"`
+	// private key used to decrypt onion connect requests, new key will be generated and saved if file does not exist
+	OnionKeyFile string            `json:"onion_key_file"`
+	Exit         ExitConfig        `json:"exit"`
+	HopPolicy    HopPolicyConfig   `json:"hop_policy"`
+	Teardown     TeardownConfig    `json:"teardown"`
+	Reestablish  ReestablishConfig `json:"reestablish"`
+	Idle         IdleConfig        `json:"idle"`
+	Failover     FailoverConfig    `json:"failover"`
+	Probe        ProbeConfig       `json:"probe"`
+	Idempotency  IdempotencyConfig `json:"idempotency"`
+	Restore      RestoreConfig     `json:"restore"`
+	// action for sessions whose upstream has no recent handshake: none, reestablish or teardown,
+	// reestablish by default if it is enabled
+	OnStaleUpstream string `json:"on_stale_upstream"`
+	// max time in seconds for connect through the whole chain, shorter budget may be set by the previous hop
+	ConnectTimeout int `json:"connect_timeout"`
+	// seconds reserved for local setup after the next hop has responded to connect
+	ConnectSetupReserve int `json:"connect_setup_reserve"`
+	// backend of session storage, session_storage is its path
+	SessionStore SessionStoreConfig `json:"session_store"`
+}
+
+// HopPolicyConfig restricts next hops which bridge is allowed to contact. Rules for a client listed in Clients
+// replace the default rules.
+type HopPolicyConfig struct {
+	HopPolicyRules
+	Clients map[string]HopPolicyRules `json:"clients"`
+	// loopback and link-local addresses allowed for previous hop callbacks, e.g. for bridges on the same host
+	CallbackAllowCIDRs []string `json:"callback_allow_cidrs"`
+}
+
+type HopPolicyRules struct {
+	// allowed URL schemes, e.g. ["https"], any scheme is allowed if empty
+	Schemes []string `json:"schemes"`
+	// host patterns, e.g. "*.example.com", any host is allowed if allow lists are empty
+	AllowHosts []string `json:"allow_hosts"`
+	DenyHosts  []string `json:"deny_hosts"`
+	// URL patterns, e.g. "https://bridge.example.com/*"
+	AllowURLs []string `json:"allow_urls"`
+	DenyURLs  []string `json:"deny_urls"`
+	// rules for resolved next hop addresses
+	AllowCIDRs []string `json:"allow_cidrs"`
+	DenyCIDRs  []string `json:"deny_cidrs"`
+	// deny loopback, private, link-local and unspecified addresses
+	DenyPrivate bool `json:"deny_private"`
+}
+
+// ExitConfig configures exit-node mode: connect requests with empty next_hops are terminated on this bridge and
+// client traffic is masqueraded out of the external network interface.
+type ExitConfig struct {
+	Enabled                     bool   `json:"enabled"`
+	DNS4                        string `json:"dns4"`
+	DNS6                        string `json:"dns6"`
+	MTU                         int    `json:"mtu"`
+	PersistentKeepaliveInterval int    `json:"persistent_keepalive_interval"`
+	RXTimeout                   int    `json:"rx_timeout"`
+	// session TTL in seconds
+	TTL int `json:"ttl"`
+}
+
+// TeardownConfig configures disconnects sent to the next hop when session is closed by this bridge: on expiry, by
+// admin or on shutdown.
+type TeardownConfig struct {
+	// max number of pending disconnects, new ones are dropped when the queue is full
+	QueueSize int `json:"queue_size"`
+	// number of delivery attempts
+	Attempts int `json:"attempts"`
+	// delay before the first retry in seconds, doubled on every next retry
+	RetryInterval int `json:"retry_interval"`
+	// disconnect all sessions on shutdown, opt-in: by default sessions are kept to be restored after restart and
+	// the hops keep them too
+	OnShutdown bool `json:"on_shutdown"`
+}
+
+// ReestablishConfig configures recovery of sessions lost by the next hop, e.g. after its restart. The session is
+// connected again on the next hop while the downstream client keeps its peer, internal IP and session id.
+type ReestablishConfig struct {
+	Enabled bool `json:"enabled"`
+	// Deprecated: use wireguard.client.monitor.handshake_timeout
+	HandshakeTimeout int `json:"handshake_timeout"`
+	// Deprecated: use wireguard.client.monitor.interval
+	CheckInterval int `json:"check_interval"`
+}
+
+// IdleConfig configures reaping of sessions without traffic from the downstream client before their TTL expires.
+type IdleConfig struct {
+	Enabled bool `json:"enabled"`
+	// seconds without traffic, the shorter of it and rx_timeout set by the exit is used
+	Timeout int `json:"timeout"`
+}
+
+// FailoverConfig configures next hop alternatives requested by clients.
+type FailoverConfig struct {
+	// max number of next_hop_alternatives in connect request
+	MaxAlternatives int `json:"max_alternatives"`
+	// seconds to wait for a next hop before trying the next alternative
+	AttemptTimeout int `json:"attempt_timeout"`
+}
+
+// ProbeConfig configures latency measurements of next hops with ping probes answered by their XDP program.
+type ProbeConfig struct {
+	// wireguard port of next hops
+	Port int `json:"port"`
+	// seconds to wait for every pong
+	Timeout  int `json:"timeout"`
+	Attempts int `json:"attempts"`
+	// seconds to keep measured latency
+	CacheTTL int `json:"cache_ttl"`
+	// max number of exit_candidates in connect request
+	MaxCandidates int `json:"max_candidates"`
+}
+
+// SessionStoreConfig selects where sessions are kept to be restored after restart.
+type SessionStoreConfig struct {
+	// dir (default), bolt, journal or memory
+	Type       string                  `json:"type"`
+	Encryption SessionEncryptionConfig `json:"encryption"`
+	// kilobytes of journal after which it is compacted into snapshot, limits recovery time
+	CompactSize int `json:"compact_size"`
+}
+
+// SessionEncryptionConfig sets source of keys encrypting stored sessions, only one of them may be used. Keys are
+// base64 encoded 32 bytes, one per line, the first one encrypts and the others are accepted while sessions are
+// re-encrypted after rotation.
+type SessionEncryptionConfig struct {
+	KeyFile string `json:"key_file"`
+	// name of environment variable with keys
+	KeyEnv string `json:"key_env"`
+	// name of systemd credential, e.g. passed with LoadCredential=
+	KeyCredential string `json:"key_credential"`
+}
+
+// RestoreConfig configures restore of stored sessions on startup.
+type RestoreConfig struct {
+	// number of sessions set up in parallel
+	Concurrency int `json:"concurrency"`
+	// directory for sessions which have failed to restore, session_storage with .quarantine suffix by default
+	QuarantineDir string `json:"quarantine_dir"`
+}
+
+// IdempotencyConfig configures caching of connect responses for retries with the same idempotency_key.
+type IdempotencyConfig struct {
+	// seconds to keep connect response
+	TTL int `json:"ttl"`
 }
 
 type AdminRecord struct {
@@ -59,6 +226,48 @@ type AdminRecord struct {
 type ClientRecord struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// bcrypt or argon2 hash, used instead of plaintext password
+	PasswordHash string   `json:"password_hash"`
+	Groups       []string `json:"groups"`
+	MaxSessions  int      `json:"max_sessions"`
+	MaxHops      int      `json:"max_hops"`
+}
+
+// ClientAuthConfig selects how clients are authenticated.
+type ClientAuthConfig struct {
+	// static (default) uses clients list, htpasswd uses HtpasswdFile, http calls local auth service at URL
+	Type         string `json:"type"`
+	HtpasswdFile string `json:"htpasswd_file"`
+	URL          string `json:"url"`
+	// timeout of auth service request in seconds
+	Timeout int `json:"timeout"`
+}
+
+// AccessTokenConfig configures validation of client access tokens (JWT) issued by external identity providers.
+type AccessTokenConfig struct {
+	Issuers []TokenIssuerConfig `json:"issuers"`
+	// reject connect requests without access token
+	Required bool              `json:"required"`
+	Claims   TokenClaimsConfig `json:"claims"`
+}
+
+type TokenIssuerConfig struct {
+	Issuer    string   `json:"issuer"`
+	Audiences []string `json:"audiences"`
+	JWKSFile  string   `json:"jwks_file"`
+	JWKSURL   string   `json:"jwks_url"`
+	// JWKS refresh interval in seconds, 3600 if not specified
+	RefreshInterval int `json:"refresh_interval"`
+}
+
+// TokenClaimsConfig maps token claims to client policy.
+type TokenClaimsConfig struct {
+	// claim with list of allowed next hop URL patterns, "allowed_hops" if not specified
+	AllowedHops string `json:"allowed_hops"`
+	// claim with maximum number of sessions, "max_sessions" if not specified
+	MaxSessions string `json:"max_sessions"`
+	// claim with list of groups, "groups" if not specified
+	Groups string `json:"groups"`
 }
 
 type ListenConfig struct {
@@ -110,16 +319,252 @@ func Load(configPath string) (*Config, error) {
 			"password", pwd)
 	}
 
-	if len(cfg.API.Clients) == 0 {
+	if len(cfg.API.Clients) == 0 && (cfg.API.ClientAuth.Type == "" || cfg.API.ClientAuth.Type == "static") {
 		slog.Info("clients are not configured, server will be accessible without authentication")
 	}
 
+	cfg.applyDeprecated()
+
 	return &cfg, nil
 }
 
+// applyDeprecated moves settings of deprecated keys to their replacements unless those are set.
+func (s *Config) applyDeprecated() {
+	monitor := &s.Wireguard.Client.Monitor
+	if s.API.Reestablish.HandshakeTimeout != 0 {
+		slog.Warn("api.reestablish.handshake_timeout is deprecated, use wireguard.client.monitor.handshake_timeout")
+		if monitor.HandshakeTimeout == 0 {
+			monitor.HandshakeTimeout = s.API.Reestablish.HandshakeTimeout
+		}
+	}
+	if s.API.Reestablish.CheckInterval != 0 {
+		slog.Warn("api.reestablish.check_interval is deprecated, use wireguard.client.monitor.interval")
+		if monitor.Interval == 0 {
+			monitor.Interval = s.API.Reestablish.CheckInterval
+		}
+	}
+}
+
 func (s APIConfig) GetMaxHops() int {
 	if s.MaxHops == 0 {
 		return 32
 	}
 	return s.MaxHops
 }
+
+func (s ExitConfig) GetDNS4() string {
+	if s.DNS4 == "" {
+		return "1.1.1.1"
+	}
+	return s.DNS4
+}
+
+func (s ExitConfig) GetDNS6() string {
+	if s.DNS6 == "" {
+		return "2606:4700:4700::1111"
+	}
+	return s.DNS6
+}
+
+func (s ExitConfig) GetMTU() int {
+	if s.MTU == 0 {
+		return 1420
+	}
+	return s.MTU
+}
+
+func (s ExitConfig) GetPersistentKeepaliveInterval() int {
+	if s.PersistentKeepaliveInterval == 0 {
+		return 25
+	}
+	return s.PersistentKeepaliveInterval
+}
+
+func (s ExitConfig) GetTTL() int {
+	if s.TTL == 0 {
+		return 3600
+	}
+	return s.TTL
+}
+
+func (s TeardownConfig) GetQueueSize() int {
+	if s.QueueSize == 0 {
+		return 1024
+	}
+	return s.QueueSize
+}
+
+func (s TeardownConfig) GetAttempts() int {
+	if s.Attempts == 0 {
+		return 5
+	}
+	return s.Attempts
+}
+
+func (s TeardownConfig) GetRetryInterval() time.Duration {
+	if s.RetryInterval == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(s.RetryInterval) * time.Second
+}
+
+func (s APIConfig) GetConnectTimeout() time.Duration {
+	if s.ConnectTimeout == 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(s.ConnectTimeout) * time.Second
+}
+
+func (s APIConfig) GetConnectSetupReserve() time.Duration {
+	if s.ConnectSetupReserve == 0 {
+		return time.Second
+	}
+	return time.Duration(s.ConnectSetupReserve) * time.Second
+}
+
+func (s APIConfig) GetOnStaleUpstream() string {
+	if s.OnStaleUpstream == "" {
+		if s.Reestablish.Enabled {
+			return "reestablish"
+		}
+		return "none"
+	}
+	return s.OnStaleUpstream
+}
+
+func (s FailoverConfig) GetMaxAlternatives() int {
+	if s.MaxAlternatives == 0 {
+		return 3
+	}
+	return s.MaxAlternatives
+}
+
+func (s FailoverConfig) GetAttemptTimeout() time.Duration {
+	if s.AttemptTimeout == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(s.AttemptTimeout) * time.Second
+}
+
+func (s ProbeConfig) GetPort() int {
+	if s.Port == 0 {
+		return 51820
+	}
+	return s.Port
+}
+
+func (s ProbeConfig) GetTimeout() time.Duration {
+	if s.Timeout == 0 {
+		return time.Second
+	}
+	return time.Duration(s.Timeout) * time.Second
+}
+
+func (s ProbeConfig) GetAttempts() int {
+	if s.Attempts == 0 {
+		return 3
+	}
+	return s.Attempts
+}
+
+func (s ProbeConfig) GetCacheTTL() time.Duration {
+	if s.CacheTTL == 0 {
+		return time.Minute
+	}
+	return time.Duration(s.CacheTTL) * time.Second
+}
+
+func (s ProbeConfig) GetMaxCandidates() int {
+	if s.MaxCandidates == 0 {
+		return 8
+	}
+	return s.MaxCandidates
+}
+
+func (s SessionStoreConfig) GetType() string {
+	if s.Type == "" {
+		return "dir"
+	}
+	return s.Type
+}
+
+func (s SessionStoreConfig) GetCompactSize() int64 {
+	if s.CompactSize == 0 {
+		return 4096 * 1024
+	}
+	return int64(s.CompactSize) * 1024
+}
+
+func (s RestoreConfig) GetConcurrency() int {
+	if s.Concurrency == 0 {
+		return 8
+	}
+	return s.Concurrency
+}
+
+// GetQuarantineDir returns directory for sessions which have failed to restore, empty if there is no place for it.
+func (s APIConfig) GetQuarantineDir() string {
+	if s.Restore.QuarantineDir != "" {
+		return s.Restore.QuarantineDir
+	}
+	if s.SessionStorage == "" {
+		return ""
+	}
+	return s.SessionStorage + ".quarantine"
+}
+
+func (s IdempotencyConfig) GetTTL() time.Duration {
+	if s.TTL == 0 {
+		return 2 * time.Minute
+	}
+	return time.Duration(s.TTL) * time.Second
+}
+
+func (s AdoptConfig) GetPinPath() string {
+	if s.PinPath == "" {
+		return "/sys/fs/bpf/pbridge"
+	}
+	return s.PinPath
+}
+
+func (s ClientMonitorConfig) GetInterval() time.Duration {
+	if s.Interval == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(s.Interval) * time.Second
+}
+
+func (s ClientMonitorConfig) GetHandshakeTimeout() time.Duration {
+	if s.HandshakeTimeout == 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(s.HandshakeTimeout) * time.Second
+}
+
+func (s TokenIssuerConfig) GetRefreshInterval() time.Duration {
+	if s.RefreshInterval == 0 {
+		return time.Hour
+	}
+	return time.Duration(s.RefreshInterval) * time.Second
+}
+
+func (s TokenClaimsConfig) GetAllowedHops() string {
+	if s.AllowedHops == "" {
+		return "allowed_hops"
+	}
+	return s.AllowedHops
+}
+
+func (s TokenClaimsConfig) GetMaxSessions() string {
+	if s.MaxSessions == "" {
+		return "max_sessions"
+	}
+	return s.MaxSessions
+}
+
+func (s TokenClaimsConfig) GetGroups() string {
+	if s.Groups == "" {
+		return "groups"
+	}
+	return s.Groups
+}
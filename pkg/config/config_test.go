@@ -0,0 +1,40 @@
+package config
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadDeprecatedReestablish(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+api:
+  reestablish:
+    enabled: true
+    handshake_timeout: 120
+    check_interval: 20
+`), 0600))
+
+	cfg, err := Load(configPath)
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Minute, cfg.Wireguard.Client.Monitor.GetHandshakeTimeout())
+	require.Equal(t, 20*time.Second, cfg.Wireguard.Client.Monitor.GetInterval())
+
+	// new keys take precedence
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+api:
+  reestablish:
+    handshake_timeout: 120
+wireguard:
+  client:
+    monitor:
+      handshake_timeout: 60
+`), 0600))
+
+	cfg, err = Load(configPath)
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, cfg.Wireguard.Client.Monitor.GetHandshakeTimeout())
+}
@@ -5,8 +5,12 @@ import (
 	_ "embed"
 	"encoding"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
 
 	"github.com/cilium/ebpf"
 	"github.com/vishvananda/netlink"
@@ -36,7 +40,18 @@ const (
 	XDP_FLAGS_REPLACE           = 1 << 4
 )
 
-func InstallEbpf(linkName string) (*EbpfHandle, error) {
+// names of the programs and maps pinned in the pin path of an interface
+const (
+	pbridgeProgName = "xdp_pbridge_prog"
+	wgProgName      = "xdp_wg_prog"
+	srcRulesName    = "src_rules"
+	dstRulesName    = "dst_rules"
+)
+
+// InstallEbpf loads pbridge program and attaches it to the interface. With non-empty pinPath, rule maps pinned there
+// by the previous run are reused, so rules and counters survive restarts, and the program is pinned next to them.
+// The program attached to the interface is replaced without detaching, traffic is not interrupted.
+func InstallEbpf(linkName string, pinPath string) (*EbpfHandle, error) {
 	link, err := netlink.LinkByName(linkName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get link by name: %w", err)
@@ -56,8 +71,34 @@ func InstallEbpf(linkName string) (*EbpfHandle, error) {
 		return nil, fmt.Errorf("failed to load XDP spec: %w", err)
 	}
 
-	handle := &EbpfHandle{}
-	err = spec.LoadAndAssign(handle, nil)
+	opts := &ebpf.CollectionOptions{}
+	if pinPath != "" {
+		err = os.MkdirAll(pinPath, 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pin path: %w", err)
+		}
+		for _, name := range []string{srcRulesName, dstRulesName} {
+			if mapSpec, ok := spec.Maps[name]; ok {
+				mapSpec.Pinning = ebpf.PinByName
+			}
+		}
+		opts.Maps.PinPath = pinPath
+	}
+
+	handle := &EbpfHandle{pinPath: pinPath}
+	err = spec.LoadAndAssign(handle, opts)
+	if errors.Is(err, ebpf.ErrMapIncompatible) {
+		// maps of another program version, the rules are set again by restored sessions
+		slog.Warn("ebpf: pinned maps are incompatible, recreating", slog.String("pin_path", pinPath),
+			slog.Any("err", err))
+		for _, name := range []string{srcRulesName, dstRulesName} {
+			err = os.Remove(filepath.Join(pinPath, name))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to remove incompatible pinned map: %w", err)
+			}
+		}
+		err = spec.LoadAndAssign(handle, opts)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to assign XDP spec: %w", err)
 	}
@@ -67,6 +108,13 @@ func InstallEbpf(linkName string) (*EbpfHandle, error) {
 		return nil, fmt.Errorf("failed to attach XDP to interface %s: %w", link.Attrs().Name, err)
 	}
 
+	if pinPath != "" {
+		err = pinProgram(handle.PBridgeProg, filepath.Join(pinPath, pbridgeProgName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return handle, nil
 }
 
@@ -74,6 +122,8 @@ type EbpfHandle struct {
 	PBridgeProg *ebpf.Program `ebpf:"xdp_pbridge_prog"`
 	SrcRules    *ebpf.Map     `ebpf:"src_rules"`
 	DstRules    *ebpf.Map     `ebpf:"dst_rules"`
+
+	pinPath string
 }
 
 type EbpfWgHandle struct {
@@ -84,7 +134,9 @@ func (s *EbpfWgHandle) Close() {
 	s.WgProg.Close()
 }
 
-func InstallEbpfWg(link netlink.Link) (*EbpfWgHandle, error) {
+// InstallEbpfWg loads wireguard filter program and attaches it to the interface, the program is pinned in non-empty
+// pinPath.
+func InstallEbpfWg(link netlink.Link, pinPath string) (*EbpfWgHandle, error) {
 	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(WgProg))
 	if err != nil {
 		return nil, fmt.Errorf("wg: failed to load XDP spec: %w", err)
@@ -101,19 +153,70 @@ func InstallEbpfWg(link netlink.Link) (*EbpfWgHandle, error) {
 		return nil, fmt.Errorf("wg: failed to attach XDP to interface %s: %w", link.Attrs().Name, err)
 	}
 
+	if pinPath != "" {
+		err = os.MkdirAll(pinPath, 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("wg: failed to create pin path: %w", err)
+		}
+		err = pinProgram(handle.WgProg, filepath.Join(pinPath, wgProgName))
+		if err != nil {
+			return nil, fmt.Errorf("wg: %w", err)
+		}
+	}
+
 	return handle, nil
 }
 
+// pinProgram pins the program in place of the one pinned by the previous run.
+func pinProgram(prog *ebpf.Program, path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove pinned program: %w", err)
+	}
+	err = prog.Pin(path)
+	if err != nil {
+		return fmt.Errorf("failed to pin program: %w", err)
+	}
+	return nil
+}
+
+// RemovePinned removes programs and maps pinned in the pin path, e.g. left by removed interface.
+func RemovePinned(pinPath string) error {
+	if pinPath == "" {
+		return nil
+	}
+	return os.RemoveAll(pinPath)
+}
+
 func (s *EbpfHandle) SetSrcRule(ip net.IP, replace net.IP, ifindex uint32) error {
-	key := RuleKey{IP: ip}
-	value := RuleValue{Replace: replace, Ifindex: ifindex}
-	return s.SrcRules.Put(&key, &value)
+	return setRule(s.SrcRules, ip, replace, ifindex)
 }
 
 func (s *EbpfHandle) SetDstRule(ip net.IP, replace net.IP, ifindex uint32) error {
+	return setRule(s.DstRules, ip, replace, ifindex)
+}
+
+// setRule keeps counters of the rule which is set again with the same forwarding, e.g. by session restored over
+// pinned maps. Packets counted between lookup and put are lost.
+func setRule(rules *ebpf.Map, ip net.IP, replace net.IP, ifindex uint32) error {
 	key := RuleKey{IP: ip}
 	value := RuleValue{Replace: replace, Ifindex: ifindex}
-	return s.DstRules.Put(&key, &value)
+	var current RuleValue
+	if rules.Lookup(&key, &current) == nil {
+		value = mergeRule(&current, value)
+	}
+	return rules.Put(&key, &value)
+}
+
+// mergeRule returns value with counters and last seen time of the current rule if forwarding is the same, rules of
+// another forwarding start from zero.
+func mergeRule(current *RuleValue, value RuleValue) RuleValue {
+	if current.Replace.Equal(value.Replace) && current.Ifindex == value.Ifindex {
+		value.CounterPackets = current.CounterPackets
+		value.CounterBytes = current.CounterBytes
+		value.LastSeen = current.LastSeen
+	}
+	return value
 }
 
 func (s *EbpfHandle) DeleteSrcRule(ip net.IP) error {
@@ -132,6 +235,11 @@ func (s *EbpfHandle) Close() {
 	// s.AccessBlacklist.Close()
 }
 
+// Unpin removes pinned program and maps, they are freed once the interface is deleted.
+func (s *EbpfHandle) Unpin() error {
+	return RemovePinned(s.pinPath)
+}
+
 func marshalIP(ip net.IP, data []byte) {
 	ip4 := ip.To4()
 	if ip4 != nil {
@@ -182,25 +290,29 @@ type RuleValue struct {
 	Ifindex        uint32
 	CounterPackets uint64
 	CounterBytes   uint64
+	// monotonic time of the last packet in ns, see KtimeToTime
+	LastSeen uint64
 }
 
 func (s *RuleValue) MarshalBinary() ([]byte, error) {
-	data := make([]byte, 40)
+	data := make([]byte, 48)
 	marshalIP(s.Replace, data)
 	binary.LittleEndian.PutUint32(data[20:], s.Ifindex)
 	binary.LittleEndian.PutUint64(data[24:], s.CounterPackets)
 	binary.LittleEndian.PutUint64(data[32:], s.CounterBytes)
+	binary.LittleEndian.PutUint64(data[40:], s.LastSeen)
 	return data, nil
 }
 
 func (s *RuleValue) UnmarshalBinary(data []byte) error {
-	if len(data) != 40 {
-		return fmt.Errorf("wrong session value length: expected %d, got %d", 24, len(data))
+	if len(data) != 48 {
+		return fmt.Errorf("wrong session value length: expected %d, got %d", 48, len(data))
 	}
 
 	s.Replace = unmarshalIP(data)
 	s.Ifindex = binary.LittleEndian.Uint32(data[20:])
 	s.CounterPackets = binary.LittleEndian.Uint64(data[24:])
 	s.CounterBytes = binary.LittleEndian.Uint64(data[32:])
+	s.LastSeen = binary.LittleEndian.Uint64(data[40:])
 	return nil
 }
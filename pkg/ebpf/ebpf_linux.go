@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/features"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
 )
 
 func CheckEbpfFeatures() error {
@@ -29,3 +32,39 @@ func CheckEbpfFeatures() error {
 
 	return nil
 }
+
+// KtimeToTime converts time returned by bpf_ktime_get_ns to wall clock time, zero ktime is converted to zero time.
+func KtimeToTime(ktime uint64) time.Time {
+	if ktime == 0 {
+		return time.Time{}
+	}
+
+	var ts unix.Timespec
+	err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	if err != nil {
+		return time.Time{}
+	}
+	now := uint64(ts.Nano())
+	if ktime > now {
+		return time.Now()
+	}
+	return time.Now().Add(-time.Duration(now - ktime))
+}
+
+// PreparePinPath creates directory for pinned programs and maps, it must be on bpffs.
+func PreparePinPath(pinPath string) error {
+	err := os.MkdirAll(pinPath, 0o700)
+	if err != nil {
+		return fmt.Errorf("create pin path: %w", err)
+	}
+
+	var stat unix.Statfs_t
+	err = unix.Statfs(pinPath, &stat)
+	if err != nil {
+		return fmt.Errorf("stat pin path: %w", err)
+	}
+	if stat.Type != unix.BPF_FS_MAGIC {
+		return fmt.Errorf("pin path %s is not on bpffs, mount it with: mount -t bpf bpf /sys/fs/bpf", pinPath)
+	}
+	return nil
+}
@@ -3,8 +3,19 @@
 
 package ebpf
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 func CheckEbpfFeatures() error {
 	return fmt.Errorf("ebpf is not supported on this platform")
 }
+
+func KtimeToTime(ktime uint64) time.Time {
+	return time.Time{}
+}
+
+func PreparePinPath(pinPath string) error {
+	return fmt.Errorf("ebpf is not supported on this platform")
+}
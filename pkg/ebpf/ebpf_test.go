@@ -0,0 +1,27 @@
+package ebpf
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestMergeRule(t *testing.T) {
+	current := &RuleValue{
+		Replace:        net.ParseIP("10.2.0.2"),
+		Ifindex:        5,
+		CounterPackets: 10,
+		CounterBytes:   1000,
+		LastSeen:       42,
+	}
+
+	// rule set again by restored session keeps its counters
+	value := mergeRule(current, RuleValue{Replace: net.ParseIP("10.2.0.2"), Ifindex: 5})
+	require.Equal(t, *current, value)
+
+	// forwarding to another upstream starts from zero
+	value = mergeRule(current, RuleValue{Replace: net.ParseIP("10.2.0.2"), Ifindex: 6})
+	require.Equal(t, RuleValue{Replace: net.ParseIP("10.2.0.2"), Ifindex: 6}, value)
+	value = mergeRule(current, RuleValue{Replace: net.ParseIP("10.2.0.3"), Ifindex: 5})
+	require.Equal(t, RuleValue{Replace: net.ParseIP("10.2.0.3"), Ifindex: 5}, value)
+}
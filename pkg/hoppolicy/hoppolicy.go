@@ -0,0 +1,363 @@
+package hoppolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"pbridge/pkg/config"
+)
+
+var ErrNotAllowed = errors.New("next hop is not allowed")
+
+type Policy struct {
+	defaultRules *rules
+	clients      map[string]*rules
+	resolver     *net.Resolver
+	// addresses allowed for callbacks in spite of callback rules
+	callbackCIDRs []*net.IPNet
+}
+
+type rules struct {
+	schemes     map[string]struct{}
+	allowHosts  []*regexp.Regexp
+	denyHosts   []*regexp.Regexp
+	allowURLs   []*regexp.Regexp
+	denyURLs    []*regexp.Regexp
+	allowCIDRs  []*net.IPNet
+	denyCIDRs   []*net.IPNet
+	denyPrivate bool
+}
+
+func New(cfg config.HopPolicyConfig) (*Policy, error) {
+	defaultRules, err := compileRules(cfg.HopPolicyRules)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{
+		defaultRules: defaultRules,
+		clients:      map[string]*rules{},
+		resolver:     net.DefaultResolver,
+	}
+
+	for username, clientCfg := range cfg.Clients {
+		clientRules, err := compileRules(clientCfg)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %w", username, err)
+		}
+		p.clients[username] = clientRules
+	}
+
+	p.callbackCIDRs, err = parseCIDRs(cfg.CallbackAllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("callback_allow_cidrs: %w", err)
+	}
+
+	return p, nil
+}
+
+// Check validates next hop URL and all its resolved addresses against rules of the client.
+func (p *Policy) Check(ctx context.Context, username, rawUrl string) error {
+	r := p.rulesFor(username)
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("%w: invalid URL: %v", ErrNotAllowed, err)
+	}
+
+	if err := r.checkURL(u); err != nil {
+		return err
+	}
+
+	if !r.hasIPRules() {
+		return nil
+	}
+
+	ips, err := p.resolve(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAllowed, err)
+	}
+
+	for _, ip := range ips {
+		if err := r.checkIP(ip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckCallback validates callback URL of the previous hop. Besides rules of the client it must be http(s) URL
+// without credentials which doesn't resolve to loopback, link-local or unspecified address, so clients can't make
+// the bridge send requests to its own or metadata services.
+func (p *Policy) CheckCallback(ctx context.Context, username, rawUrl string) error {
+	err := p.Check(ctx, username, rawUrl)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("%w: invalid URL: %v", ErrNotAllowed, err)
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return fmt.Errorf("%w: callback scheme %q", ErrNotAllowed, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in callback URL", ErrNotAllowed)
+	}
+
+	ips, err := p.resolve(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAllowed, err)
+	}
+	for _, ip := range ips {
+		if err := p.checkCallbackIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Policy) checkCallbackIP(ip net.IP) error {
+	for _, cidr := range p.callbackCIDRs {
+		if cidr.Contains(ip) {
+			return nil
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w: address %s is not allowed for callback", ErrNotAllowed, ip)
+	}
+	return nil
+}
+
+// DialContext wraps dialer to validate addresses at connection time, so a host can't be resolved to a denied
+// address after Check (DNS rebinding). Client rules are taken from the context, see WithClient.
+func (p *Policy) DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		username, _ := ctx.Value(clientKey{}).(string)
+		callback, _ := ctx.Value(callbackKey{}).(bool)
+		r := p.rulesFor(username)
+		if !r.hasIPRules() && !callback {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := p.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			if err := r.checkIP(ip); err != nil {
+				lastErr = err
+				continue
+			}
+			if callback {
+				if err := p.checkCallbackIP(ip); err != nil {
+					lastErr = err
+					continue
+				}
+			}
+
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return conn, nil
+		}
+
+		return nil, lastErr
+	}
+}
+
+type clientKey struct{}
+
+// WithClient attaches client username to the context of a next hop request.
+func WithClient(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, clientKey{}, username)
+}
+
+type callbackKey struct{}
+
+// WithCallback marks the context of a callback request to the previous hop, its addresses are checked as in
+// CheckCallback at connection time.
+func WithCallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, callbackKey{}, true)
+}
+
+func (p *Policy) rulesFor(username string) *rules {
+	if r, ok := p.clients[username]; ok {
+		return r
+	}
+	return p.defaultRules
+}
+
+func (p *Policy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func (r *rules) hasIPRules() bool {
+	return r.denyPrivate || len(r.allowCIDRs) > 0 || len(r.denyCIDRs) > 0
+}
+
+func (r *rules) checkURL(u *url.URL) error {
+	if len(r.schemes) > 0 {
+		if _, ok := r.schemes[strings.ToLower(u.Scheme)]; !ok {
+			return fmt.Errorf("%w: scheme %q", ErrNotAllowed, u.Scheme)
+		}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: empty host", ErrNotAllowed)
+	}
+
+	if matchAny(r.denyHosts, host) {
+		return fmt.Errorf("%w: host %s is denied", ErrNotAllowed, host)
+	}
+	if matchAny(r.denyURLs, u.String()) {
+		return fmt.Errorf("%w: URL %s is denied", ErrNotAllowed, u.String())
+	}
+
+	if len(r.allowHosts) == 0 && len(r.allowURLs) == 0 {
+		return nil
+	}
+	if matchAny(r.allowHosts, host) || matchAny(r.allowURLs, u.String()) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not in allow list", ErrNotAllowed, u.String())
+}
+
+func (r *rules) checkIP(ip net.IP) error {
+	if r.denyPrivate && !isPublic(ip) {
+		return fmt.Errorf("%w: address %s is not public", ErrNotAllowed, ip)
+	}
+
+	for _, cidr := range r.denyCIDRs {
+		if cidr.Contains(ip) {
+			return fmt.Errorf("%w: address %s is denied by %s", ErrNotAllowed, ip, cidr)
+		}
+	}
+
+	if len(r.allowCIDRs) == 0 {
+		return nil
+	}
+	for _, cidr := range r.allowCIDRs {
+		if cidr.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: address %s is not in allow list", ErrNotAllowed, ip)
+}
+
+func isPublic(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+func compileRules(cfg config.HopPolicyRules) (*rules, error) {
+	r := &rules{
+		schemes:     map[string]struct{}{},
+		denyPrivate: cfg.DenyPrivate,
+	}
+
+	for _, scheme := range cfg.Schemes {
+		r.schemes[strings.ToLower(scheme)] = struct{}{}
+	}
+
+	var err error
+	if r.allowHosts, err = compilePatterns(cfg.AllowHosts, true); err != nil {
+		return nil, err
+	}
+	if r.denyHosts, err = compilePatterns(cfg.DenyHosts, true); err != nil {
+		return nil, err
+	}
+	if r.allowURLs, err = compilePatterns(cfg.AllowURLs, false); err != nil {
+		return nil, err
+	}
+	if r.denyURLs, err = compilePatterns(cfg.DenyURLs, false); err != nil {
+		return nil, err
+	}
+	if r.allowCIDRs, err = parseCIDRs(cfg.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if r.denyCIDRs, err = parseCIDRs(cfg.DenyCIDRs); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// compilePatterns converts glob patterns to regular expressions, "*" matches any sequence of characters.
+func compilePatterns(patterns []string, ignoreCase bool) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if ignoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
+// MatchPatterns reports whether s matches any of glob patterns.
+func MatchPatterns(patterns []string, s string) bool {
+	compiled, err := compilePatterns(patterns, false)
+	if err != nil {
+		return false
+	}
+	return matchAny(compiled, s)
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
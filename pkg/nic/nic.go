@@ -53,3 +53,15 @@ func (s *NICPool) FreeNIC(nicId uint32) {
 	delete(s.nicUsed, nicId)
 	s.nicFree[nicId] = true
 }
+
+// Reserve marks the NIC as used, e.g. for interface adopted from the previous run.
+func (s *NICPool) Reserve(nicId uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for ; s.nicCounter <= nicId; s.nicCounter++ {
+		s.nicFree[s.nicCounter] = true
+	}
+	delete(s.nicFree, nicId)
+	s.nicUsed[nicId] = true
+}
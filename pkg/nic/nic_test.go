@@ -26,3 +26,22 @@ func TestNICPool(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, uint32(2), nic4)
 }
+
+func TestNICPoolReserve(t *testing.T) {
+	nicPool := NewNICPool()
+	nicPool.Reserve(2)
+	nicPool.Reserve(0)
+
+	nic1, err := nicPool.GetNIC()
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), nic1)
+
+	nic2, err := nicPool.GetNIC()
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), nic2)
+
+	nicPool.FreeNIC(2)
+	nic3, err := nicPool.GetNIC()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), nic3)
+}
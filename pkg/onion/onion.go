@@ -0,0 +1,97 @@
+package onion
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Hop is a bridge in the chain with its onion public key. PublicKey may be empty for the last hop, in that case
+// the previous hop forwards a plain connect request to it (e.g. third-party exit).
+type Hop struct {
+	URL       string
+	PublicKey string
+}
+
+// Layer is a decrypted onion layer. It contains only the address of the successor and the opaque remainder of the
+// onion encrypted to the successor. Empty NextHop means the receiving bridge is an exit.
+type Layer struct {
+	NextHop string `json:"next_hop,omitempty"`
+	Onion   string `json:"onion,omitempty"`
+}
+
+// Wrap builds an onion for the chain of hops. Returned onion should be sent to hops[0].
+func Wrap(hops []Hop) (string, error) {
+	if len(hops) == 0 {
+		return "", fmt.Errorf("empty hop list")
+	}
+
+	var layer Layer
+	var sealed string
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].PublicKey == "" {
+			if i != len(hops)-1 {
+				return "", fmt.Errorf("hop %d has no public key", i)
+			}
+			// plain last hop, previous hop will forward a request without onion
+			layer = Layer{NextHop: hops[i].URL}
+			sealed = ""
+			continue
+		}
+
+		var err error
+		sealed, err = seal(hops[i].PublicKey, layer)
+		if err != nil {
+			return "", fmt.Errorf("hop %d: %w", i, err)
+		}
+		layer = Layer{NextHop: hops[i].URL, Onion: sealed}
+	}
+
+	if sealed == "" {
+		return "", fmt.Errorf("first hop has no public key")
+	}
+	return sealed, nil
+}
+
+// Peel decrypts the outer layer of the onion with the bridge private key.
+func Peel(privateKey wgtypes.Key, onion string) (*Layer, error) {
+	data, err := base64.StdEncoding.DecodeString(onion)
+	if err != nil {
+		return nil, fmt.Errorf("decode onion: %w", err)
+	}
+
+	publicKey := privateKey.PublicKey()
+	opened, ok := box.OpenAnonymous(nil, data, (*[32]byte)(&publicKey), (*[32]byte)(&privateKey))
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt onion layer")
+	}
+
+	var layer Layer
+	err = json.Unmarshal(opened, &layer)
+	if err != nil {
+		return nil, fmt.Errorf("decode onion layer: %w", err)
+	}
+	return &layer, nil
+}
+
+func seal(publicKey string, layer Layer) (string, error) {
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("parse public key: %w", err)
+	}
+
+	data, err := json.Marshal(layer)
+	if err != nil {
+		return "", fmt.Errorf("encode onion layer: %w", err)
+	}
+
+	sealed, err := box.SealAnonymous(nil, data, (*[32]byte)(&key), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("seal onion layer: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
@@ -0,0 +1,54 @@
+package onion
+
+import (
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"testing"
+)
+
+func TestOnion(t *testing.T) {
+	var keys []wgtypes.Key
+	var hops []Hop
+	for _, url := range []string{"https://hop1", "https://hop2", "https://exit"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		keys = append(keys, key)
+		hops = append(hops, Hop{URL: url, PublicKey: key.PublicKey().String()})
+	}
+
+	onion, err := Wrap(hops)
+	require.NoError(t, err)
+
+	layer, err := Peel(keys[0], onion)
+	require.NoError(t, err)
+	require.Equal(t, "https://hop2", layer.NextHop)
+
+	// layer is addressed to hop1 only
+	_, err = Peel(keys[2], onion)
+	require.Error(t, err)
+
+	layer, err = Peel(keys[1], layer.Onion)
+	require.NoError(t, err)
+	require.Equal(t, "https://exit", layer.NextHop)
+
+	layer, err = Peel(keys[2], layer.Onion)
+	require.NoError(t, err)
+	require.Empty(t, layer.NextHop)
+	require.Empty(t, layer.Onion)
+}
+
+func TestOnionPlainExit(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	onion, err := Wrap([]Hop{
+		{URL: "https://hop1", PublicKey: key.PublicKey().String()},
+		{URL: "https://thirdparty-exit"},
+	})
+	require.NoError(t, err)
+
+	layer, err := Peel(key, onion)
+	require.NoError(t, err)
+	require.Equal(t, "https://thirdparty-exit", layer.NextHop)
+	require.Empty(t, layer.Onion)
+}
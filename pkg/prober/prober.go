@@ -0,0 +1,234 @@
+package prober
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/url"
+	"pbridge/pkg/config"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// probe is a wireguard transport data message with "ping" in place of the encrypted packet, XDP program of the
+// bridge answers it with "pong" without passing it to the wireguard interface
+const (
+	probeSize      = 32
+	probeSignature = 16
+)
+
+var (
+	pingSignature = []byte("ping")
+	pongSignature = []byte("pong")
+)
+
+// Result is the latency of a next hop measured with ping probes.
+type Result struct {
+	NextHop string
+	RTT     time.Duration
+	Err     error
+	Time    time.Time
+}
+
+func (r *Result) Healthy() bool {
+	return r.Err == nil
+}
+
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Prober measures round trip time to wireguard ports of next hops and caches results.
+type Prober struct {
+	cfg  config.ProbeConfig
+	dial DialFunc
+
+	lock sync.Mutex
+	// results by host of next hop URL
+	cache map[string]*Result
+	// probes in progress by host, concurrent measures of the host wait for them
+	inflight map[string]*inflightProbe
+}
+
+type inflightProbe struct {
+	done   chan struct{}
+	result *Result
+	// result is not cached if the owner's context was canceled
+	cached bool
+}
+
+// New creates prober which sends probes over connections from dial, see Dialer.
+func New(cfg config.ProbeConfig, dial DialFunc) *Prober {
+	return &Prober{
+		cfg:      cfg,
+		dial:     dial,
+		cache:    map[string]*Result{},
+		inflight: map[string]*inflightProbe{},
+	}
+}
+
+// Dialer returns dialer of UDP sockets with don't fragment flag, probes without it are ignored by the responder.
+func Dialer() *net.Dialer {
+	return &net.Dialer{Control: setDontFragment}
+}
+
+// Measure probes next hops concurrently, recent results are taken from cache and next hops on the same host share
+// one probe. Results are in order of next hops.
+func (p *Prober) Measure(ctx context.Context, nextHops []string) []*Result {
+	results := make([]*Result, len(nextHops))
+	var wg sync.WaitGroup
+	for i, nextHop := range nextHops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = p.measure(ctx, nextHop)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (p *Prober) measure(ctx context.Context, nextHop string) *Result {
+	u, err := url.Parse(nextHop)
+	if err != nil {
+		return &Result{NextHop: nextHop, Err: err, Time: time.Now()}
+	}
+	host := u.Hostname()
+
+	for {
+		p.lock.Lock()
+		cached, ok := p.cache[host]
+		if ok && time.Since(cached.Time) < p.cfg.GetCacheTTL() {
+			p.lock.Unlock()
+			result := *cached
+			result.NextHop = nextHop
+			return &result
+		}
+		probe, waiting := p.inflight[host]
+		if !waiting {
+			probe = &inflightProbe{done: make(chan struct{})}
+			p.inflight[host] = probe
+		}
+		p.lock.Unlock()
+
+		if !waiting {
+			p.probe(ctx, host, probe)
+		}
+
+		select {
+		case <-probe.done:
+		case <-ctx.Done():
+			return &Result{NextHop: nextHop, Err: ctx.Err(), Time: time.Now()}
+		}
+		// probe of another caller was canceled, measure again
+		if waiting && !probe.cached && ctx.Err() == nil {
+			continue
+		}
+
+		result := *probe.result
+		result.NextHop = nextHop
+		return &result
+	}
+}
+
+// probe measures the host and publishes result to callers waiting for the probe.
+func (p *Prober) probe(ctx context.Context, host string, probe *inflightProbe) {
+	result := &Result{}
+	result.RTT, result.Err = p.ping(ctx, net.JoinHostPort(host, strconv.Itoa(p.cfg.GetPort())))
+	result.Time = time.Now()
+
+	p.lock.Lock()
+	delete(p.inflight, host)
+	// canceled probes say nothing about the next hop
+	if ctx.Err() == nil {
+		p.cache[host] = result
+		probe.cached = true
+	}
+	probe.result = result
+	p.lock.Unlock()
+	close(probe.done)
+}
+
+// ping sends probes one by one and returns the lowest round trip time.
+func (p *Prober) ping(ctx context.Context, addr string) (time.Duration, error) {
+	conn, err := p.dial(ctx, "udp", addr)
+	if err != nil {
+		return 0, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	var best time.Duration
+	var lastErr error
+	for range p.cfg.GetAttempts() {
+		rtt, err := p.pingOnce(ctx, conn)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	if best == 0 {
+		return 0, lastErr
+	}
+	return best, nil
+}
+
+func (p *Prober) pingOnce(ctx context.Context, conn net.Conn) (time.Duration, error) {
+	probe := make([]byte, probeSize)
+	probe[0] = 0x4
+	// receiver index and counter identify the probe
+	_, err := rand.Read(probe[4:probeSignature])
+	if err != nil {
+		return 0, err
+	}
+	copy(probe[probeSignature:], pingSignature)
+
+	deadline := time.Now().Add(p.cfg.GetTimeout())
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	_, err = conn.Write(probe)
+	if err != nil {
+		return 0, fmt.Errorf("send probe: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, fmt.Errorf("receive pong: %w", err)
+		}
+		// late pongs of previous probes are skipped
+		if n >= probeSignature+len(pongSignature) && bytes.Equal(buf[4:probeSignature], probe[4:probeSignature]) &&
+			bytes.Equal(buf[probeSignature:probeSignature+len(pongSignature)], pongSignature) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// SortByLatency orders results from the lowest round trip time, unhealthy next hops go last.
+func SortByLatency(results []*Result) {
+	slices.SortStableFunc(results, func(a, b *Result) int {
+		if a.Healthy() != b.Healthy() {
+			if a.Healthy() {
+				return -1
+			}
+			return 1
+		}
+		if !a.Healthy() {
+			return 0
+		}
+		return cmp.Compare(a.RTT, b.RTT)
+	})
+}
@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package prober
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setDontFragment(network, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if network == "udp6" {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+			return
+		}
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
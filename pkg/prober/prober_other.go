@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package prober
+
+import "syscall"
+
+func setDontFragment(network, address string, c syscall.RawConn) error {
+	return nil
+}
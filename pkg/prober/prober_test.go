@@ -0,0 +1,104 @@
+package prober
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"pbridge/pkg/config"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pongResponder answers probes like XDP program of the bridge.
+func pongResponder(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 20 || buf[0] != 0x4 || string(buf[16:20]) != "ping" {
+				continue
+			}
+			buf[17] = 'o'
+			_, _ = conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestMeasure(t *testing.T) {
+	port := pongResponder(t)
+	p := New(config.ProbeConfig{Port: port, Attempts: 2}, Dialer().DialContext)
+
+	results := p.Measure(context.Background(), []string{"https://127.0.0.1:8443", "https://127.0.0.1"})
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.True(t, results[0].Healthy())
+	require.Greater(t, results[0].RTT, time.Duration(0))
+	require.Equal(t, "https://127.0.0.1:8443", results[0].NextHop)
+	require.Equal(t, "https://127.0.0.1", results[1].NextHop)
+
+	// results are cached by host
+	cached := p.Measure(context.Background(), []string{"https://127.0.0.1:8443"})
+	require.Equal(t, results[0].Time, cached[0].Time)
+
+	// nobody answers on the port
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer silent.Close()
+	p = New(config.ProbeConfig{Port: silent.LocalAddr().(*net.UDPAddr).Port, Attempts: 1, Timeout: 1},
+		Dialer().DialContext)
+	results = p.Measure(context.Background(), []string{"https://127.0.0.1"})
+	require.Error(t, results[0].Err)
+	require.False(t, results[0].Healthy())
+}
+
+func TestMeasureSharedProbe(t *testing.T) {
+	port := pongResponder(t)
+	var dials atomic.Int32
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return Dialer().DialContext(ctx, network, addr)
+	}
+	p := New(config.ProbeConfig{Port: port, Attempts: 2}, dial)
+
+	nextHops := []string{"https://127.0.0.1:8443", "https://127.0.0.1", "https://127.0.0.1:9443"}
+	results := p.Measure(context.Background(), nextHops)
+	require.Equal(t, int32(1), dials.Load())
+	for i, result := range results {
+		require.NoError(t, result.Err)
+		require.Equal(t, nextHops[i], result.NextHop)
+		require.Equal(t, results[0].Time, result.Time)
+	}
+
+	// canceled measure leaves no result in cache
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p = New(config.ProbeConfig{Port: port}, Dialer().DialContext)
+	results = p.Measure(ctx, []string{"https://127.0.0.1"})
+	require.Error(t, results[0].Err)
+	require.Empty(t, p.cache)
+	require.Empty(t, p.inflight)
+}
+
+func TestSortByLatency(t *testing.T) {
+	results := []*Result{
+		{NextHop: "down", Err: errors.New("timeout")},
+		{NextHop: "slow", RTT: 80 * time.Millisecond},
+		{NextHop: "fast", RTT: 10 * time.Millisecond},
+	}
+	SortByLatency(results)
+
+	require.Equal(t, "fast", results[0].NextHop)
+	require.Equal(t, "slow", results[1].NextHop)
+	require.Equal(t, "down", results[2].NextHop)
+}
@@ -0,0 +1,73 @@
+package sessionstore
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var sessionsBucket = []byte("sessions")
+
+// BoltStore keeps sessions in a single file key/value database, changes of one save are applied in a transaction.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the database file, it is locked while open, so another process fails to open it instead of
+// waiting.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session database: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create sessions bucket: %v", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() (map[string][]byte, error) {
+	sessions := map[string][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			// values are only valid during the transaction
+			sessions[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %v", err)
+	}
+	return sessions, nil
+}
+
+func (s *BoltStore) Apply(put map[string][]byte, del []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		for id, data := range put {
+			err := bucket.Put([]byte(id), data)
+			if err != nil {
+				return fmt.Errorf("failed to put session: %v", err)
+			}
+		}
+		for _, id := range del {
+			err := bucket.Delete([]byte(id))
+			if err != nil {
+				return fmt.Errorf("failed to delete session: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,84 @@
+package sessionstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// DirStore keeps every session in its own json file in a directory. A file is written to a temporary file first
+// and renamed, so it is never seen half written. Sessions contain secrets, so they are readable only by the owner.
+type DirStore struct {
+	dir string
+}
+
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{dir: dir}
+}
+
+func (s *DirStore) Load() (map[string][]byte, error) {
+	fileList, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read session storage directory: %v", err)
+	}
+
+	sessions := make(map[string][]byte, len(fileList))
+	for _, file := range fileList {
+		if file.IsDir() {
+			continue
+		}
+
+		// leftovers of interrupted writes
+		if strings.HasSuffix(file.Name(), ".tmp.json") || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(path.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session file: %v", err)
+		}
+		sessions[strings.TrimSuffix(file.Name(), ".json")] = data
+	}
+
+	return sessions, nil
+}
+
+func (s *DirStore) Apply(put map[string][]byte, del []string) error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create session storage directory: %v", err)
+	}
+
+	for id, data := range put {
+		tempSessionFile := path.Join(s.dir, fmt.Sprintf("%s.tmp.json", id))
+		sessionFile := path.Join(s.dir, fmt.Sprintf("%s.json", id))
+
+		err = writeFileSync(tempSessionFile, data)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(tempSessionFile, sessionFile)
+		if err != nil {
+			return fmt.Errorf("failed to rename session file: %v", err)
+		}
+	}
+
+	for _, id := range del {
+		err = os.Remove(path.Join(s.dir, fmt.Sprintf("%s.json", id)))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove session file: %v", err)
+		}
+	}
+
+	// renames and removals are durable only when the directory is flushed
+	return syncDir(s.dir)
+}
+
+func (s *DirStore) Close() error {
+	return nil
+}
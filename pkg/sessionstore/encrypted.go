@@ -0,0 +1,222 @@
+package sessionstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"pbridge/pkg/config"
+	"slices"
+	"strings"
+)
+
+// encrypted session is magic, id of the key, nonce and AES-256-GCM sealed json, the header and session id are
+// authenticated too, so a session can't be swapped for another one
+var encryptedMagic = []byte("PBSE1")
+
+const (
+	keySize   = 32
+	keyIdSize = 4
+)
+
+// IsEncrypted reports whether the stored session is encrypted.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+type encryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// EncryptedStore encrypts sessions of the wrapped store. The first key encrypts, the others are previous keys
+// accepted on load, sessions encrypted with them or not encrypted at all are marked to be rewritten on the next
+// save.
+type EncryptedStore struct {
+	Store
+	keys    []*encryptionKey
+	rewrite map[string]struct{}
+}
+
+func NewEncryptedStore(store Store, keys [][]byte) (*EncryptedStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption key")
+	}
+
+	s := &EncryptedStore{Store: store, rewrite: map[string]struct{}{}}
+	for _, key := range keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("encryption key must be %d bytes, got %d", keySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %v", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCM: %v", err)
+		}
+		sum := sha256.Sum256(key)
+		s.keys = append(s.keys, &encryptionKey{id: sum[:keyIdSize], aead: aead})
+	}
+	return s, nil
+}
+
+func (s *EncryptedStore) Load() (map[string][]byte, error) {
+	stored, err := s.Store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[string][]byte, len(stored))
+	for id, data := range stored {
+		if !IsEncrypted(data) {
+			s.rewrite[id] = struct{}{}
+			sessions[id] = data
+			continue
+		}
+
+		var rotated bool
+		sessions[id], rotated, err = s.open(id, data)
+		if err != nil {
+			return nil, fmt.Errorf("session %s: %v", id, err)
+		}
+		if rotated {
+			s.rewrite[id] = struct{}{}
+		}
+	}
+	return sessions, nil
+}
+
+// NeedsRewrite reports whether the loaded session is not encrypted with the current key.
+func (s *EncryptedStore) NeedsRewrite(id string) bool {
+	_, ok := s.rewrite[id]
+	return ok
+}
+
+func (s *EncryptedStore) Apply(put map[string][]byte, del []string) error {
+	sealed := make(map[string][]byte, len(put))
+	for id, data := range put {
+		var err error
+		sealed[id], err = s.seal(id, data)
+		if err != nil {
+			return fmt.Errorf("session %s: %v", id, err)
+		}
+	}
+
+	err := s.Store.Apply(sealed, del)
+	if err != nil {
+		return err
+	}
+	for id := range put {
+		delete(s.rewrite, id)
+	}
+	for _, id := range del {
+		delete(s.rewrite, id)
+	}
+	return nil
+}
+
+func (s *EncryptedStore) seal(id string, data []byte) ([]byte, error) {
+	key := s.keys[0]
+	header := slices.Concat(encryptedMagic, key.id)
+	nonce := make([]byte, key.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	return key.aead.Seal(slices.Concat(header, nonce), nonce, data, slices.Concat(header, []byte(id))), nil
+}
+
+// open decrypts the session and tells whether it is encrypted with a previous key.
+func (s *EncryptedStore) open(id string, data []byte) ([]byte, bool, error) {
+	headerSize := len(encryptedMagic) + keyIdSize
+	if len(data) < headerSize {
+		return nil, false, errors.New("truncated encrypted session")
+	}
+	header, keyId := data[:headerSize], data[len(encryptedMagic):headerSize]
+
+	for i, key := range s.keys {
+		if !bytes.Equal(key.id, keyId) {
+			continue
+		}
+
+		nonceSize := key.aead.NonceSize()
+		if len(data) < headerSize+nonceSize {
+			return nil, false, errors.New("truncated encrypted session")
+		}
+		nonce := data[headerSize : headerSize+nonceSize]
+		plaintext, err := key.aead.Open(nil, nonce, data[headerSize+nonceSize:], slices.Concat(header, []byte(id)))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decrypt: %v", err)
+		}
+		return plaintext, i > 0, nil
+	}
+	return nil, false, fmt.Errorf("encrypted with unknown key %s, check session_store encryption keys",
+		hex.EncodeToString(keyId))
+}
+
+// LoadKeys reads encryption keys from the configured source: base64 encoded 32 byte keys, one per line, the first
+// one is current. Nil is returned if encryption is not configured.
+func LoadKeys(cfg config.SessionEncryptionConfig) ([][]byte, error) {
+	sources := 0
+	for _, source := range []string{cfg.KeyFile, cfg.KeyEnv, cfg.KeyCredential} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, errors.New("only one of key_file, key_env and key_credential may be set")
+	}
+
+	var source, content string
+	switch {
+	case cfg.KeyFile != "":
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %v", err)
+		}
+		source, content = cfg.KeyFile, string(data)
+	case cfg.KeyEnv != "":
+		value, ok := os.LookupEnv(cfg.KeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("encryption key environment variable %s is not set", cfg.KeyEnv)
+		}
+		source, content = cfg.KeyEnv, value
+	case cfg.KeyCredential != "":
+		// systemd passes credentials of LoadCredential= as files in this directory
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, fmt.Errorf("CREDENTIALS_DIRECTORY is not set for encryption key credential %s",
+				cfg.KeyCredential)
+		}
+		data, err := os.ReadFile(path.Join(dir, cfg.KeyCredential))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key credential: %v", err)
+		}
+		source, content = cfg.KeyCredential, string(data)
+	default:
+		return nil, nil
+	}
+
+	var keys [][]byte
+	for _, line := range strings.Fields(content) {
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("invalid encryption key in %s, base64 encoded %d bytes expected", source, keySize)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption key in %s", source)
+	}
+	return keys, nil
+}
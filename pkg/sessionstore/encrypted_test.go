@@ -0,0 +1,104 @@
+package sessionstore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"pbridge/pkg/config"
+	"testing"
+)
+
+func generateKey(t *testing.T) []byte {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := generateKey(t), generateKey(t)
+	session := []byte(`{"password":"secret"}`)
+
+	store, err := NewEncryptedStore(NewDirStore(dir), [][]byte{oldKey})
+	require.NoError(t, err)
+	require.NoError(t, store.Apply(map[string][]byte{"a": session}, nil))
+
+	data, err := os.ReadFile(path.Join(dir, "a.json"))
+	require.NoError(t, err)
+	require.True(t, IsEncrypted(data))
+	require.NotContains(t, string(data), "secret")
+	info, err := os.Stat(path.Join(dir, "a.json"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// sessions encrypted with the previous key are loaded and rewritten with the new one
+	store, err = NewEncryptedStore(NewDirStore(dir), [][]byte{newKey, oldKey})
+	require.NoError(t, err)
+	sessions, err := store.Load()
+	require.NoError(t, err)
+	require.Equal(t, session, sessions["a"])
+	require.True(t, store.NeedsRewrite("a"))
+	require.NoError(t, store.Apply(sessions, nil))
+	require.False(t, store.NeedsRewrite("a"))
+
+	store, err = NewEncryptedStore(NewDirStore(dir), [][]byte{newKey})
+	require.NoError(t, err)
+	sessions, err = store.Load()
+	require.NoError(t, err)
+	require.Equal(t, session, sessions["a"])
+
+	// unknown key fails loudly
+	store, err = NewEncryptedStore(NewDirStore(dir), [][]byte{oldKey})
+	require.NoError(t, err)
+	_, err = store.Load()
+	require.ErrorContains(t, err, "unknown key")
+
+	// sessions are bound to their ids
+	require.NoError(t, os.Rename(path.Join(dir, "a.json"), path.Join(dir, "b.json")))
+	store, err = NewEncryptedStore(NewDirStore(dir), [][]byte{newKey})
+	require.NoError(t, err)
+	_, err = store.Load()
+	require.ErrorContains(t, err, "failed to decrypt")
+
+	// plaintext sessions are encrypted on the next save
+	require.NoError(t, NewDirStore(dir).Apply(map[string][]byte{"b": session}, nil))
+	sessions, err = store.Load()
+	require.NoError(t, err)
+	require.Equal(t, session, sessions["b"])
+	require.True(t, store.NeedsRewrite("b"))
+}
+
+func TestLoadKeys(t *testing.T) {
+	key1, key2 := generateKey(t), generateKey(t)
+	content := base64.StdEncoding.EncodeToString(key1) + "\n" + base64.StdEncoding.EncodeToString(key2) + "\n"
+
+	keys, err := LoadKeys(config.SessionEncryptionConfig{})
+	require.NoError(t, err)
+	require.Nil(t, keys)
+
+	keyFile := path.Join(t.TempDir(), "session.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(content), 0600))
+	keys, err = LoadKeys(config.SessionEncryptionConfig{KeyFile: keyFile})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{key1, key2}, keys)
+
+	t.Setenv("PBRIDGE_SESSION_KEY", content)
+	keys, err = LoadKeys(config.SessionEncryptionConfig{KeyEnv: "PBRIDGE_SESSION_KEY"})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{key1, key2}, keys)
+
+	t.Setenv("CREDENTIALS_DIRECTORY", path.Dir(keyFile))
+	keys, err = LoadKeys(config.SessionEncryptionConfig{KeyCredential: "session.key"})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{key1, key2}, keys)
+
+	_, err = LoadKeys(config.SessionEncryptionConfig{KeyFile: keyFile, KeyEnv: "PBRIDGE_SESSION_KEY"})
+	require.Error(t, err)
+
+	t.Setenv("PBRIDGE_SESSION_KEY", "c2hvcnQ=")
+	_, err = LoadKeys(config.SessionEncryptionConfig{KeyEnv: "PBRIDGE_SESSION_KEY"})
+	require.ErrorContains(t, err, "invalid encryption key")
+}
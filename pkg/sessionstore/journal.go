@@ -0,0 +1,321 @@
+package sessionstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+)
+
+const (
+	snapshotFile = "snapshot"
+	journalFile  = "journal"
+
+	opPut = 1
+	opDel = 2
+
+	// length and checksum of the payload
+	frameHeaderSize = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// JournalStore appends every change to a write-ahead journal and compacts it into a snapshot when the journal grows
+// over the limit, so recovery reads at most the snapshot and the limited journal. Changes of one save are written in
+// a single checksummed frame, a frame torn by a crash is dropped on recovery as a whole.
+type JournalStore struct {
+	dir         string
+	compactSize int64
+
+	journal     *os.File
+	journalSize int64
+	// current state, written to the snapshot on compaction
+	sessions map[string][]byte
+}
+
+// OpenJournalStore recovers sessions from the snapshot and journal in dir.
+func OpenJournalStore(dir string, compactSize int64) (*JournalStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session storage directory: %v", err)
+	}
+
+	s := &JournalStore{dir: dir, compactSize: compactSize, sessions: map[string][]byte{}}
+	err = s.readSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	s.journal, err = os.OpenFile(path.Join(dir, journalFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+	// entry of the created journal is durable only when the directory is flushed
+	err = syncDir(dir)
+	if err != nil {
+		_ = s.journal.Close()
+		return nil, err
+	}
+	err = s.replayJournal()
+	if err != nil {
+		_ = s.journal.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *JournalStore) readSnapshot() error {
+	data, err := os.ReadFile(path.Join(s.dir, snapshotFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read snapshot: %v", err)
+	}
+
+	// the snapshot is renamed into place only when complete, so it has to be valid
+	payload, _, err := readFrame(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %v", err)
+	}
+	return applyOps(s.sessions, payload)
+}
+
+// replayJournal applies complete frames of the journal and cuts off the torn tail.
+func (s *JournalStore) replayJournal() error {
+	data, err := io.ReadAll(s.journal)
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %v", err)
+	}
+
+	r := bytes.NewReader(data)
+	var offset int64
+	for r.Len() > 0 {
+		payload, size, err := readFrame(r)
+		if err == nil {
+			err = applyOps(s.sessions, payload)
+		}
+		if err != nil {
+			slog.Warn("drop torn journal tail", slog.String("dir", s.dir), slog.Int64("offset", offset),
+				slog.Int64("size", int64(len(data))-offset), slog.Any("err", err))
+			break
+		}
+		offset += size
+	}
+
+	if offset < int64(len(data)) {
+		err = s.journal.Truncate(offset)
+		if err != nil {
+			return fmt.Errorf("failed to truncate journal: %v", err)
+		}
+	}
+	_, err = s.journal.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek journal: %v", err)
+	}
+	s.journalSize = offset
+	return nil
+}
+
+func (s *JournalStore) Load() (map[string][]byte, error) {
+	return maps.Clone(s.sessions), nil
+}
+
+func (s *JournalStore) Apply(put map[string][]byte, del []string) error {
+	var payload []byte
+	for id, data := range put {
+		payload = appendOp(payload, opPut, id, data)
+	}
+	for _, id := range del {
+		payload = appendOp(payload, opDel, id, nil)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	frame := appendFrame(nil, payload)
+	_, err := s.journal.Write(frame)
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		// the partial frame is dropped on recovery, the next one must not follow it
+		_ = s.journal.Truncate(s.journalSize)
+		_, _ = s.journal.Seek(s.journalSize, io.SeekStart)
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	s.journalSize += int64(len(frame))
+
+	err = applyOps(s.sessions, payload)
+	if err != nil {
+		return err
+	}
+
+	if s.journalSize > s.compactSize {
+		err = s.compact()
+		if err != nil {
+			return fmt.Errorf("failed to compact journal: %v", err)
+		}
+	}
+	return nil
+}
+
+// compact writes the current state to the snapshot and empties the journal. If it is interrupted before the
+// journal is emptied, the journal is replayed over the new snapshot with the same result.
+func (s *JournalStore) compact() error {
+	var payload []byte
+	for id, data := range s.sessions {
+		payload = appendOp(payload, opPut, id, data)
+	}
+
+	tempSnapshotFile := path.Join(s.dir, snapshotFile+".tmp")
+	err := writeFileSync(tempSnapshotFile, appendFrame(nil, payload))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempSnapshotFile, path.Join(s.dir, snapshotFile))
+	if err != nil {
+		return fmt.Errorf("failed to rename snapshot: %v", err)
+	}
+	err = syncDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	err = s.journal.Truncate(0)
+	if err == nil {
+		_, err = s.journal.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to truncate journal: %v", err)
+	}
+	s.journalSize = 0
+	return nil
+}
+
+func (s *JournalStore) Close() error {
+	return s.journal.Close()
+}
+
+func appendOp(payload []byte, op byte, id string, data []byte) []byte {
+	payload = append(payload, op)
+	payload = binary.AppendUvarint(payload, uint64(len(id)))
+	payload = append(payload, id...)
+	if op == opPut {
+		payload = binary.AppendUvarint(payload, uint64(len(data)))
+		payload = append(payload, data...)
+	}
+	return payload
+}
+
+func applyOps(sessions map[string][]byte, payload []byte) error {
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		id, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opPut:
+			data, err := readBytes(r)
+			if err != nil {
+				return err
+			}
+			sessions[string(id)] = data
+		case opDel:
+			delete(sessions, string(id))
+		default:
+			return fmt.Errorf("unknown journal operation %d", op)
+		}
+	}
+	return nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func appendFrame(frame []byte, payload []byte) []byte {
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(payload, crcTable))
+	return append(frame, payload...)
+}
+
+// readFrame returns payload of the next frame and size of the whole frame.
+func readFrame(r *bytes.Reader) ([]byte, int64, error) {
+	var header [frameHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("truncated frame header: %v", err)
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if int64(size) > int64(r.Len()) {
+		return nil, 0, errors.New("truncated frame")
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("frame checksum mismatch")
+	}
+	return payload, frameHeaderSize + int64(size), nil
+}
+
+// writeFileSync writes the file and flushes it to disk.
+func writeFileSync(name string, data []byte) error {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", name, err)
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// syncDir flushes directory entries, e.g. after rename, to disk.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer fd.Close()
+	err = fd.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package sessionstore
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestJournalStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenJournalStore(dir, 1024)
+	require.NoError(t, err)
+
+	// changes are appended to the journal until it is compacted into the snapshot
+	require.NoError(t, store.Apply(map[string][]byte{"a": []byte("a1"), "b": []byte("b1")}, nil))
+	require.NoError(t, store.Apply(map[string][]byte{"a": []byte("a2")}, []string{"b"}))
+	_, err = os.Stat(path.Join(dir, snapshotFile))
+	require.True(t, os.IsNotExist(err))
+
+	for i := range 20 {
+		require.NoError(t, store.Apply(map[string][]byte{fmt.Sprintf("s%d", i): make([]byte, 100)}, nil))
+	}
+	info, err := os.Stat(path.Join(dir, journalFile))
+	require.NoError(t, err)
+	require.Less(t, info.Size(), int64(1024))
+	require.NoError(t, store.Apply(map[string][]byte{"c": []byte("c1")}, []string{"s0"}))
+	require.NoError(t, store.Close())
+
+	expected, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, expected, 21)
+	require.Equal(t, []byte("a2"), expected["a"])
+
+	store, err = OpenJournalStore(dir, 1024)
+	require.NoError(t, err)
+	sessions, err := store.Load()
+	require.NoError(t, err)
+	require.Equal(t, expected, sessions)
+
+	// frame torn by a crash is dropped and the journal continues after the last complete one
+	require.NoError(t, store.Apply(map[string][]byte{"d": []byte("d1")}, nil))
+	require.NoError(t, store.Close())
+	journal, err := os.OpenFile(path.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = journal.Write(appendFrame(nil, appendOp(nil, opPut, "e", []byte("e1")))[:10])
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	store, err = OpenJournalStore(dir, 1024)
+	require.NoError(t, err)
+	require.NoError(t, store.Apply(map[string][]byte{"f": []byte("f1")}, nil))
+	require.NoError(t, store.Close())
+
+	store, err = OpenJournalStore(dir, 1024)
+	require.NoError(t, err)
+	defer store.Close()
+	sessions, err = store.Load()
+	require.NoError(t, err)
+	require.Equal(t, []byte("d1"), sessions["d"])
+	require.Equal(t, []byte("f1"), sessions["f"])
+	require.NotContains(t, sessions, "e")
+
+	// interrupted compaction replays the journal over the new snapshot
+	require.NoError(t, store.compact())
+	require.NoError(t, store.Apply(map[string][]byte{"a": []byte("a3")}, []string{"c"}))
+	journalData, err := os.ReadFile(path.Join(dir, journalFile))
+	require.NoError(t, err)
+	require.NoError(t, store.compact())
+	require.NoError(t, os.WriteFile(path.Join(dir, journalFile), journalData, 0600))
+
+	replayed, err := OpenJournalStore(dir, 1024)
+	require.NoError(t, err)
+	defer replayed.Close()
+	expected, err = store.Load()
+	require.NoError(t, err)
+	sessions, err = replayed.Load()
+	require.NoError(t, err)
+	require.Equal(t, expected, sessions)
+}
@@ -0,0 +1,38 @@
+package sessionstore
+
+import (
+	"maps"
+	"sync"
+)
+
+// MemoryStore keeps sessions only for the lifetime of the process, nothing is restored after restart.
+type MemoryStore struct {
+	lock     sync.Mutex
+	sessions map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string][]byte{}}
+}
+
+func (s *MemoryStore) Load() (map[string][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return maps.Clone(s.sessions), nil
+}
+
+func (s *MemoryStore) Apply(put map[string][]byte, del []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, data := range put {
+		s.sessions[id] = data
+	}
+	for _, id := range del {
+		delete(s.sessions, id)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package sessionstore
+
+import (
+	"fmt"
+	"pbridge/pkg/config"
+)
+
+// backends of session storage
+const (
+	TypeDir     = "dir"
+	TypeBolt    = "bolt"
+	TypeJournal = "journal"
+	TypeMemory  = "memory"
+)
+
+// Store keeps encoded sessions by session id.
+type Store interface {
+	// Load returns all stored sessions.
+	Load() (map[string][]byte, error)
+	// Apply stores changed sessions and deletes removed ones, as one transaction if the backend supports it.
+	Apply(put map[string][]byte, del []string) error
+	Close() error
+}
+
+// Rewriter is implemented by stores which want some of the loaded sessions written again on the next save even if
+// they have not changed, e.g. to re-encrypt them with the current key.
+type Rewriter interface {
+	NeedsRewrite(id string) bool
+}
+
+// Open opens session storage of the configured type at path, a directory or a database file. Sessions are encrypted
+// if encryption keys are configured.
+func Open(cfg config.SessionStoreConfig, path string) (Store, error) {
+	keys, err := LoadKeys(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	var store Store
+	switch cfg.GetType() {
+	case TypeDir:
+		store = NewDirStore(path)
+	case TypeBolt:
+		store, err = OpenBoltStore(path)
+		if err != nil {
+			return nil, err
+		}
+	case TypeJournal:
+		store, err = OpenJournalStore(path, cfg.GetCompactSize())
+		if err != nil {
+			return nil, err
+		}
+	case TypeMemory:
+		store = NewMemoryStore()
+	default:
+		return nil, fmt.Errorf("unknown session store type: %s", cfg.Type)
+	}
+
+	if keys == nil {
+		return store, nil
+	}
+	encryptedStore, err := NewEncryptedStore(store, keys)
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return encryptedStore, nil
+}
+
+// Migrate copies all sessions to another store, sessions which are not in the source are deleted from it.
+func Migrate(from Store, to Store) (int, error) {
+	sessions, err := from.Load()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load sessions: %v", err)
+	}
+
+	existing, err := to.Load()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load sessions from target: %v", err)
+	}
+	var del []string
+	for id := range existing {
+		if _, ok := sessions[id]; !ok {
+			del = append(del, id)
+		}
+	}
+
+	err = to.Apply(sessions, del)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store sessions: %v", err)
+	}
+	return len(sessions), nil
+}
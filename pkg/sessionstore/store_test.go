@@ -0,0 +1,59 @@
+package sessionstore
+
+import (
+	"github.com/stretchr/testify/require"
+	"path"
+	"pbridge/pkg/config"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	for _, storeType := range []string{TypeDir, TypeBolt, TypeJournal, TypeMemory} {
+		t.Run(storeType, func(t *testing.T) {
+			storePath := t.TempDir()
+			if storeType == TypeBolt {
+				storePath = path.Join(storePath, "sessions.db")
+			}
+			store, err := Open(config.SessionStoreConfig{Type: storeType}, storePath)
+			require.NoError(t, err)
+			defer store.Close()
+
+			sessions, err := store.Load()
+			require.NoError(t, err)
+			require.Empty(t, sessions)
+
+			require.NoError(t, store.Apply(map[string][]byte{"a": []byte("{}\n"), "b": []byte(`{"id":"b"}`)}, nil))
+			require.NoError(t, store.Apply(map[string][]byte{"b": []byte(`{"id":"b2"}`)}, []string{"a", "missing"}))
+
+			sessions, err = store.Load()
+			require.NoError(t, err)
+			require.Equal(t, map[string][]byte{"b": []byte(`{"id":"b2"}`)}, sessions)
+		})
+	}
+
+	_, err := Open(config.SessionStoreConfig{Type: "sql"}, "")
+	require.Error(t, err)
+}
+
+func TestMigrate(t *testing.T) {
+	from := NewDirStore(t.TempDir())
+	require.NoError(t, from.Apply(map[string][]byte{"a": []byte("a"), "b": []byte("b")}, nil))
+
+	toPath := path.Join(t.TempDir(), "sessions.db")
+	to, err := OpenBoltStore(toPath)
+	require.NoError(t, err)
+	defer to.Close()
+	require.NoError(t, to.Apply(map[string][]byte{"stale": []byte("stale")}, nil))
+
+	migrated, err := Migrate(from, to)
+	require.NoError(t, err)
+	require.Equal(t, 2, migrated)
+
+	sessions, err := to.Load()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("a"), "b": []byte("b")}, sessions)
+
+	// the database is locked while it is open
+	_, err = OpenBoltStore(toPath)
+	require.Error(t, err)
+}
@@ -0,0 +1,273 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// minKeySetRefreshInterval limits refreshes triggered by tokens with unknown key id.
+var minKeySetRefreshInterval = 30 * time.Second
+
+// keySetFetchTimeout limits the refresh shared by concurrent callers.
+const keySetFetchTimeout = 10 * time.Second
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// KeySet is a cached JSON Web Key Set loaded from a file or URL. It is refreshed periodically and when a token
+// is signed with unknown key id, which handles key rollover on the issuer side.
+type KeySet struct {
+	file            string
+	url             string
+	refreshInterval time.Duration
+	c               *http.Client
+
+	lock        sync.Mutex
+	keys        map[string]crypto.PublicKey
+	refreshTime time.Time
+	// closed when the refresh in progress is done, nil if there is none
+	refreshing chan struct{}
+}
+
+func NewKeySet(file, url string, refreshInterval time.Duration) (*KeySet, error) {
+	if (file == "") == (url == "") {
+		return nil, fmt.Errorf("exactly one of JWKS file or URL must be specified")
+	}
+
+	return &KeySet{
+		file:            file,
+		url:             url,
+		refreshInterval: refreshInterval,
+		c:               &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Get returns public key by key id. The key set is fetched without holding the lock: clients with a cached key don't
+// wait for the refresh, the others wait for the refresh in progress.
+func (s *KeySet) Get(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.lock.Lock()
+	key, known := s.keys[kid]
+	sinceRefresh := time.Since(s.refreshTime)
+	if s.keys != nil && sinceRefresh <= s.refreshInterval && (known || sinceRefresh <= minKeySetRefreshInterval) {
+		s.lock.Unlock()
+		return keyById(key, known, kid)
+	}
+
+	done := s.refreshing
+	if done == nil {
+		done = make(chan struct{})
+		s.refreshing = done
+		s.refreshTime = time.Now()
+		s.lock.Unlock()
+
+		// other callers wait for the refresh, so it doesn't end with the request which started it
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), keySetFetchTimeout)
+		keys, err := s.load(loadCtx)
+		cancel()
+
+		s.lock.Lock()
+		if err == nil {
+			s.keys = keys
+		}
+		noKeys := s.keys == nil
+		key, known = s.keys[kid]
+		s.refreshing = nil
+		close(done)
+		s.lock.Unlock()
+
+		if err != nil {
+			if noKeys {
+				return nil, err
+			}
+			// keep using cached keys
+			slog.Error("failed to refresh JWKS", slog.String("file", s.file), slog.String("url", s.url),
+				slog.Any("err", err))
+		}
+		return keyById(key, known, kid)
+	}
+	s.lock.Unlock()
+
+	// keep using cached key while the key set is refreshed
+	if known {
+		return key, nil
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	s.lock.Lock()
+	noKeys := s.keys == nil
+	key, known = s.keys[kid]
+	s.lock.Unlock()
+	if noKeys {
+		return nil, fmt.Errorf("JWKS is not loaded")
+	}
+	return keyById(key, known, kid)
+}
+
+func keyById(key crypto.PublicKey, known bool, kid string) (crypto.PublicKey, error) {
+	if !known {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	return key, nil
+}
+
+func (s *KeySet) load(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	data, err := s.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("JWKS loaded", slog.String("file", s.file), slog.String("url", s.url), slog.Int("keys", len(keys)))
+	return keys, nil
+}
+
+func (s *KeySet) fetch(ctx context.Context) ([]byte, error) {
+	if s.file != "" {
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return nil, fmt.Errorf("read JWKS file: %w", err)
+		}
+		return data, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create JWKS request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("read JWKS: %w", err)
+	}
+	return data, nil
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set jwks
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("skip invalid JWK", slog.String("kid", k.Kid), slog.Any("err", err))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e: %w", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key size: %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
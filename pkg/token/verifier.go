@@ -0,0 +1,124 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"pbridge/pkg/config"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AccessClaims are claims of a verified client access token mapped to client policy.
+type AccessClaims struct {
+	Subject     string
+	Issuer      string
+	Groups      []string
+	AllowedHops []string
+	MaxSessions int
+}
+
+// Verifier validates client access tokens issued by configured identity providers.
+type Verifier struct {
+	issuers map[string]*issuer
+	claims  config.TokenClaimsConfig
+}
+
+type issuer struct {
+	audiences []string
+	keySet    *KeySet
+}
+
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// NewVerifier returns nil if no issuers are configured.
+func NewVerifier(cfg config.AccessTokenConfig) (*Verifier, error) {
+	if len(cfg.Issuers) == 0 {
+		return nil, nil
+	}
+
+	v := &Verifier{
+		issuers: map[string]*issuer{},
+		claims:  cfg.Claims,
+	}
+	for _, issuerCfg := range cfg.Issuers {
+		if issuerCfg.Issuer == "" {
+			return nil, fmt.Errorf("issuer is not specified")
+		}
+
+		keySet, err := NewKeySet(issuerCfg.JWKSFile, issuerCfg.JWKSURL, issuerCfg.GetRefreshInterval())
+		if err != nil {
+			return nil, fmt.Errorf("issuer %s: %w", issuerCfg.Issuer, err)
+		}
+
+		v.issuers[issuerCfg.Issuer] = &issuer{
+			audiences: issuerCfg.Audiences,
+			keySet:    keySet,
+		}
+	}
+	return v, nil
+}
+
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*AccessClaims, error) {
+	claims := jwt.MapClaims{}
+	var tokenIssuer *issuer
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		iss, err := claims.GetIssuer()
+		if err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		tokenIssuer, ok = v.issuers[iss]
+		if !ok {
+			return nil, fmt.Errorf("unknown issuer: %q", iss)
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return tokenIssuer.keySet.Get(ctx, kid)
+	}, jwt.WithValidMethods(validMethods), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	if len(tokenIssuer.audiences) > 0 {
+		audiences, err := claims.GetAudience()
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify token: %w", err)
+		}
+		if !slices.ContainsFunc(audiences, func(aud string) bool {
+			return slices.Contains(tokenIssuer.audiences, aud)
+		}) {
+			return nil, fmt.Errorf("failed to verify token: %w", jwt.ErrTokenInvalidAudience)
+		}
+	}
+
+	result := &AccessClaims{
+		Groups:      stringsClaim(claims, v.claims.GetGroups()),
+		AllowedHops: stringsClaim(claims, v.claims.GetAllowedHops()),
+	}
+	result.Subject, _ = claims.GetSubject()
+	result.Issuer, _ = claims.GetIssuer()
+	if maxSessions, ok := claims[v.claims.GetMaxSessions()].(float64); ok {
+		result.MaxSessions = int(maxSessions)
+	}
+	return result, nil
+}
+
+// stringsClaim returns claim value as list of strings, single string is also accepted.
+func stringsClaim(claims jwt.MapClaims, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,181 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"pbridge/pkg/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	tokenString, err := token.SignedString(key)
+	require.NoError(t, err)
+	return tokenString
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var lock sync.Mutex
+	keys := []jwk{{
+		Kty: "RSA", Kid: "rsa1", Use: "sig",
+		N: encodeBigInt(rsaKey.N), E: encodeBigInt(big.NewInt(int64(rsaKey.E))),
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		_ = json.NewEncoder(w).Encode(&jwks{Keys: keys})
+	}))
+	defer server.Close()
+
+	v, err := NewVerifier(config.AccessTokenConfig{
+		Issuers: []config.TokenIssuerConfig{{
+			Issuer:    "https://idp.example.com",
+			Audiences: []string{"pbridge"},
+			JWKSURL:   server.URL,
+		}},
+	})
+	require.NoError(t, err)
+
+	claims := jwt.MapClaims{
+		"iss":          "https://idp.example.com",
+		"sub":          "user1",
+		"aud":          "pbridge",
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"groups":       []string{"g1", "g2"},
+		"allowed_hops": "https://*.example.com",
+		"max_sessions": 3,
+	}
+
+	accessClaims, err := v.Verify(context.Background(), signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa1", claims))
+	require.NoError(t, err)
+	require.Equal(t, "user1", accessClaims.Subject)
+	require.Equal(t, []string{"g1", "g2"}, accessClaims.Groups)
+	require.Equal(t, []string{"https://*.example.com"}, accessClaims.AllowedHops)
+	require.Equal(t, 3, accessClaims.MaxSessions)
+
+	// wrong audience
+	claims["aud"] = "other"
+	_, err = v.Verify(context.Background(), signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa1", claims))
+	require.Error(t, err)
+	claims["aud"] = "pbridge"
+
+	// unknown issuer
+	claims["iss"] = "https://other.example.com"
+	_, err = v.Verify(context.Background(), signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa1", claims))
+	require.Error(t, err)
+	claims["iss"] = "https://idp.example.com"
+
+	// key rollover, unknown key id triggers JWKS refresh
+	ecToken := signToken(t, jwt.SigningMethodES256, ecKey, "ec1", claims)
+	_, err = v.Verify(context.Background(), ecToken)
+	require.Error(t, err)
+
+	lock.Lock()
+	keys = append(keys, jwk{
+		Kty: "EC", Kid: "ec1", Crv: "P-256",
+		X: encodeBigInt(ecKey.X), Y: encodeBigInt(ecKey.Y),
+	})
+	lock.Unlock()
+	setMinKeySetRefreshInterval(t, 0)
+
+	_, err = v.Verify(context.Background(), ecToken)
+	require.NoError(t, err)
+}
+
+func setMinKeySetRefreshInterval(t *testing.T, interval time.Duration) {
+	saved := minKeySetRefreshInterval
+	minKeySetRefreshInterval = interval
+	t.Cleanup(func() { minKeySetRefreshInterval = saved })
+}
+
+func TestKeySetSlowRefresh(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	setMinKeySetRefreshInterval(t, 0)
+	block := make(chan struct{})
+	var requests sync.WaitGroup
+	requests.Add(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []string{"ec1"}
+		if r.URL.Query().Get("slow") != "" {
+			requests.Done()
+			<-block
+			keys = append(keys, "ec2")
+		}
+		var set jwks
+		for _, kid := range keys {
+			set.Keys = append(set.Keys, jwk{
+				Kty: "EC", Kid: kid, Crv: "P-256",
+				X: encodeBigInt(ecKey.X), Y: encodeBigInt(ecKey.Y),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(&set)
+	}))
+	defer server.Close()
+	defer func() {
+		select {
+		case <-block:
+		default:
+			close(block)
+		}
+	}()
+
+	keySet, err := NewKeySet("", server.URL, time.Hour)
+	require.NoError(t, err)
+	_, err = keySet.Get(context.Background(), "ec1")
+	require.NoError(t, err)
+
+	// refresh hangs on the slow issuer
+	keySet.url = server.URL + "?slow=1"
+	keySet.refreshTime = time.Time{}
+	refreshed := make(chan error)
+	// request which started the refresh goes away, the refresh goes on for the others
+	refreshCtx, cancelRefresh := context.WithCancel(context.Background())
+	go func() {
+		_, err := keySet.Get(refreshCtx, "ec1")
+		refreshed <- err
+	}()
+	requests.Wait()
+	cancelRefresh()
+
+	// cached key is returned while refresh is in progress, unknown key waits for it
+	_, err = keySet.Get(context.Background(), "ec1")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = keySet.Get(ctx, "ec2")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	waited := make(chan error)
+	go func() {
+		_, err := keySet.Get(context.Background(), "ec2")
+		waited <- err
+	}()
+
+	close(block)
+	require.NoError(t, <-refreshed)
+	require.NoError(t, <-waited)
+}
@@ -0,0 +1,134 @@
+package wgclient
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"pbridge/pkg/ebpf"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// adoptableLink is a client interface left by the previous run, its peer keeps forwarding traffic until the session
+// is restored.
+type adoptableLink struct {
+	nicId uint32
+	link  netlink.Link
+	// public key of the upstream peer, zero if the interface has none or several
+	peer wgtypes.Key
+}
+
+func (l *adoptableLink) update(mtu int) error {
+	if mtu != 0 && l.link.Attrs().MTU != mtu {
+		err := netlink.LinkSetMTU(l.link, mtu)
+		if err != nil {
+			return fmt.Errorf("set mtu of wireguard interface %s: %w", l.link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// pinPath returns directory for pinned ebpf objects of the interface, empty if adoption is disabled.
+func (s *Service) pinPath(nicName string) string {
+	if !s.adopt.Enabled {
+		return ""
+	}
+	return filepath.Join(s.adopt.GetPinPath(), nicName)
+}
+
+// collectAdoptable finds client interfaces left by the previous run, they are matched with restored sessions by
+// private key. Interfaces which can't be adopted are deleted.
+func (s *Service) collectAdoptable() error {
+	linkList, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("get link list failed: %w", err)
+	}
+	for _, link := range linkList {
+		linkName := link.Attrs().Name
+		nicId, ok := parseNicId(linkName, s.nicPrefix)
+		if !ok {
+			continue
+		}
+
+		device, err := s.ctrl.Device(linkName)
+		if err == nil {
+			adopted := newAdoptableLink(nicId, link, device)
+			// interfaces with the same key can't be told apart
+			if _, ok := s.adoptable[device.PrivateKey]; adopted != nil && !ok {
+				s.nicPool.Reserve(nicId)
+				s.adoptable[device.PrivateKey] = adopted
+				slog.Info("client: found wireguard interface to adopt", slog.String("name", linkName))
+				continue
+			}
+		}
+
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("delete existing wireguard interface %s: %w", linkName, err)
+		}
+		slog.Info("client: existing wireguard interface can't be adopted, deleted", slog.String("name", linkName))
+	}
+	return nil
+}
+
+// parseNicId returns id of the client interface with the prefix, e.g. 3 of wgc3.
+func parseNicId(linkName, nicPrefix string) (uint32, bool) {
+	after, ok := strings.CutPrefix(linkName, nicPrefix)
+	if !ok || after == "" {
+		return 0, false
+	}
+	nicId, err := strconv.ParseUint(after, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(nicId), true
+}
+
+// newAdoptableLink returns interface which can be matched with a restored session, nil if the device has no key.
+func newAdoptableLink(nicId uint32, link netlink.Link, device *wgtypes.Device) *adoptableLink {
+	if device.PrivateKey == (wgtypes.Key{}) {
+		return nil
+	}
+	adopted := &adoptableLink{nicId: nicId, link: link}
+	if len(device.Peers) == 1 {
+		adopted.peer = device.Peers[0].PublicKey
+	}
+	return adopted
+}
+
+func (s *Service) claimAdoptable(privateKey wgtypes.Key) *adoptableLink {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	adopted := s.adoptable[privateKey]
+	delete(s.adoptable, privateKey)
+	return adopted
+}
+
+// Reconcile deletes interfaces left by the previous run which have not been claimed by restored sessions. It must be
+// called once sessions are restored.
+func (s *Service) Reconcile() error {
+	s.lock.Lock()
+	adoptable := s.adoptable
+	s.adoptable = map[wgtypes.Key]*adoptableLink{}
+	s.lock.Unlock()
+
+	// failure to delete one interface doesn't keep the others
+	var errs []error
+	for _, adopted := range adoptable {
+		linkName := adopted.link.Attrs().Name
+		if err := netlink.LinkDel(adopted.link); err != nil {
+			errs = append(errs, fmt.Errorf("delete stale wireguard interface %s: %w", linkName, err))
+			continue
+		}
+		s.nicPool.FreeNIC(adopted.nicId)
+		if err := ebpf.RemovePinned(s.pinPath(linkName)); err != nil {
+			errs = append(errs, fmt.Errorf("remove pinned ebpf objects of %s: %w", linkName, err))
+		}
+		slog.Info("client: stale wireguard interface deleted", slog.String("name", linkName))
+	}
+	return errors.Join(errs...)
+}
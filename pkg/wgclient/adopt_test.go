@@ -0,0 +1,47 @@
+package wgclient
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"testing"
+)
+
+func TestParseNicId(t *testing.T) {
+	nicId, ok := parseNicId("wgc12", "wgc")
+	require.True(t, ok)
+	require.Equal(t, uint32(12), nicId)
+
+	for _, linkName := range []string{"wgc", "wgcx", "wgs0", "eth0", "wgc99999999999"} {
+		_, ok = parseNicId(linkName, "wgc")
+		require.False(t, ok, linkName)
+	}
+}
+
+func TestAdoptableLink(t *testing.T) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	peer, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wgc3"}}
+
+	// interface without key can't be matched with a session
+	require.Nil(t, newAdoptableLink(3, link, &wgtypes.Device{}))
+
+	adopted := newAdoptableLink(3, link, &wgtypes.Device{PrivateKey: privateKey, Peers: []wgtypes.Peer{{PublicKey: peer}}})
+	require.Equal(t, uint32(3), adopted.nicId)
+	require.Equal(t, peer, adopted.peer)
+
+	// peer is replaced if it is not the only one
+	adopted = newAdoptableLink(3, link, &wgtypes.Device{PrivateKey: privateKey,
+		Peers: []wgtypes.Peer{{PublicKey: peer}, {PublicKey: privateKey.PublicKey()}}})
+	require.Equal(t, wgtypes.Key{}, adopted.peer)
+
+	// interface is claimed once by the session with its private key
+	s := &Service{adoptable: map[wgtypes.Key]*adoptableLink{privateKey: adopted}}
+	otherKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	require.Nil(t, s.claimAdoptable(otherKey))
+	require.Same(t, adopted, s.claimAdoptable(privateKey))
+	require.Nil(t, s.claimAdoptable(privateKey))
+}
@@ -8,6 +8,8 @@ import (
 	"log/slog"
 	"net"
 	"pbridge/pkg/ebpf"
+	"sync"
+	"time"
 )
 
 type ProfileHandle struct {
@@ -19,6 +21,11 @@ type ProfileHandle struct {
 	handle     *ebpf.EbpfHandle
 	ip4        net.IP
 	ip6        net.IP
+	created    time.Time
+
+	// last peer state read by monitor
+	stateLock sync.Mutex
+	state     *PeerState
 }
 
 func (s *ProfileHandle) SetupForwarding(ip4 net.IP, ip6 net.IP, link uint32) error {
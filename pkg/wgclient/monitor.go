@@ -0,0 +1,120 @@
+package wgclient
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// PeerState is the state of the upstream peer read from the client interface.
+type PeerState struct {
+	LastHandshake time.Time `json:"last_handshake"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	// no handshake within the configured window since the interface was created
+	Stale     bool      `json:"stale"`
+	CheckTime time.Time `json:"check_time"`
+}
+
+// SetStaleHandler sets function called by monitor on every check of an interface without recent handshake.
+func (s *Service) SetStaleHandler(handler func(*ProfileHandle)) {
+	s.lock.Lock()
+	s.staleHandler = handler
+	s.lock.Unlock()
+}
+
+func (s *Service) monitor() {
+	for range time.Tick(s.monitorCfg.GetInterval()) {
+		s.checkPeers()
+	}
+}
+
+func (s *Service) checkPeers() {
+	s.lock.Lock()
+	clients := make([]*ProfileHandle, 0, len(s.clients))
+	for _, instance := range s.clients {
+		clients = append(clients, instance)
+	}
+	staleHandler := s.staleHandler
+	s.lock.Unlock()
+
+	for _, instance := range clients {
+		state, err := s.readPeerState(instance)
+		if err != nil {
+			slog.Warn("client: failed to read peer state", slog.String("name", instance.nicName), slog.Any("err", err))
+			continue
+		}
+
+		previous := instance.setPeerState(state)
+		if !state.Stale {
+			if previous != nil && previous.Stale {
+				slog.Info("client: upstream handshake recovered", slog.String("name", instance.nicName))
+			}
+			continue
+		}
+
+		if previous == nil || !previous.Stale {
+			slog.Warn("client: no upstream handshake", slog.String("name", instance.nicName),
+				slog.Time("last_handshake", state.LastHandshake))
+		}
+		if staleHandler != nil {
+			staleHandler(instance)
+		}
+	}
+}
+
+func (s *Service) readPeerState(instance *ProfileHandle) (*PeerState, error) {
+	device, err := s.ctrl.Device(instance.nicName)
+	if err != nil {
+		return nil, fmt.Errorf("get wireguard device: %w", err)
+	}
+	if len(device.Peers) == 0 {
+		return nil, fmt.Errorf("no peer on wireguard device")
+	}
+
+	peer := device.Peers[0]
+	state := &PeerState{
+		LastHandshake: peer.LastHandshakeTime,
+		RxBytes:       peer.ReceiveBytes,
+		TxBytes:       peer.TransmitBytes,
+		CheckTime:     time.Now(),
+	}
+	if peer.Endpoint != nil {
+		state.Endpoint = peer.Endpoint.String()
+	}
+
+	state.Stale = isStale(instance.created, state.LastHandshake, state.CheckTime, s.monitorCfg.GetHandshakeTimeout())
+	return state, nil
+}
+
+// isStale reports whether the upstream had no handshake within timeout. Interfaces are given the timeout since
+// they were created to complete the first handshake.
+func isStale(created, lastHandshake, checkTime time.Time, timeout time.Duration) bool {
+	lastSeen := created
+	if lastHandshake.After(lastSeen) {
+		lastSeen = lastHandshake
+	}
+	return checkTime.Sub(lastSeen) > timeout
+}
+
+// PeerState returns the last state of the upstream peer read by monitor, nil if it was not read yet.
+func (s *ProfileHandle) PeerState() *PeerState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	if s.state == nil {
+		return nil
+	}
+	state := *s.state
+	return &state
+}
+
+func (s *ProfileHandle) setPeerState(state *PeerState) *PeerState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	previous := s.state
+	s.state = state
+	return previous
+}
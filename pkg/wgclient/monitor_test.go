@@ -0,0 +1,24 @@
+package wgclient
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestIsStale(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeout := 5 * time.Minute
+
+	// new interface is given the timeout for the first handshake
+	require.False(t, isStale(created, time.Time{}, created.Add(timeout), timeout))
+	require.True(t, isStale(created, time.Time{}, created.Add(timeout+time.Second), timeout))
+
+	// recent handshake keeps the upstream alive
+	handshake := created.Add(time.Hour)
+	require.False(t, isStale(created, handshake, handshake.Add(time.Minute), timeout))
+	require.True(t, isStale(created, handshake, handshake.Add(timeout+time.Second), timeout))
+
+	// handshake before the interface was created, e.g. of the adopted peer, doesn't count
+	require.True(t, isStale(created, created.Add(-time.Hour), created.Add(timeout+time.Second), timeout))
+}
@@ -21,38 +21,60 @@ import (
 const defaulClientInterfacePrefix = "wgc"
 
 type Service struct {
-	nicPool   *nic.NICPool
-	ctrl      *wgctrl.Client
-	nicPrefix string
+	nicPool    *nic.NICPool
+	ctrl       *wgctrl.Client
+	nicPrefix  string
+	monitorCfg config.ClientMonitorConfig
+	adopt      config.AdoptConfig
+	// called by monitor for interfaces without recent handshake
+	staleHandler func(*ProfileHandle)
 
 	lock           sync.Mutex
 	clientsCounter uint64
 	clients        map[uint64]*ProfileHandle
+	// interfaces left by the previous run by private key, until claimed by Add or removed by Reconcile
+	adoptable map[wgtypes.Key]*adoptableLink
 }
 
-func New(cfg *config.WireguardClientConfig) *Service {
+func New(cfg *config.WireguardClientConfig, adopt config.AdoptConfig) *Service {
 	nicPrefix := defaulClientInterfacePrefix
 	if cfg.NicPrefix != "" {
 		nicPrefix = cfg.NicPrefix
 	}
 	return &Service{
-		nicPool:   nic.NewNICPool(),
-		clients:   make(map[uint64]*ProfileHandle),
-		nicPrefix: nicPrefix,
+		nicPool:    nic.NewNICPool(),
+		clients:    make(map[uint64]*ProfileHandle),
+		nicPrefix:  nicPrefix,
+		monitorCfg: cfg.Monitor,
+		adopt:      adopt,
+		adoptable:  map[wgtypes.Key]*adoptableLink{},
 	}
 }
 
 func (s *Service) Init() error {
 	slog.Info("client: initialization")
-	err := s.cleanup()
-	if err != nil {
-		return fmt.Errorf("cleanup client odd wireguard network interfaces: %w", err)
-	}
 	ctrl, err := wgctrl.New()
 	if err != nil {
 		return fmt.Errorf("create wireguard netlink client: %w", err)
 	}
 	s.ctrl = ctrl
+
+	if s.adopt.Enabled {
+		err = ebpf.PreparePinPath(s.adopt.GetPinPath())
+		if err != nil {
+			return fmt.Errorf("prepare ebpf pin path: %w", err)
+		}
+		err = s.collectAdoptable()
+		if err != nil {
+			return fmt.Errorf("collect client wireguard network interfaces: %w", err)
+		}
+	} else {
+		err = s.cleanup()
+		if err != nil {
+			return fmt.Errorf("cleanup client odd wireguard network interfaces: %w", err)
+		}
+	}
+	go s.monitor()
 	return nil
 }
 
@@ -83,7 +105,7 @@ func (s *Service) cleanup() error {
 	return nil
 }
 
-func (s *Service) Add(profile *Profile) (*ProfileHandle, error) {
+func (s *Service) Add(profile *Profile) (_ *ProfileHandle, err error) {
 	// validate
 	if net.ParseIP(profile.ServerIP) == nil {
 		return nil, fmt.Errorf("invalid server IP: %s", profile.ServerIP)
@@ -121,9 +143,24 @@ func (s *Service) Add(profile *Profile) (*ProfileHandle, error) {
 		return nil, fmt.Errorf("parse server public key: %w", err)
 	}
 
-	nicId, err := s.nicPool.GetNIC()
-	if err != nil {
-		return nil, err
+	adopted := s.claimAdoptable(clientPrivateKey)
+	defer func() {
+		if err != nil && adopted != nil {
+			// left for Reconcile
+			s.lock.Lock()
+			s.adoptable[clientPrivateKey] = adopted
+			s.lock.Unlock()
+		}
+	}()
+
+	var nicId uint32
+	if adopted != nil {
+		nicId = adopted.nicId
+	} else {
+		nicId, err = s.nicPool.GetNIC()
+		if err != nil {
+			return nil, err
+		}
 	}
 	// wdc0 ... wdcN
 	nicName := fmt.Sprintf("%s%d", s.nicPrefix, nicId)
@@ -136,26 +173,43 @@ func (s *Service) Add(profile *Profile) (*ProfileHandle, error) {
 		allowedIPs = append(allowedIPs, net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
 	}
 
-	// Create a new Wireguard interface
-	if link, err := netlink.LinkByName(nicName); err == nil {
-		if err := netlink.LinkDel(link); err != nil {
-			return nil, fmt.Errorf("delete existing wireguard interface %s: %w", nicName, err)
+	// replacing the peer would drop the handshake of adopted interface
+	replacePeers := true
+	if adopted != nil {
+		slog.Info("client: adopt existing wireguard interface", slog.String("name", nicName))
+		err = adopted.update(profile.MTU)
+		if err != nil {
+			return nil, err
+		}
+		replacePeers = adopted.peer != serverPublicKey
+	} else {
+		// Create a new Wireguard interface
+		if link, err := netlink.LinkByName(nicName); err == nil {
+			if err := netlink.LinkDel(link); err != nil {
+				return nil, fmt.Errorf("delete existing wireguard interface %s: %w", nicName, err)
+			}
 		}
-	}
 
-	err = netlink.LinkAdd(&netlink.Wireguard{
-		LinkAttrs: netlink.LinkAttrs{
-			Name: nicName,
-			MTU:  profile.MTU,
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("create wireguard interface %s: %w", nicName, err)
+		// maps pinned for the removed interface hold its stale rules
+		err = ebpf.RemovePinned(s.pinPath(nicName))
+		if err != nil {
+			return nil, fmt.Errorf("remove pinned ebpf objects of %s: %w", nicName, err)
+		}
+
+		err = netlink.LinkAdd(&netlink.Wireguard{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: nicName,
+				MTU:  profile.MTU,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create wireguard interface %s: %w", nicName, err)
+		}
 	}
 
 	err = s.ctrl.ConfigureDevice(nicName, wgtypes.Config{
 		PrivateKey:   &clientPrivateKey,
-		ReplacePeers: true,
+		ReplacePeers: replacePeers,
 		Peers: []wgtypes.PeerConfig{
 			{
 				PublicKey:                   serverPublicKey,
@@ -169,7 +223,7 @@ func (s *Service) Add(profile *Profile) (*ProfileHandle, error) {
 		return nil, fmt.Errorf("configure wireguard interface: %w", err)
 	}
 
-	handle, err := ebpf.InstallEbpf(nicName)
+	handle, err := ebpf.InstallEbpf(nicName, s.pinPath(nicName))
 	if err != nil {
 		return nil, fmt.Errorf("install ebpf filter: %w", err)
 	}
@@ -202,6 +256,7 @@ func (s *Service) Add(profile *Profile) (*ProfileHandle, error) {
 		link:       link,
 		ip4:        internalIP4,
 		ip6:        internalIP6,
+		created:    time.Now(),
 	}
 	s.clients[id] = instance
 	return instance, nil
@@ -223,6 +278,18 @@ func (s *Service) Remove(instance *ProfileHandle) error {
 
 	s.nicPool.FreeNIC(instance.nicId)
 	instance.handle.Close()
+	err = instance.handle.Unpin()
+	if err != nil {
+		slog.Error("client: remove pinned ebpf objects", slog.String("name", instance.nicName), slog.Any("err", err))
+	}
 	delete(s.clients, instance.id)
 	return nil
 }
+
+func (s *Service) SetupForwarding(instance *ProfileHandle, ip4, ip6 net.IP, link uint32) error {
+	return instance.SetupForwarding(ip4, ip6, link)
+}
+
+func (s *Service) GetLink(instance *ProfileHandle) uint32 {
+	return instance.GetLink()
+}
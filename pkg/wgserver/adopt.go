@@ -0,0 +1,132 @@
+package wgserver
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+
+	"pbridge/pkg/ebpf"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// pinPath returns directory for pinned ebpf objects of the interface, empty if adoption is disabled.
+func (s *Service) pinPath(linkName string) string {
+	if !s.adopt.Enabled {
+		return ""
+	}
+	return filepath.Join(s.adopt.GetPinPath(), linkName)
+}
+
+// adoptLink returns wireguard interface left by the previous run if adoption is enabled. Its peers keep forwarding
+// traffic until they are reconciled with restored sessions.
+func (s *Service) adoptLink(name string) (*netlink.Wireguard, bool, error) {
+	if !s.adopt.Enabled {
+		return nil, false, nil
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("get wireguard interface: %w", err)
+	}
+
+	wgLink, ok := link.(*netlink.Wireguard)
+	if !ok {
+		slog.Warn("server: existing interface is not wireguard, not adopting", slog.String("link", name),
+			slog.String("type", link.Type()))
+		return nil, false, nil
+	}
+
+	slog.Info("server: adopt existing wireguard interface", slog.String("link", name))
+	return wgLink, true, nil
+}
+
+// Reconcile removes peers and forwarding rules left by the previous run which have not been claimed by restored
+// sessions. It must be called once sessions are restored.
+func (s *Service) Reconcile() error {
+	if !s.adopt.Enabled {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	serverInterfaceName := s.getServerInterfaceName()
+	device, err := s.client.Device(serverInterfaceName)
+	if err != nil {
+		return fmt.Errorf("get wireguard device: %w", err)
+	}
+
+	removePeers := stalePeers(device.Peers, s.profiles)
+	if len(removePeers) > 0 {
+		slog.Info("server: remove stale peers", slog.Int("peers", len(removePeers)))
+		err = s.client.ConfigureDevice(serverInterfaceName, wgtypes.Config{Peers: removePeers})
+		if err != nil {
+			return fmt.Errorf("remove stale peers: %w", err)
+		}
+	}
+
+	var ruleIPs []net.IP
+	var k ebpf.RuleKey
+	var v ebpf.RuleValue
+	it := s.handle.SrcRules.Iterate()
+	for it.Next(&k, &v) {
+		ruleIPs = append(ruleIPs, slices.Clone(k.IP))
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("iterate src rules: %w", err)
+	}
+
+	staleIPs := staleSrcIPs(ruleIPs, s.profiles)
+	for _, ip := range staleIPs {
+		err = s.handle.DeleteSrcRule(ip)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("delete stale src rule: %w", err)
+		}
+	}
+	if len(staleIPs) > 0 {
+		slog.Info("server: removed stale src rules", slog.Int("rules", len(staleIPs)))
+	}
+
+	return nil
+}
+
+// stalePeers returns removal of peers which don't belong to any profile.
+func stalePeers(peers []wgtypes.Peer, profiles map[string]*ProfileHandle) []wgtypes.PeerConfig {
+	var stale []wgtypes.PeerConfig
+	for _, peer := range peers {
+		if _, ok := profiles[peer.PublicKey.String()]; ok {
+			continue
+		}
+		stale = append(stale, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+	}
+	return stale
+}
+
+// staleSrcIPs returns IPs of src rules which are not internal IPs of any profile.
+func staleSrcIPs(ruleIPs []net.IP, profiles map[string]*ProfileHandle) []net.IP {
+	used := map[string]struct{}{}
+	for _, peer := range profiles {
+		for _, ip := range []net.IP{peer.IP4, peer.IP6} {
+			if ip != nil {
+				used[ip.String()] = struct{}{}
+			}
+		}
+	}
+
+	var stale []net.IP
+	for _, ip := range ruleIPs {
+		if _, ok := used[ip.String()]; !ok {
+			stale = append(stale, ip)
+		}
+	}
+	return stale
+}
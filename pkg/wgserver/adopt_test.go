@@ -0,0 +1,37 @@
+package wgserver
+
+import (
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"testing"
+)
+
+func TestStalePeers(t *testing.T) {
+	restored, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+	stale, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+
+	profiles := map[string]*ProfileHandle{restored.String(): {IP4: net.ParseIP("10.1.0.2")}}
+	peers := []wgtypes.Peer{{PublicKey: restored}, {PublicKey: stale}}
+	require.Equal(t, []wgtypes.PeerConfig{{PublicKey: stale, Remove: true}}, stalePeers(peers, profiles))
+	require.Empty(t, stalePeers(peers[:1], profiles))
+}
+
+func TestStaleSrcIPs(t *testing.T) {
+	profiles := map[string]*ProfileHandle{
+		"a": {IP4: net.ParseIP("10.1.0.2"), IP6: net.ParseIP("fd00::2")},
+		"b": {IP4: net.ParseIP("10.1.0.3")},
+	}
+	// keys of ebpf maps hold IPv4 in 4 bytes
+	ruleIPs := []net.IP{
+		net.ParseIP("10.1.0.2").To4(),
+		net.ParseIP("fd00::2"),
+		net.ParseIP("10.1.0.3"),
+		net.ParseIP("10.1.0.4").To4(),
+		net.ParseIP("fd00::4"),
+	}
+	require.Equal(t, []net.IP{ruleIPs[3], ruleIPs[4]}, staleSrcIPs(ruleIPs, profiles))
+	require.Len(t, staleSrcIPs(ruleIPs, nil), len(ruleIPs))
+}
@@ -2,10 +2,12 @@ package wgserver
 
 import (
 	"errors"
+	"fmt"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"log/slog"
 	"net"
 	"pbridge/pkg/ebpf"
+	"time"
 )
 
 type ProfileHandle struct {
@@ -45,6 +47,28 @@ func (s *ProfileHandle) SetupForwarding(ip4, ip6 net.IP, link uint32) error {
 	return nil
 }
 
+// SetupExit terminates peer traffic on this node: packets are passed to the kernel network stack instead of being
+// redirected to an upstream interface.
+func (s *ProfileHandle) SetupExit() error {
+	if s.IP4 != nil {
+		slog.Debug("server: set exit src rule", slog.Any("from", s.IP4))
+		err := s.handle.SetSrcRule(s.IP4, s.IP4, 0)
+		if err != nil {
+			return fmt.Errorf("set exit src rule: %w", err)
+		}
+	}
+
+	if s.IP6 != nil {
+		slog.Debug("server: set exit src rule", slog.Any("from", s.IP6))
+		err := s.handle.SetSrcRule(s.IP6, s.IP6, 0)
+		if err != nil {
+			return fmt.Errorf("set exit src rule: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (s *ProfileHandle) GetStats() (uint64, uint64) {
 	var counterPackets, counterBytes uint64
 
@@ -76,3 +100,25 @@ func (s *ProfileHandle) GetStats() (uint64, uint64) {
 
 	return counterPackets, counterBytes
 }
+
+// LastActivity returns time of the last packet sent by the peer, zero time if it has sent nothing since
+// forwarding was set up.
+func (s *ProfileHandle) LastActivity() time.Time {
+	var lastSeen uint64
+	var rule ebpf.RuleValue
+	for _, ip := range []net.IP{s.IP4, s.IP6} {
+		if ip == nil {
+			continue
+		}
+		err := s.handle.SrcRules.Lookup(&ebpf.RuleKey{IP: ip}, &rule)
+		if err != nil {
+			if !errors.Is(err, ebpf.ErrKeyNotExist) {
+				slog.Error("failed to lookup src rule", slog.Any("err", err))
+			}
+			continue
+		}
+		lastSeen = max(lastSeen, rule.LastSeen)
+	}
+
+	return ebpf.KtimeToTime(lastSeen)
+}
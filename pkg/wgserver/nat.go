@@ -0,0 +1,104 @@
+package wgserver
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const natRuleComment = "pbridge"
+
+type natRule struct {
+	cmd   string
+	table string
+	chain string
+	args  []string
+}
+
+func (r natRule) run(action string) error {
+	args := append([]string{"-w", "-t", r.table, action, r.chain}, r.args...)
+	args = append(args, "-m", "comment", "--comment", natRuleComment)
+	out, err := exec.Command(r.cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", r.cmd, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// EnableExitNAT enables IP forwarding and masquerades traffic of the wireguard subnets out of the external network
+// interface. It is used in exit-node mode, when client traffic is terminated on this bridge.
+func (s *Service) EnableExitNAT() error {
+	serverInterfaceName := s.getServerInterfaceName()
+
+	families := []struct {
+		family  int
+		cmd     string
+		subnet  string
+		sysctl  string
+		enabled bool
+	}{
+		{unix.AF_INET, "iptables", s.cfg.Subnet4, "/proc/sys/net/ipv4/ip_forward", true},
+		{unix.AF_INET6, "ip6tables", s.cfg.Subnet6, "/proc/sys/net/ipv6/conf/all/forwarding", s.cfg.Subnet6 != ""},
+	}
+
+	for _, f := range families {
+		if !f.enabled {
+			continue
+		}
+
+		externalLink, _, err := GetExternalLink(f.family)
+		if err != nil {
+			if f.family == unix.AF_INET6 {
+				slog.Warn("server: no external IPv6 interface, IPv6 exit traffic is disabled", slog.Any("err", err))
+				continue
+			}
+			return fmt.Errorf("failed to find external network interface: %w", err)
+		}
+		externalLinkName := externalLink.Attrs().Name
+
+		slog.Info("server: enable ip forwarding", slog.String("sysctl", f.sysctl))
+		if err := os.WriteFile(f.sysctl, []byte("1"), 0o644); err != nil {
+			return fmt.Errorf("enable ip forwarding: %w", err)
+		}
+
+		rules := []natRule{
+			{cmd: f.cmd, table: "nat", chain: "POSTROUTING",
+				args: []string{"-s", f.subnet, "-o", externalLinkName, "-j", "MASQUERADE"}},
+			{cmd: f.cmd, table: "filter", chain: "FORWARD",
+				args: []string{"-i", serverInterfaceName, "-o", externalLinkName, "-j", "ACCEPT"}},
+			{cmd: f.cmd, table: "filter", chain: "FORWARD",
+				args: []string{"-i", externalLinkName, "-o", serverInterfaceName,
+					"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+		}
+
+		for _, rule := range rules {
+			// skip rules left by previous run
+			if rule.run("-C") == nil {
+				s.natRules = append(s.natRules, rule)
+				continue
+			}
+
+			slog.Info("server: add exit nat rule", slog.String("cmd", rule.cmd), slog.String("table", rule.table),
+				slog.String("chain", rule.chain), slog.String("rule", strings.Join(rule.args, " ")))
+			if err := rule.run("-I"); err != nil {
+				return fmt.Errorf("add exit nat rule: %w", err)
+			}
+			s.natRules = append(s.natRules, rule)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) disableExitNAT() {
+	for _, rule := range s.natRules {
+		if err := rule.run("-D"); err != nil {
+			slog.Error("server: delete exit nat rule", slog.Any("err", err))
+		}
+	}
+	s.natRules = nil
+}
@@ -23,6 +23,7 @@ const defaulServerInterfacePrefix = "wgs"
 
 type Service struct {
 	cfg        *config.WireguardServerConfig
+	adopt      config.AdoptConfig
 	privateKey wgtypes.Key
 	publicKey  wgtypes.Key
 	client     *wgctrl.Client
@@ -33,14 +34,16 @@ type Service struct {
 	ip6        net.IP
 	ipPool4    *ippool.IPPool
 	ipPool6    *ippool.IPPool
+	natRules   []natRule
 
 	lock     sync.Mutex
 	profiles map[string]*ProfileHandle
 }
 
-func New(cfg *config.WireguardServerConfig) *Service {
+func New(cfg *config.WireguardServerConfig, adopt config.AdoptConfig) *Service {
 	return &Service{
 		cfg:      cfg,
+		adopt:    adopt,
 		profiles: map[string]*ProfileHandle{},
 	}
 }
@@ -57,6 +60,13 @@ func (s *Service) getServerInterfaceName() string {
 func (s *Service) Init() error {
 	slog.Info("server: initialization")
 
+	if s.adopt.Enabled {
+		err := ebpf.PreparePinPath(s.adopt.GetPinPath())
+		if err != nil {
+			return fmt.Errorf("server: prepare ebpf pin path: %w", err)
+		}
+	}
+
 	err := s.initWgHandler()
 	if err != nil {
 		return fmt.Errorf("server: init wireguard handler: %w", err)
@@ -116,27 +126,40 @@ func (s *Service) Init() error {
 
 	serverInterfaceName := s.getServerInterfaceName()
 
-	if link, err := netlink.LinkByName(serverInterfaceName); err == nil {
-		slog.Info("server: wireguard interface already exists, removing")
-		if err := netlink.LinkDel(link); err != nil {
-			return fmt.Errorf("remove wireguard interface: %w", err)
-		}
+	link, adopted, err := s.adoptLink(serverInterfaceName)
+	if err != nil {
+		return err
 	}
 
-	slog.Info("server: creating wireguard interface", slog.String("link", serverInterfaceName))
+	if !adopted {
+		if link, err := netlink.LinkByName(serverInterfaceName); err == nil {
+			slog.Info("server: wireguard interface already exists, removing")
+			if err := netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("remove wireguard interface: %w", err)
+			}
+		}
 
-	link := &netlink.Wireguard{
-		LinkAttrs: netlink.LinkAttrs{
-			Name: serverInterfaceName,
-		},
-	}
+		// maps pinned for the removed interface hold its stale rules
+		err = ebpf.RemovePinned(s.pinPath(serverInterfaceName))
+		if err != nil {
+			return fmt.Errorf("remove pinned ebpf objects: %w", err)
+		}
 
-	err = netlink.LinkAdd(link)
-	if err != nil {
-		return fmt.Errorf("add wireguard interface: %w", err)
-	}
+		slog.Info("server: creating wireguard interface", slog.String("link", serverInterfaceName))
+
+		link = &netlink.Wireguard{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: serverInterfaceName,
+			},
+		}
 
-	slog.Info("server: wireguard interface created", slog.String("link", serverInterfaceName))
+		err = netlink.LinkAdd(link)
+		if err != nil {
+			return fmt.Errorf("add wireguard interface: %w", err)
+		}
+
+		slog.Info("server: wireguard interface created", slog.String("link", serverInterfaceName))
+	}
 
 	for _, subnet := range []string{s.cfg.Subnet4, s.cfg.Subnet6} {
 		addr, err := netlink.ParseAddr(subnet)
@@ -145,7 +168,11 @@ func (s *Service) Init() error {
 		}
 
 		slog.Info("server: add subnet to wireguard interface", slog.String("link", serverInterfaceName), slog.String("subnet", subnet))
-		err = netlink.AddrAdd(link, addr)
+		if adopted {
+			err = netlink.AddrReplace(link, addr)
+		} else {
+			err = netlink.AddrAdd(link, addr)
+		}
 		if err != nil {
 			return fmt.Errorf("add subnet to wireguard interface: %w", err)
 		}
@@ -161,7 +188,7 @@ func (s *Service) Init() error {
 	}
 
 	slog.Info("server: install ebpf filter", slog.String("link", serverInterfaceName))
-	handle, err := ebpf.InstallEbpf(serverInterfaceName)
+	handle, err := ebpf.InstallEbpf(serverInterfaceName, s.pinPath(serverInterfaceName))
 	if err != nil {
 		return fmt.Errorf("install ebpf filter: %w", err)
 	}
@@ -184,6 +211,8 @@ func (s *Service) Init() error {
 	return nil
 }
 
+// Add adds peer with internal IPs allocated by AllocateInternalIPs. On error the IPs stay acquired and must be
+// released by the caller, on success they are released by Remove.
 func (s *Service) Add(profile *ServerProfile) (*ProfileHandle, error) {
 	slog.Info("server: add peer", slog.String("public_key", profile.ClientPublicKey))
 
@@ -215,10 +244,6 @@ func (s *Service) Add(profile *ServerProfile) (*ProfileHandle, error) {
 	defer s.lock.Unlock()
 
 	if _, ok := s.profiles[profile.ClientPublicKey]; ok {
-		s.ipPool4.Release(ip4)
-		if ip6 != nil {
-			s.ipPool6.Release(ip6)
-		}
 		return nil, fmt.Errorf("peer already exists")
 	}
 
@@ -232,10 +257,7 @@ func (s *Service) Add(profile *ServerProfile) (*ProfileHandle, error) {
 
 	err = s.updatePeersLocked()
 	if err != nil {
-		s.ipPool4.Release(ip4)
-		if ip6 != nil {
-			s.ipPool6.Release(ip6)
-		}
+		delete(s.profiles, profile.ClientPublicKey)
 		return nil, fmt.Errorf("update peers: %v", err)
 	}
 
@@ -328,6 +350,28 @@ func (s *Service) AllocateInternalIPs() (net.IP, net.IP, error) {
 	return ip4, ip6, nil
 }
 
+func (s *Service) ReleaseInternalIPs(ip4, ip6 net.IP) {
+	if ip4 != nil {
+		s.ipPool4.Release(ip4)
+	}
+
+	if ip6 != nil && s.ipPool6 != nil {
+		s.ipPool6.Release(ip6)
+	}
+}
+
+func (s *Service) SetupForwarding(handle *ProfileHandle, ip4, ip6 net.IP, link uint32) error {
+	return handle.SetupForwarding(ip4, ip6, link)
+}
+
+func (s *Service) SetupExit(handle *ProfileHandle) error {
+	return handle.SetupExit()
+}
+
+func (s *Service) LastActivity(handle *ProfileHandle) time.Time {
+	return handle.LastActivity()
+}
+
 func (s *Service) ReserveInternalIPs(ip4, ip6 net.IP) {
 	if ip4 != nil {
 		s.ipPool4.SetAcquired(ip4)
@@ -360,6 +404,10 @@ func (s *Service) DumpMaps() {
 }
 
 func (s *Service) Close() {
+	// with adoption exit traffic keeps flowing while restarting
+	if !s.adopt.Enabled {
+		s.disableExitNAT()
+	}
 	s.handle.Close()
 	s.handleWg.Close()
 }
@@ -371,7 +419,7 @@ func (s *Service) initWgHandler() error {
 	}
 
 	slog.Info("server: install ebpf wg filter prog", slog.String("link", externalLink.Attrs().Name))
-	handleWg, err := ebpf.InstallEbpfWg(externalLink)
+	handleWg, err := ebpf.InstallEbpfWg(externalLink, s.pinPath(externalLink.Attrs().Name))
 	if err != nil {
 		return fmt.Errorf("install ebpf filter: %v", err)
 	}
@@ -13,7 +13,7 @@ import (
 	"time"
 )
 
-func Connect(username, password string, servers []string) {
+func Connect(username, password string, servers []string, useOnion bool) {
 	// It is a test client. Pretty print and color everything.
 	slog.SetDefault(slog.New(
 		tint.NewHandler(os.Stderr, &tint.Options{
@@ -74,7 +74,14 @@ func Connect(username, password string, servers []string) {
 		"password":          password,
 		"client_public_key": clientPrivateKey.PublicKey().String(),
 	}
-	if len(nextHops) > 0 {
+	if useOnion {
+		onionRequest, err := wrapOnion(client, servers)
+		if err != nil {
+			slog.Error("Failed to wrap onion", slog.Any("err", err))
+			return
+		}
+		request["onion"] = onionRequest
+	} else if len(nextHops) > 0 {
 		request["next_hops"] = nextHops
 	}
 	requestBytes, err := json.Marshal(request)
@@ -108,7 +115,7 @@ func Connect(username, password string, servers []string) {
 
 	prepareWireguardConfig(clientDir, clientPrivateKey.String(), connectResponse)
 	dockerRunClient(clientDir)
-	updateWorker(client, serverUrl, username, password, connectResponse)
+	updateWorker(client, serverUrl, connectResponse)
 }
 
 type ConnectResponse struct {
@@ -128,4 +135,5 @@ type ConnectResponse struct {
 	PersistentKeepaliveInterval int    `json:"persistent_keepalive_interval"`
 	RXTimeout                   int    `json:"rx_timeout"`
 	TTL                         int    `json:"ttl"`
+	SessionToken                string `json:"session_token"`
 }
@@ -0,0 +1,51 @@
+package testclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"pbridge/pkg/onion"
+)
+
+// wrapOnion fetches onion keys of all servers and wraps the chain into onion layers.
+func wrapOnion(client *http.Client, servers []string) (string, error) {
+	hops := make([]onion.Hop, 0, len(servers))
+	for _, server := range servers {
+		publicKey, err := requestKey(client, server)
+		if err != nil {
+			return "", fmt.Errorf("request key from %s: %w", server, err)
+		}
+		slog.Debug("Server onion key", slog.String("server", server), slog.String("key", publicKey))
+		hops = append(hops, onion.Hop{URL: server, PublicKey: publicKey})
+	}
+
+	return onion.Wrap(hops)
+}
+
+func requestKey(client *http.Client, server string) (string, error) {
+	requestUrl, err := url.JoinPath(server, "/wireguard/key")
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Get(requestUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var keyResponse struct {
+		Result    string `json:"result"`
+		PublicKey string `json:"public_key"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&keyResponse)
+	if err != nil {
+		return "", err
+	}
+	return keyResponse.PublicKey, nil
+}
@@ -10,7 +10,7 @@ import (
 	"time"
 )
 
-func updateWorker(client *http.Client, serverUrl, username, password string, connectResponse ConnectResponse) {
+func updateWorker(client *http.Client, serverUrl string, connectResponse ConnectResponse) {
 	slog.Info("Starting update worker")
 	lastUpdate := time.Now()
 	ttl := time.Duration(connectResponse.TTL) * time.Second
@@ -22,16 +22,15 @@ func updateWorker(client *http.Client, serverUrl, username, password string, con
 		}
 
 		// renew the session
-		requestUpdate(client, serverUrl, username, password, connectResponse.SessionID)
+		requestUpdate(client, serverUrl, connectResponse.SessionID, connectResponse.SessionToken)
 		lastUpdate = time.Now()
 	}
 }
 
-func requestUpdate(client *http.Client, serverUrl, username, password, sessionId string) time.Duration {
+func requestUpdate(client *http.Client, serverUrl, sessionId, sessionToken string) time.Duration {
 	request := map[string]any{
-		"username":   username,
-		"password":   password,
-		"session_id": sessionId,
+		"session_id":    sessionId,
+		"session_token": sessionToken,
 	}
 	requestBytes, err := json.Marshal(request)
 	if err != nil {